@@ -0,0 +1,101 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+)
+
+// GeneratedKeySize is the size of the RSA keys that GenerateSelfSignedCert
+// generates.
+const GeneratedKeySize = 2048
+
+// GenerateSelfSignedCert generates an RSA key and a certificate for it,
+// signed by the key itself, that is suitable as the Key and Certificate of a
+// ServiceProvider: its subject is cn, it is valid from now for validity,
+// and its key may be used both to sign requests and to decrypt assertions.
+// The key is an *rsa.PrivateKey. certPEM and keyPEM are the certificate and
+// the PKCS#1 key in PEM format, which can be loaded with tls.X509KeyPair
+// and SetTLSCertificate or written to files for tls.LoadX509KeyPair.
+//
+// SAML does not rely on the certificate chaining to a trusted root, so a
+// self-signed certificate is sufficient for most deployments.
+func GenerateSelfSignedCert(cn string, validity time.Duration) (key crypto.Signer, certPEM []byte, keyPEM []byte, err error) {
+	if cn == "" {
+		return nil, nil, nil, fmt.Errorf("cannot generate certificate: empty common name")
+	}
+	if validity <= 0 {
+		return nil, nil, nil, fmt.Errorf("cannot generate certificate: validity must be positive")
+	}
+
+	rsaKey, err := rsa.GenerateKey(RandReader, GeneratedKeySize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	subjectKeyID, err := subjectKeyIdentifier(&rsaKey.PublicKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	now := TimeNow()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             now,
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		SubjectKeyId:          subjectKeyID,
+		AuthorityKeyId:        subjectKeyID,
+	}
+	certDER, err := x509.CreateCertificate(RandReader, template, template, &rsaKey.PublicKey, rsaKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	return rsaKey, certPEM, keyPEM, nil
+}
+
+// randomSerialNumber returns a random positive serial number of 128 bits,
+// as recommended by RFC 5280.
+func randomSerialNumber() (*big.Int, error) {
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(RandReader, buf); err != nil {
+		return nil, err
+	}
+	buf[0] &= 0x7f
+	return new(big.Int).SetBytes(buf), nil
+}
+
+// subjectKeyIdentifier returns the SHA-1 hash of the DER encoded public key,
+// the first method of RFC 5280 section 4.2.1.2. It lets an IDP name the
+// certificate in the EncryptedKey of an assertion it encrypts to it.
+func subjectKeyIdentifier(key *rsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	publicKeyInfo := struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{}
+	if _, err := asn1.Unmarshal(der, &publicKeyInfo); err != nil {
+		return nil, err
+	}
+	digest := sha1.Sum(publicKeyInfo.PublicKey.Bytes)
+	return digest[:], nil
+}
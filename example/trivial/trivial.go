@@ -18,8 +18,8 @@ func main() {
 	samlSP, _ := samlsp.New(samlsp.Options{
 		IDPMetadataURL: "https://www.testshib.org/metadata/testshib-providers.xml",
 		URL:            "http://localhost:8000",
-		Key:            string(key),
-		Certificate:    string(cert),
+		KeyPEM:         key,
+		CertificatePEM: cert,
 	})
 	app := http.HandlerFunc(hello)
 	http.Handle("/hello", samlSP.RequireAccount(app))
@@ -2,13 +2,13 @@ package saml
 
 import (
 	"bytes"
-	"compress/flate"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
 	"encoding/xml"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -65,10 +65,27 @@ type SessionProvider interface {
 type IdentityProvider struct {
 	Key              string
 	Certificate      string
+	CertificateChain []string // intermediates, see ServiceProvider.CertificateChain
 	MetadataURL      string
 	SSOURL           string
 	ServiceProviders map[string]*Metadata
 	SessionProvider  SessionProvider
+
+	// CanonicalizationMethod is the XML canonicalization method of the
+	// assertion signatures, as for ServiceProvider.CanonicalizationMethod.
+	CanonicalizationMethod string
+
+	// SignatureMethod is the XML signature method of the assertion
+	// signatures, as for ServiceProvider.SignatureMethod.
+	SignatureMethod string
+
+	// SignResponses, if set, signs each Response as well as the assertion
+	// it carries, for service providers that require a signed Response.
+	SignResponses bool
+
+	// PostTemplate, if not nil, renders the HTML form that sends responses
+	// with the HTTP-POST binding, as for ServiceProvider.PostTemplate.
+	PostTemplate *template.Template
 }
 
 // Metadata returns the metadata structure for this identity provider.
@@ -222,10 +239,7 @@ func (idp *IdentityProvider) ServeIDPInitiated(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	for _, endpoint := range req.ServiceProviderMetadata.SPSSODescriptor.AssertionConsumerService {
-		req.ACSEndpoint = &endpoint
-		break
-	}
+	req.ACSEndpoint = defaultEndpoint(req.ServiceProviderMetadata.SPSSODescriptor.AssertionConsumerService)
 
 	if err := req.MakeAssertion(session); err != nil {
 		log.Printf("failed to make assertion: %s", err)
@@ -251,6 +265,7 @@ type IdpAuthnRequest struct {
 	Assertion               *Assertion
 	AssertionBuffer         []byte
 	Response                *Response
+	ResponseBuffer          []byte
 }
 
 // NewIdpAuthnRequest returns a new IdpAuthnRequest for the given HTTP request to the authorization
@@ -263,23 +278,20 @@ func NewIdpAuthnRequest(idp *IdentityProvider, r *http.Request) (*IdpAuthnReques
 
 	switch r.Method {
 	case "GET":
-		compressedRequest, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("SAMLRequest"))
+		var err error
+		req.RequestBuffer, err = DecodeMessage(HTTPRedirectBinding, r.URL.Query().Get("SAMLRequest"))
 		if err != nil {
 			return nil, fmt.Errorf("cannot decode request: %s", err)
 		}
-		req.RequestBuffer, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressedRequest)))
-		if err != nil {
-			return nil, fmt.Errorf("cannot decompress request: %s", err)
-		}
 		req.RelayState = r.URL.Query().Get("RelayState")
 	case "POST":
 		if err := r.ParseForm(); err != nil {
 			return nil, err
 		}
 		var err error
-		req.RequestBuffer, err = base64.StdEncoding.DecodeString(r.PostForm.Get("SAMLRequest"))
+		req.RequestBuffer, err = DecodeMessage(HTTPPostBinding, r.PostForm.Get("SAMLRequest"))
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("cannot decode request: %s", err)
 		}
 		req.RelayState = r.PostForm.Get("RelayState")
 	default:
@@ -318,26 +330,71 @@ func (req *IdpAuthnRequest) Validate() error {
 	}
 	req.ServiceProviderMetadata = serviceProvider
 
-	// Check that the ACS URL matches an ACS endpoint in the SP metadata.
-	acsValid := false
-	for _, acsEndpoint := range serviceProvider.SPSSODescriptor.AssertionConsumerService {
-		if req.Request.AssertionConsumerServiceURL == acsEndpoint.Location {
-			req.ACSEndpoint = &acsEndpoint
-			acsValid = true
-			break
+	// Find the ACS endpoint in the SP metadata that the request asks for by
+	// index or URL, or else the default one.
+	endpoints := serviceProvider.SPSSODescriptor.AssertionConsumerService
+	switch {
+	case req.Request.AssertionConsumerServiceIndex != nil:
+		index := *req.Request.AssertionConsumerServiceIndex
+		for i := range endpoints {
+			if endpoints[i].Index == index {
+				req.ACSEndpoint = &endpoints[i]
+				break
+			}
+		}
+		if req.ACSEndpoint == nil {
+			return fmt.Errorf("invalid ACS index specified in request: %d", index)
+		}
+	case req.Request.AssertionConsumerServiceURL != "":
+		for i := range endpoints {
+			if endpoints[i].Location == req.Request.AssertionConsumerServiceURL &&
+				(req.Request.ProtocolBinding == "" || endpoints[i].Binding == req.Request.ProtocolBinding) {
+				req.ACSEndpoint = &endpoints[i]
+				break
+			}
+		}
+		if req.ACSEndpoint == nil {
+			return fmt.Errorf("invalid ACS url specified in request: %s", req.Request.AssertionConsumerServiceURL)
+		}
+	default:
+		req.ACSEndpoint = defaultEndpoint(endpoints)
+		if req.ACSEndpoint == nil {
+			return fmt.Errorf("service provider %s has no ACS endpoint", req.Request.Issuer.Value)
 		}
-	}
-	if !acsValid {
-		return fmt.Errorf("invalid ACS url specified in request: %s", req.Request.AssertionConsumerServiceURL)
 	}
 
 	return nil
 }
 
+// defaultEndpoint returns the default of endpoints: the first whose
+// isDefault is true, or else the first for which it is not set, or else the
+// first. It returns nil if there are none.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.2.3
+func defaultEndpoint(endpoints []IndexedEndpoint) *IndexedEndpoint {
+	for i := range endpoints {
+		if endpoints[i].IsDefault != nil && *endpoints[i].IsDefault {
+			return &endpoints[i]
+		}
+	}
+	for i := range endpoints {
+		if endpoints[i].IsDefault == nil {
+			return &endpoints[i]
+		}
+	}
+	if len(endpoints) > 0 {
+		return &endpoints[0]
+	}
+	return nil
+}
+
 // MakeAssertion produces a SAML assertion for the
 // given request and assigns it to req.Assertion.
 func (req *IdpAuthnRequest) MakeAssertion(session *Session) error {
-	signatureTemplate := xmlsec.DefaultSignature(req.IDP.Certificate)
+	signatureTemplate, err := makeSignature(req.IDP.CanonicalizationMethod, req.IDP.SignatureMethod, req.IDP.Certificate, req.IDP.CertificateChain)
+	if err != nil {
+		return err
+	}
 	attributes := []Attribute{}
 	if session.UserName != "" {
 		attributes = append(attributes, Attribute{
@@ -441,7 +498,7 @@ func (req *IdpAuthnRequest) MakeAssertion(session *Session) error {
 				Value:           session.NameID,
 			},
 			SubjectConfirmation: &SubjectConfirmation{
-				Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
+				Method: BearerConfirmationMethod,
 				SubjectConfirmationData: SubjectConfirmationData{
 					Address:      req.HTTPRequest.RemoteAddr,
 					InResponseTo: req.Request.ID,
@@ -454,7 +511,7 @@ func (req *IdpAuthnRequest) MakeAssertion(session *Session) error {
 			NotBefore:    now,
 			NotOnOrAfter: now.Add(MaxIssueDelay),
 			AudienceRestriction: &AudienceRestriction{
-				Audience: &Audience{Value: req.ServiceProviderMetadata.EntityID},
+				Audiences: []Audience{{Value: req.ServiceProviderMetadata.EntityID}},
 			},
 		},
 		AuthnStatement: &AuthnStatement{
@@ -534,38 +591,68 @@ func (req *IdpAuthnRequest) MakeResponse() error {
 			EncryptedData: req.AssertionBuffer,
 		},
 	}
+
+	if req.IDP.SignResponses {
+		signatureTemplate, err := makeSignature(req.IDP.CanonicalizationMethod, req.IDP.SignatureMethod, req.IDP.Certificate, req.IDP.CertificateChain)
+		if err != nil {
+			return err
+		}
+		signatureTemplate.SignedInfo.Reference.URI = "#" + req.Response.ID
+		req.Response.Signature = &signatureTemplate
+	}
 	return nil
 }
 
-// WriteResponse writes the `Response` to the http.ResponseWriter. If
-// `Response` is not already set, it calls MakeResponse to produce it.
-func (req *IdpAuthnRequest) WriteResponse(w http.ResponseWriter) error {
+// MarshalResponse sets `ResponseBuffer` to the serialized `Response`,
+// signed with the IDP key if it has a signature template, as MakeResponse
+// adds when IDP.SignResponses is set. If `Response` is not already set, it
+// calls MakeResponse to produce it.
+func (req *IdpAuthnRequest) MarshalResponse() error {
 	if req.Response == nil {
 		if err := req.MakeResponse(); err != nil {
 			return err
 		}
 	}
-	responseBuf, err := xml.Marshal(req.Response)
+	buf, err := xml.Marshal(req.Response)
 	if err != nil {
 		return err
 	}
+	if req.Response.Signature == nil {
+		req.ResponseBuffer = buf
+		return nil
+	}
+
+	key, err := parseRSAPrivateKey(req.IDP.Key)
+	if err != nil {
+		return err
+	}
+	signedXML, err := xmlsec.SignResponse(string(buf), key)
+	if err != nil {
+		return err
+	}
+	req.ResponseBuffer = []byte(signedXML)
+	return nil
+}
+
+// WriteResponse writes the `ResponseBuffer` to the http.ResponseWriter. If
+// `ResponseBuffer` is not already set, it calls MarshalResponse to produce
+// it.
+func (req *IdpAuthnRequest) WriteResponse(w http.ResponseWriter) error {
+	if req.ResponseBuffer == nil {
+		if err := req.MarshalResponse(); err != nil {
+			return err
+		}
+	}
+	responseBuf := req.ResponseBuffer
 
 	// the only supported binding is the HTTP-POST binding
 	switch req.ACSEndpoint.Binding {
 	case HTTPPostBinding:
-		tmpl := template.Must(template.New("saml-post-form").Parse(`<html>` +
-			`<form method="post" action="{{.URL}}" id="SAMLResponseForm">` +
-			`<input type="hidden" name="SAMLResponse" value="{{.SAMLResponse}}" />` +
-			`<input type="hidden" name="RelayState" value="{{.RelayState}}" />` +
-			`<input type="submit" value="Continue" />` +
-			`</form>` +
-			`<script>document.getElementById('SAMLResponseForm').submit();</script>` +
-			`</html>`))
-		data := struct {
-			URL          string
-			SAMLResponse string
-			RelayState   string
-		}{
+		tmpl := req.IDP.PostTemplate
+		if tmpl == nil {
+			tmpl = defaultResponsePostTemplate
+		}
+		data := PostFormData{
 			URL:          req.ACSEndpoint.Location,
 			SAMLResponse: base64.StdEncoding.EncodeToString(responseBuf),
 			RelayState:   req.RelayState,
@@ -587,6 +674,38 @@ func (req *IdpAuthnRequest) WriteResponse(w http.ResponseWriter) error {
 	}
 }
 
+// defaultResponsePostTemplate renders the form of a response when no
+// PostTemplate is given.
+var defaultResponsePostTemplate = template.Must(template.New("saml-post-form").Parse(`<html>` +
+	`<form method="post" action="{{.URL}}" id="SAMLResponseForm">` +
+	`<input type="hidden" name="SAMLResponse" value="{{.SAMLResponse}}" />` +
+	`<input type="hidden" name="RelayState" value="{{.RelayState}}" />` +
+	`<input type="submit" value="Continue" />` +
+	`</form>` +
+	`<script>document.getElementById('SAMLResponseForm').submit();</script>` +
+	`</html>`))
+
+// parseRSAPrivateKey parses an RSA private key in PEM format, either in
+// PKCS#1 or PKCS#8 form.
+func parseRSAPrivateKey(keyPEM string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("cannot decode private key: no PEM block")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse private key: %s", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T, only RSA keys are supported", key)
+	}
+	return rsaKey, nil
+}
+
 // getSPEncryptionCert returns the certificate which we can use to encrypt things
 // to the SP in PEM format, or nil if no such certificate is found.
 func getSPEncryptionCert(sp *Metadata) []byte {
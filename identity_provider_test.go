@@ -297,15 +297,15 @@ func (test *IdentityProviderTest) TestCanParse(c *C) {
 
 	r, _ = http.NewRequest("GET", "https://idp.example.com/saml/sso?RelayState=ThisIsTheRelayState", nil)
 	_, err = NewIdpAuthnRequest(&test.IDP, r)
-	c.Assert(err, ErrorMatches, "cannot decompress request: unexpected EOF")
+	c.Assert(err, ErrorMatches, "cannot decode request: cannot inflate: unexpected EOF")
 
 	r, _ = http.NewRequest("GET", "https://idp.example.com/saml/sso?RelayState=ThisIsTheRelayState&SAMLRequest=NotValidBase64", nil)
 	_, err = NewIdpAuthnRequest(&test.IDP, r)
-	c.Assert(err, ErrorMatches, "cannot decode request: illegal base64 data at input byte 12")
+	c.Assert(err, ErrorMatches, "cannot decode request: cannot parse base64: illegal base64 data at input byte 12")
 
 	r, _ = http.NewRequest("GET", "https://idp.example.com/saml/sso?RelayState=ThisIsTheRelayState&SAMLRequest=bm90IGZsYXRlIGVuY29kZWQ%3D", nil)
 	_, err = NewIdpAuthnRequest(&test.IDP, r)
-	c.Assert(err, ErrorMatches, "cannot decompress request: flate: corrupt input before offset 1")
+	c.Assert(err, ErrorMatches, "cannot decode request: cannot inflate: flate: corrupt input before offset 1")
 
 	r, _ = http.NewRequest("FROBNICATE", "https://idp.example.com/saml/sso?RelayState=ThisIsTheRelayState&SAMLRequest=lJJBayoxFIX%2FypC9JhnU5wszAz7lgWCLaNtFd5fMbQ1MkmnunVb%2FfUfbUqEgdhs%2BTr5zkmLW8S5s8KVD4mzvm0Cl6FIwEciRCeCRDFuznd2sTD5Upk2Ro42NyGZEmNjFMI%2BBOo9pi%2BnVWbzfrEqxY27JSEntEPfg2waHNnpJ4JtcgiWRLfoLXYBjwDfu6p%2B8JIoiWy5K4eqBUipXIzVRUwXKKtRK53qkJ3qqQVuNPUjU4TIQQ%2BBS5EqPBzofKH2ntBn%2FMervo8jWnyX%2BuVC78FwKkT1gopNKX1JUxSklXTMIfM0gsv8xeeDL%2BPGk7%2FF0Qg0GdnwQ1cW5PDLUwFDID6uquO1Dlot1bJw9%2FPLRmia%2BzRMCYyk4dSiq6205QSDXOxfy3KAq5Pkvqt4DAAD%2F%2Fw%3D%3D", nil)
 	_, err = NewIdpAuthnRequest(&test.IDP, r)
@@ -426,6 +426,58 @@ func (test *IdentityProviderTest) TestCanValidate(c *C) {
 
 }
 
+func (test *IdentityProviderTest) TestValidateACSEndpoint(c *C) {
+	isDefault := true
+	test.IDP.ServiceProviders[test.SP.MetadataURL].SPSSODescriptor.AssertionConsumerService = []IndexedEndpoint{
+		{Binding: HTTPPostBinding, Location: "https://sp.example.com/saml2/acs", Index: 1},
+		{Binding: HTTPPostBinding, Location: "https://sp.example.com/saml2/acs2", Index: 2, IsDefault: &isDefault},
+	}
+	validate := func(acsAttrs string) (*IndexedEndpoint, error) {
+		req := IdpAuthnRequest{
+			IDP: &test.IDP,
+			RequestBuffer: []byte("" +
+				"<AuthnRequest xmlns=\"urn:oasis:names:tc:SAML:2.0:protocol\" " + acsAttrs +
+				"  Destination=\"https://idp.example.com/saml/sso\" " +
+				"  ID=\"id-00020406080a0c0e10121416181a1c1e\" " +
+				"  IssueInstant=\"2015-12-01T01:57:09Z\" " +
+				"  Version=\"2.0\">" +
+				"  <Issuer xmlns=\"urn:oasis:names:tc:SAML:2.0:assertion\" " +
+				"    Format=\"urn:oasis:names:tc:SAML:2.0:nameid-format:entity\">https://sp.example.com/saml2/metadata</Issuer>" +
+				"</AuthnRequest>"),
+		}
+		req.HTTPRequest, _ = http.NewRequest("POST", "http://idp.example.com/saml/sso", nil)
+		err := req.Validate()
+		return req.ACSEndpoint, err
+	}
+
+	endpoint, err := validate(`AssertionConsumerServiceIndex="1"`)
+	c.Assert(err, IsNil)
+	c.Assert(endpoint.Location, Equals, "https://sp.example.com/saml2/acs")
+
+	endpoint, err = validate(`AssertionConsumerServiceURL="https://sp.example.com/saml2/acs2" ProtocolBinding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"`)
+	c.Assert(err, IsNil)
+	c.Assert(endpoint.Index, Equals, 2)
+
+	// without either, the default endpoint is used
+	endpoint, err = validate("")
+	c.Assert(err, IsNil)
+	c.Assert(endpoint.Location, Equals, "https://sp.example.com/saml2/acs2")
+
+	_, err = validate(`AssertionConsumerServiceIndex="3"`)
+	c.Assert(err, ErrorMatches, "invalid ACS index specified in request: 3")
+
+	_, err = validate(`AssertionConsumerServiceURL="https://sp.example.com/saml2/acs" ProtocolBinding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"`)
+	c.Assert(err, ErrorMatches, "invalid ACS url specified in request: https://sp.example.com/saml2/acs")
+}
+
+func (test *IdentityProviderTest) TestDefaultEndpoint(c *C) {
+	yes, no := true, false
+	c.Assert(defaultEndpoint(nil), IsNil)
+	c.Assert(defaultEndpoint([]IndexedEndpoint{{Index: 1}, {Index: 2, IsDefault: &yes}}).Index, Equals, 2)
+	c.Assert(defaultEndpoint([]IndexedEndpoint{{Index: 1, IsDefault: &no}, {Index: 2}}).Index, Equals, 2)
+	c.Assert(defaultEndpoint([]IndexedEndpoint{{Index: 1, IsDefault: &no}, {Index: 2, IsDefault: &no}}).Index, Equals, 1)
+}
+
 func (test *IdentityProviderTest) TestMakeAssertion(c *C) {
 	req := IdpAuthnRequest{
 		IDP: &test.IDP,
@@ -480,7 +532,7 @@ func (test *IdentityProviderTest) TestMakeAssertion(c *C) {
 			},
 			SignatureValue:  "",
 			KeyName:         "",
-			X509Certificate: &xmlsec.SignatureX509Data{X509Certificate: "MIIB7zCCAVgCCQDFzbKIp7b3MTANBgkqhkiG9w0BAQUFADA8MQswCQYDVQQGEwJVUzELMAkGA1UECAwCR0ExDDAKBgNVBAoMA2ZvbzESMBAGA1UEAwwJbG9jYWxob3N0MB4XDTEzMTAwMjAwMDg1MVoXDTE0MTAwMjAwMDg1MVowPDELMAkGA1UEBhMCVVMxCzAJBgNVBAgMAkdBMQwwCgYDVQQKDANmb28xEjAQBgNVBAMMCWxvY2FsaG9zdDCBnzANBgkqhkiG9w0BAQEFAAOBjQAwgYkCgYEA1PMHYmhZj308kWLhZVT4vOulqx/9ibm5B86fPWwUKKQ2i12MYtz07tzukPymisTDhQaqyJ8Kqb/6JjhmeMnEOdTvSPmHO8m1ZVveJU6NoKRn/mP/BD7FW52WhbrUXLSeHVSKfWkNk6S4hk9MV9TswTvyRIKvRsw0X/gfnqkroJcCAwEAATANBgkqhkiG9w0BAQUFAAOBgQCMMlIO+GNcGekevKgkakpMdAqJfs24maGb90DvTLbRZRD7Xvn1MnVBBS9hzlXiFLYOInXACMW5gcoRFfeTQLSouMM8o57h0uKjfTmuoWHLQLi6hnF+cvCsEFiJZ4AbF+DgmO6TarJ8O05t8zvnOwJlNCASPZRH/JmF8tX0hoHuAQ=="},
+			X509Certificate: &xmlsec.SignatureX509Data{X509Certificates: []string{"MIIB7zCCAVgCCQDFzbKIp7b3MTANBgkqhkiG9w0BAQUFADA8MQswCQYDVQQGEwJVUzELMAkGA1UECAwCR0ExDDAKBgNVBAoMA2ZvbzESMBAGA1UEAwwJbG9jYWxob3N0MB4XDTEzMTAwMjAwMDg1MVoXDTE0MTAwMjAwMDg1MVowPDELMAkGA1UEBhMCVVMxCzAJBgNVBAgMAkdBMQwwCgYDVQQKDANmb28xEjAQBgNVBAMMCWxvY2FsaG9zdDCBnzANBgkqhkiG9w0BAQEFAAOBjQAwgYkCgYEA1PMHYmhZj308kWLhZVT4vOulqx/9ibm5B86fPWwUKKQ2i12MYtz07tzukPymisTDhQaqyJ8Kqb/6JjhmeMnEOdTvSPmHO8m1ZVveJU6NoKRn/mP/BD7FW52WhbrUXLSeHVSKfWkNk6S4hk9MV9TswTvyRIKvRsw0X/gfnqkroJcCAwEAATANBgkqhkiG9w0BAQUFAAOBgQCMMlIO+GNcGekevKgkakpMdAqJfs24maGb90DvTLbRZRD7Xvn1MnVBBS9hzlXiFLYOInXACMW5gcoRFfeTQLSouMM8o57h0uKjfTmuoWHLQLi6hnF+cvCsEFiJZ4AbF+DgmO6TarJ8O05t8zvnOwJlNCASPZRH/JmF8tX0hoHuAQ=="}},
 		},
 		Subject: &Subject{
 			NameID: &NameID{Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:transient", NameQualifier: "https://idp.example.com/saml/metadata", SPNameQualifier: "https://sp.example.com/saml2/metadata", Value: ""},
@@ -498,7 +550,7 @@ func (test *IdentityProviderTest) TestMakeAssertion(c *C) {
 			NotBefore:    TimeNow(),
 			NotOnOrAfter: TimeNow().Add(MaxIssueDelay),
 			AudienceRestriction: &AudienceRestriction{
-				Audience: &Audience{Value: "https://sp.example.com/saml2/metadata"},
+				Audiences: []Audience{{Value: "https://sp.example.com/saml2/metadata"}},
 			},
 		},
 		AuthnStatement: &AuthnStatement{
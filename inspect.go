@@ -0,0 +1,194 @@
+package saml
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+)
+
+// InspectionResult describes what ParseResponse would make of a response,
+// as returned by InspectResponse. It is meant to be marshalled to JSON, e.g.
+// to show to whoever is setting up the federation with a new IDP.
+type InspectionResult struct {
+	// Valid is true if all the checks passed, i.e. if ParseResponse would
+	// accept the response, provided that InResponseTo is the ID of one of
+	// our requests.
+	Valid  bool    `json:"valid"`
+	Checks []Check `json:"checks"`
+
+	ResponseID   string `json:"response_id,omitempty"`
+	InResponseTo string `json:"in_response_to,omitempty"`
+	Issuer       string `json:"issuer,omitempty"`
+	Encrypted    bool   `json:"encrypted"`
+
+	// NameID and Attributes are taken from the assertion even if checks
+	// failed, and must then not be trusted.
+	NameID     *NameID     `json:"name_id,omitempty"`
+	Attributes []Attribute `json:"attributes,omitempty"`
+}
+
+// Check is the outcome of one of the checks of InspectResponse, e.g.
+// "signature" or "audience". Error is empty if it passed.
+type Check struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// InspectResponse is a dry run of ParseResponse for the response received
+// in req: rather than stopping at the first problem, it runs each check on
+// its own and reports the outcome of all of them, along with the NameID and
+// attributes of the assertion. It does not record the assertion in the
+// ReplayCache, and whatever it returns must not be taken to authenticate
+// anyone.
+//
+// The checks are "metadata" if RejectExpiredMetadata is set, "destination",
+// "issue_instant", "issuer", "status" and "structure" of the response,
+// "decryption" if the assertion is encrypted, "signature", and "name_id",
+// "attributes", "assertion_issue_instant", "assertion_issuer",
+// "subject_confirmation", "conditions" and "audience" of the assertion. The
+// "structure" check is the one ParseResponse makes, strict if StrictXML is
+// set, which also fails for more than one assertion; if it fails, the
+// assertion checks are not run. InResponseTo is not checked, as there is no
+// way of knowing which requests are outstanding.
+//
+// It returns an error only if the response cannot be decoded at all, e.g.
+// because it is larger than MaxMessageSize allows.
+func (sp *ServiceProvider) InspectResponse(req *http.Request) (*InspectionResult, error) {
+	values, binding, err := sp.ResponseValues(req)
+	if err != nil {
+		return nil, err
+	}
+	rawResponseBuf, err := sp.decodeResponse(binding, values.Get("SAMLResponse"))
+	if err != nil {
+		return nil, err
+	}
+	resp := Response{}
+	if err := xml.Unmarshal(rawResponseBuf, &resp); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal response: %s", err)
+	}
+
+	now := TimeNow()
+	rv := &InspectionResult{
+		Valid:        true,
+		ResponseID:   resp.ID,
+		InResponseTo: resp.InResponseTo,
+		Encrypted:    resp.EncryptedAssertion != nil,
+	}
+	check := func(name string, err error) {
+		c := Check{Name: name, Passed: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+			rv.Valid = false
+		}
+		rv.Checks = append(rv.Checks, c)
+	}
+
+	if sp.RejectExpiredMetadata {
+		check("metadata", sp.checkMetadataExpiry(now))
+	}
+	acsURLs := sp.receivingAcsURLs(req)
+	if resp.Destination != "" && !containsString(acsURLs, resp.Destination) {
+		check("destination", &DestinationMismatchError{Expected: acsURLs[0], Actual: resp.Destination})
+	} else {
+		check("destination", nil)
+	}
+	check("issue_instant", sp.checkResponseIssueInstant(resp.IssueInstant, now))
+	if resp.Issuer != nil {
+		rv.Issuer = resp.Issuer.Value
+	}
+	if rv.Issuer != sp.IDPMetadata.EntityID {
+		check("issuer", &IssuerMismatchError{Expected: sp.IDPMetadata.EntityID, Actual: rv.Issuer})
+	} else {
+		check("issuer", nil)
+	}
+	if resp.Status == nil {
+		check("status", fmt.Errorf("response has no Status"))
+	} else {
+		check("status", checkStatus(resp.Status))
+	}
+
+	structureErr := sp.checkStructure(rawResponseBuf)
+	check("structure", structureErr)
+	if structureErr != nil {
+		return rv, nil
+	}
+
+	var assertion *Assertion
+	if resp.EncryptedAssertion != nil {
+		plaintextAssertion, err := sp.decrypt(req.Context(), string(resp.EncryptedAssertion.EncryptedData))
+		if err == nil {
+			assertion = &Assertion{}
+			if err = xml.Unmarshal([]byte(plaintextAssertion), assertion); err != nil {
+				assertion = nil
+				err = fmt.Errorf("cannot unmarshal assertion: %s", err)
+			}
+		}
+		if err != nil {
+			check("decryption", fmt.Errorf("failed to decrypt response: %s", err))
+		} else {
+			check("decryption", nil)
+			assertion.RawXML = []byte(plaintextAssertion)
+			err := sp.validateEncryptedResponseSignature(req.Context(), &resp, rawResponseBuf)
+			if err == nil {
+				err = sp.validateDecryptedAssertionSignature(req.Context(), assertion)
+			}
+			check("signature", err)
+		}
+	} else if resp.Assertion != nil {
+		assertion = resp.Assertion
+		assertion.RawXML = assertion.rawXML(rawResponseBuf)
+		check("signature", sp.validateResponseSignatures(req.Context(), &resp, rawResponseBuf))
+	}
+	if assertion == nil {
+		if resp.EncryptedAssertion == nil {
+			check("assertion", fmt.Errorf("response does not contain an assertion"))
+		}
+		return rv, nil
+	}
+
+	if err := sp.decryptNameID(req.Context(), assertion); err != nil {
+		check("name_id", err)
+	} else {
+		if assertion.Subject != nil {
+			rv.NameID = assertion.Subject.NameID
+		}
+		check("name_id", sp.validateNameID(rv.NameID))
+	}
+	if assertion.AttributeStatement != nil {
+		rv.Attributes = assertion.AttributeStatement.Attributes
+	}
+	check("attributes", sp.checkAttributeLimits(assertion))
+
+	check("assertion_issue_instant", sp.checkAssertionIssueInstant(assertion.IssueInstant, now))
+	if assertion.Issuer == nil || assertion.Issuer.Value != sp.IDPMetadata.EntityID {
+		actual := ""
+		if assertion.Issuer != nil {
+			actual = assertion.Issuer.Value
+		}
+		check("assertion_issuer", &IssuerMismatchError{Expected: sp.IDPMetadata.EntityID, Actual: actual, InAssertion: true})
+	} else {
+		check("assertion_issuer", nil)
+	}
+
+	if assertion.Subject == nil || assertion.Subject.SubjectConfirmation == nil {
+		check("subject_confirmation", fmt.Errorf("assertion has no SubjectConfirmation"))
+	} else if method := assertion.Subject.SubjectConfirmation.Method; !sp.subjectConfirmationMethodAllowed(method) {
+		check("subject_confirmation", &SubjectConfirmationMethodError{Expected: sp.subjectConfirmationMethods(), Actual: method})
+	} else {
+		check("subject_confirmation", sp.validateSubjectConfirmationData(assertion.Subject.SubjectConfirmation.SubjectConfirmationData, acsURLs, now))
+	}
+
+	if assertion.Conditions == nil {
+		check("conditions", fmt.Errorf("assertion has no Conditions"))
+		check("audience", fmt.Errorf("assertion has no Conditions"))
+		return rv, nil
+	}
+	check("conditions", sp.validateConditionsTime(assertion.Conditions, now))
+	if assertion.Conditions.AudienceRestriction == nil || len(assertion.Conditions.AudienceRestriction.audiences()) == 0 {
+		check("audience", fmt.Errorf("Conditions has no AudienceRestriction"))
+	} else {
+		check("audience", sp.validateAudience(assertion.Conditions))
+	}
+	return rv, nil
+}
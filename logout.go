@@ -0,0 +1,191 @@
+package saml
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/tambeti/saml/xmlsec"
+)
+
+// maxSOAPMessageSize limits the size of a SOAP message that
+// ParseBackChannelLogoutRequest reads.
+const maxSOAPMessageSize = 1 << 20
+
+// soapEnvelope is a SOAP 1.1 envelope, in which the SOAP binding carries a
+// SAML message.
+type soapEnvelope struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    soapBody
+}
+
+type soapBody struct {
+	XMLName        xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	LogoutRequest  *LogoutRequest
+	LogoutResponse *LogoutResponse
+}
+
+// ParseBackChannelLogoutRequest reads the LogoutRequest that the IDP sent
+// in r with the SOAP binding, for the session of a user to be ended without
+// their browser, and validates it: it must be signed by the IDP, be issued
+// by it, and be addressed to SloURL, if it has a Destination. An EncryptedID
+// is decrypted into the NameID, which is then checked against
+// RequiredNameIDFormat and SPNameQualifier like that of an assertion, and
+// must not be empty. The caller ends the sessions of the NameID,
+// or only the one with the SessionIndex if the request has one, and
+// answers with MakeLogoutResponse.
+func (sp *ServiceProvider) ParseBackChannelLogoutRequest(r *http.Request) (*LogoutRequest, error) {
+	if r.Method != "POST" {
+		return nil, fmt.Errorf("cannot read LogoutRequest: method %s is not POST", r.Method)
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSOAPMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read LogoutRequest: %s", err)
+	}
+	if len(buf) > maxSOAPMessageSize {
+		return nil, fmt.Errorf("cannot read LogoutRequest: it is larger than %d bytes", maxSOAPMessageSize)
+	}
+	return sp.parseBackChannelLogoutRequest(r.Context(), trimXMLPrefix(buf))
+}
+
+// parseBackChannelLogoutRequest does the work of
+// ParseBackChannelLogoutRequest for the SOAP envelope buf. It gives up once
+// ctx is done.
+func (sp *ServiceProvider) parseBackChannelLogoutRequest(ctx context.Context, buf []byte) (*LogoutRequest, error) {
+	now := TimeNow()
+	if err := sp.checkMetadataExpiry(now); err != nil {
+		return nil, err
+	}
+	if err := checkLogoutRequestEnvelope(buf); err != nil {
+		return nil, err
+	}
+	envelope := soapEnvelope{}
+	if err := xml.Unmarshal(buf, &envelope); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal LogoutRequest: %s", err)
+	}
+	req := envelope.Body.LogoutRequest
+	if req == nil {
+		return nil, fmt.Errorf("SOAP Body has no LogoutRequest")
+	}
+
+	if req.Issuer.Value != sp.IDPMetadata.EntityID {
+		return nil, &IssuerMismatchError{Expected: sp.IDPMetadata.EntityID, Actual: req.Issuer.Value}
+	}
+	if req.Destination != "" && req.Destination != sp.SloURL {
+		return nil, fmt.Errorf("`Destination` does not match SloURL (expected %q)", sp.SloURL)
+	}
+	if req.IssueInstant.Before(now.Add(-sp.maxIssueDelay())) || req.IssueInstant.After(now.Add(sp.maxClockSkew())) {
+		return nil, fmt.Errorf("LogoutRequest IssueInstant %s is too far from now", req.IssueInstant)
+	}
+
+	if sp.InsecureSkipSignatureValidation {
+		log.Printf("WARNING: InsecureSkipSignatureValidation is set, not checking the signature of LogoutRequest %s from %s", req.ID, req.Issuer.Value)
+	} else {
+		if req.Signature == nil {
+			return nil, fmt.Errorf("LogoutRequest is not signed")
+		}
+		// the signature that is checked here is the one that is verified
+		if req.Signature.SignedInfo.Reference.URI != "#"+req.ID {
+			return nil, fmt.Errorf("signature of LogoutRequest %s does not reference it", req.ID)
+		}
+		if err := sp.checkSignatureAlgorithms(req.Signature); err != nil {
+			return nil, err
+		}
+		cert, err := sp.idpSigningCertFor(req.Signature)
+		if err != nil {
+			return nil, fmt.Errorf("cannot validate signature on LogoutRequest: %v", err)
+		}
+		if err := xmlsec.VerifyLogoutRequestSignatureContext(ctx, string(buf), string(cert), req.ID); err != nil {
+			return nil, fmt.Errorf("cannot validate signature on LogoutRequest: %v", err)
+		}
+	}
+
+	if req.EncryptedID != nil {
+		plaintext, err := sp.decrypt(ctx, string(req.EncryptedID.EncryptedData))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt EncryptedID: %s", err)
+		}
+		nameID := &NameID{}
+		if err := xml.Unmarshal([]byte(plaintext), nameID); err != nil {
+			return nil, fmt.Errorf("cannot decrypt EncryptedID: cannot unmarshal NameID: %s", err)
+		}
+		req.NameID = nameID
+		req.EncryptedID = nil
+	}
+	if req.NameID == nil || req.NameID.Value == "" {
+		return nil, fmt.Errorf("LogoutRequest has no NameID")
+	}
+	// the NameID names the sessions to end, so it is held to the same
+	// format and qualifier as that of the assertions they were made from
+	if err := sp.validateNameID(req.NameID); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// MakeLogoutResponse returns the LogoutResponse to req with the status
+// code status, e.g. StatusSuccess once the sessions of the user have been
+// ended, signed with Key.
+func (sp *ServiceProvider) MakeLogoutResponse(req *LogoutRequest, status string) (*LogoutResponse, error) {
+	rnd, err := randomBytes(20)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := LogoutResponse{
+		ID:           fmt.Sprintf("id-%x", rnd),
+		InResponseTo: req.ID,
+		IssueInstant: TimeNow(),
+		Version:      "2.0",
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  sp.MetadataURL,
+		},
+		Status: Status{StatusCode: StatusCode{Value: status}},
+	}
+
+	signatureTemplate, err := makeSignature(sp.CanonicalizationMethod, sp.SignatureMethod, sp.Certificate, sp.CertificateChain)
+	if err != nil {
+		return nil, err
+	}
+	resp.Signature = &signatureTemplate
+	resp.Signature.SignedInfo.Reference.URI = "#" + resp.ID
+	resp.Signature.KeyName = sp.KeyName
+
+	respXML, err := xml.Marshal(&resp)
+	if err != nil {
+		return nil, err
+	}
+	signedXML, err := xmlsec.SignLogoutResponse(string(respXML), sp.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	signedResp := &LogoutResponse{}
+	if err := xml.Unmarshal([]byte(signedXML), signedResp); err != nil {
+		return nil, err
+	}
+	return signedResp, nil
+}
+
+// SOAP returns resp in a SOAP envelope, as the SOAP binding carries it.
+func (resp *LogoutResponse) SOAP() ([]byte, error) {
+	return xml.Marshal(soapEnvelope{Body: soapBody{LogoutResponse: resp}})
+}
+
+// WriteSOAP writes resp to w in a SOAP envelope, as the answer to a
+// back-channel LogoutRequest.
+func (resp *LogoutResponse) WriteSOAP(w http.ResponseWriter) error {
+	buf, err := resp.SOAP()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, err = w.Write(buf)
+	return err
+}
@@ -1,6 +1,7 @@
 package saml
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"time"
 )
@@ -11,30 +12,71 @@ const HTTPPostBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
 // HTTPRedirectBinding is the official URN for the HTTP-Redirect binding (transport)
 const HTTPRedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
 
-// EntitiesDescriptor represents the SAML object of the same name.
+// SOAPBinding is the official URN for the SOAP binding (transport), over
+// which an IDP sends back-channel LogoutRequests.
+const SOAPBinding = "urn:oasis:names:tc:SAML:2.0:bindings:SOAP"
+
+// EntitiesDescriptor represents the SAML object of the same name, e.g. the
+// metadata aggregate that a federation publishes for its members. It may
+// contain further EntitiesDescriptors.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.3.1
 type EntitiesDescriptor struct {
-	XMLName          xml.Name    `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor"`
-	EntityDescriptor []*Metadata `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	XMLName             xml.Name              `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor" json:"-"`
+	Name                string                `xml:"Name,attr,omitempty" json:"name,omitempty"`
+	EntitiesDescriptors []*EntitiesDescriptor `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor" json:"entitiesDescriptors,omitempty"`
+	EntityDescriptor    []*Metadata           `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor" json:"entityDescriptors"`
+}
+
+// Entity returns the entity with entityID in e or in the EntitiesDescriptors
+// that it contains, or nil if there is none.
+func (e *EntitiesDescriptor) Entity(entityID string) *Metadata {
+	for _, entity := range e.EntityDescriptor {
+		if entity.EntityID == entityID {
+			return entity
+		}
+	}
+	for _, entities := range e.EntitiesDescriptors {
+		if entity := entities.Entity(entityID); entity != nil {
+			return entity
+		}
+	}
+	return nil
+}
+
+// IDPEntities returns the entities in e and in the EntitiesDescriptors that
+// it contains that have an IDPSSODescriptor, in document order within each
+// EntitiesDescriptor.
+func (e *EntitiesDescriptor) IDPEntities() []*Metadata {
+	rv := []*Metadata{}
+	for _, entity := range e.EntityDescriptor {
+		if entity.IDPSSODescriptor != nil {
+			rv = append(rv, entity)
+		}
+	}
+	for _, entities := range e.EntitiesDescriptors {
+		rv = append(rv, entities.IDPEntities()...)
+	}
+	return rv
 }
 
 // Metadata represents the SAML EntityDescriptor object.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.3.2
 type Metadata struct {
-	XMLName          xml.Name          `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
-	ValidUntil       time.Time         `xml:"validUntil,attr"`
-	CacheDuration    time.Duration     `xml:"cacheDuration,attr,omitempty"`
-	EntityID         string            `xml:"entityID,attr"`
-	SPSSODescriptor  *SPSSODescriptor  `xml:"SPSSODescriptor"`
-	IDPSSODescriptor *IDPSSODescriptor `xml:"IDPSSODescriptor"`
+	XMLName          xml.Name          `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor" json:"-"`
+	ValidUntil       time.Time         `xml:"validUntil,attr" json:"validUntil"`
+	CacheDuration    time.Duration     `xml:"cacheDuration,attr,omitempty" json:"cacheDuration,omitempty"`
+	EntityID         string            `xml:"entityID,attr" json:"entityID"`
+	SPSSODescriptor  *SPSSODescriptor  `xml:"SPSSODescriptor" json:"spSSODescriptor,omitempty"`
+	IDPSSODescriptor *IDPSSODescriptor `xml:"IDPSSODescriptor" json:"idpSSODescriptor,omitempty"`
 }
 
 func (m *Metadata) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	type Alias Metadata
 	aux := &struct {
-		ValidUntil RelaxedTime `xml:"validUntil,attr"`
+		ValidUntil    RelaxedTime `xml:"validUntil,attr"`
+		CacheDuration Duration    `xml:"cacheDuration,attr,omitempty"`
 		*Alias
 	}{
 		Alias: (*Alias)(m),
@@ -43,69 +85,175 @@ func (m *Metadata) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 		return err
 	}
 	m.ValidUntil = time.Time(aux.ValidUntil)
+	m.CacheDuration = time.Duration(aux.CacheDuration)
+	return nil
+}
+
+// MarshalXML writes CacheDuration as an xs:duration.
+func (m Metadata) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name = xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:metadata", Local: "EntityDescriptor"}
+	type Alias Metadata
+	aux := &struct {
+		*Alias
+		CacheDuration Duration `xml:"cacheDuration,attr,omitempty"`
+	}{
+		Alias:         (*Alias)(&m),
+		CacheDuration: Duration(m.CacheDuration),
+	}
+	return e.EncodeElement(aux, start)
+}
+
+// MarshalJSON writes CacheDuration as an xs:duration, like MarshalXML.
+func (m Metadata) MarshalJSON() ([]byte, error) {
+	type Alias Metadata
+	return json.Marshal(&struct {
+		*Alias
+		CacheDuration Duration `json:"cacheDuration,omitempty"`
+	}{
+		Alias:         (*Alias)(&m),
+		CacheDuration: Duration(m.CacheDuration),
+	})
+}
+
+// UnmarshalJSON reads the CacheDuration written by MarshalJSON.
+func (m *Metadata) UnmarshalJSON(buf []byte) error {
+	type Alias Metadata
+	aux := &struct {
+		*Alias
+		CacheDuration Duration `json:"cacheDuration,omitempty"`
+	}{
+		Alias: (*Alias)(m),
+	}
+	if err := json.Unmarshal(buf, aux); err != nil {
+		return err
+	}
+	m.CacheDuration = time.Duration(aux.CacheDuration)
 	return nil
 }
 
 // KeyDescriptor represents the XMLSEC object of the same name
 type KeyDescriptor struct {
-	Use               string             `xml:"use,attr"`
-	KeyInfo           KeyInfo            `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
-	EncryptionMethods []EncryptionMethod `xml:"EncryptionMethod"`
+	Use               string             `xml:"use,attr" json:"use,omitempty"`
+	KeyInfo           KeyInfo            `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo" json:"keyInfo"`
+	EncryptionMethods []EncryptionMethod `xml:"EncryptionMethod" json:"encryptionMethods,omitempty"`
 }
 
 // EncryptionMethod represents the XMLSEC object of the same name
 type EncryptionMethod struct {
-	Algorithm string `xml:"Algorithm,attr"`
+	Algorithm string `xml:"Algorithm,attr" json:"algorithm"`
 }
 
 // KeyInfo represents the XMLSEC object of the same name
 type KeyInfo struct {
-	XMLName     xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
-	Certificate string   `xml:"X509Data>X509Certificate"`
+	XMLName     xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo" json:"-"`
+	KeyName     string   `xml:"KeyName,omitempty" json:"keyName,omitempty"`
+	Certificate string   `xml:"X509Data>X509Certificate" json:"certificate"`
 }
 
 // Endpoint represents the SAML EndpointType object.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.2.2
 type Endpoint struct {
-	Binding          string `xml:"Binding,attr"`
-	Location         string `xml:"Location,attr"`
-	ResponseLocation string `xml:"ResponseLocation,attr,omitempty"`
+	Binding          string `xml:"Binding,attr" json:"binding"`
+	Location         string `xml:"Location,attr" json:"location"`
+	ResponseLocation string `xml:"ResponseLocation,attr,omitempty" json:"responseLocation,omitempty"`
 }
 
 // IndexedEndpoint represents the SAML IndexedEndpointType object.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.2.3
 type IndexedEndpoint struct {
-	Binding  string `xml:"Binding,attr"`
-	Location string `xml:"Location,attr"`
-	Index    int    `xml:"index,attr"`
+	Binding   string `xml:"Binding,attr" json:"binding"`
+	Location  string `xml:"Location,attr" json:"location"`
+	Index     int    `xml:"index,attr" json:"index"`
+	IsDefault *bool  `xml:"isDefault,attr,omitempty" json:"isDefault,omitempty"`
 }
 
 // SPSSODescriptor represents the SAML SPSSODescriptorType object.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.4.2
 type SPSSODescriptor struct {
-	XMLName                    xml.Name          `xml:"urn:oasis:names:tc:SAML:2.0:metadata SPSSODescriptor"`
-	AuthnRequestsSigned        bool              `xml:",attr"`
-	WantAssertionsSigned       bool              `xml:",attr"`
-	ProtocolSupportEnumeration string            `xml:"protocolSupportEnumeration,attr"`
-	KeyDescriptor              []KeyDescriptor   `xml:"KeyDescriptor"`
-	ArtifactResolutionService  []IndexedEndpoint `xml:"ArtifactResolutionService"`
-	SingleLogoutService        []Endpoint        `xml:"SingleLogoutService"`
-	ManageNameIDService        []Endpoint
-	NameIDFormat               []string          `xml:"NameIDFormat"`
-	AssertionConsumerService   []IndexedEndpoint `xml:"AssertionConsumerService"`
-	AttributeConsumingService  []interface{}
+	XMLName                    xml.Name                    `xml:"urn:oasis:names:tc:SAML:2.0:metadata SPSSODescriptor" json:"-"`
+	AuthnRequestsSigned        bool                        `xml:",attr" json:"authnRequestsSigned"`
+	WantAssertionsSigned       bool                        `xml:",attr" json:"wantAssertionsSigned"`
+	ProtocolSupportEnumeration string                      `xml:"protocolSupportEnumeration,attr" json:"protocolSupportEnumeration"`
+	Extensions                 *MetadataExtensions         `xml:"Extensions" json:"extensions,omitempty"`
+	KeyDescriptor              []KeyDescriptor             `xml:"KeyDescriptor" json:"keyDescriptors,omitempty"`
+	ArtifactResolutionService  []IndexedEndpoint           `xml:"ArtifactResolutionService" json:"artifactResolutionServices,omitempty"`
+	SingleLogoutService        []Endpoint                  `xml:"SingleLogoutService" json:"singleLogoutServices,omitempty"`
+	ManageNameIDService        []Endpoint                  `json:"manageNameIDServices,omitempty"`
+	NameIDFormat               []string                    `xml:"NameIDFormat" json:"nameIDFormats,omitempty"`
+	AssertionConsumerService   []IndexedEndpoint           `xml:"AssertionConsumerService" json:"assertionConsumerServices,omitempty"`
+	AttributeConsumingService  []AttributeConsumingService `xml:"AttributeConsumingService" json:"attributeConsumingServices,omitempty"`
+}
+
+// MetadataExtensions represents the Extensions of a role descriptor in
+// metadata. Only the extensions that we understand are read; others are
+// dropped.
+type MetadataExtensions struct {
+	UIInfo *UIInfo `xml:"urn:oasis:names:tc:SAML:metadata:ui UIInfo" json:"uiInfo,omitempty"`
+}
+
+// UIInfo represents the mdui:UIInfo object, which tells discovery services
+// and IDP login pages how to present the entity to the user.
+//
+// See http://docs.oasis-open.org/security/saml/Post2.0/sstc-saml-metadata-ui/v1.0/sstc-saml-metadata-ui-v1.0.pdf section 2.1
+type UIInfo struct {
+	DisplayName []LocalizedName `xml:"urn:oasis:names:tc:SAML:metadata:ui DisplayName" json:"displayNames,omitempty"`
+	Description []LocalizedName `xml:"urn:oasis:names:tc:SAML:metadata:ui Description" json:"descriptions,omitempty"`
+	Logo        []Logo          `xml:"urn:oasis:names:tc:SAML:metadata:ui Logo" json:"logos,omitempty"`
+}
+
+// Logo represents the mdui:Logo object, the URL of an image of Width by
+// Height pixels. Lang is only set if the image contains text.
+//
+// See http://docs.oasis-open.org/security/saml/Post2.0/sstc-saml-metadata-ui/v1.0/sstc-saml-metadata-ui-v1.0.pdf section 2.1.1
+type Logo struct {
+	Lang   string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty" json:"lang,omitempty"`
+	Height int    `xml:"height,attr" json:"height"`
+	Width  int    `xml:"width,attr" json:"width"`
+	URL    string `xml:",chardata" json:"url"`
+}
+
+// AttributeConsumingService represents the SAML object of the same name,
+// which tells the IDP the attributes that the service provider wants.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.4.4.1
+type AttributeConsumingService struct {
+	Index              int                  `xml:"index,attr" json:"index"`
+	IsDefault          bool                 `xml:"isDefault,attr,omitempty" json:"isDefault,omitempty"`
+	ServiceName        []LocalizedName      `xml:"ServiceName" json:"serviceNames,omitempty"`
+	RequestedAttribute []RequestedAttribute `xml:"RequestedAttribute" json:"requestedAttributes,omitempty"`
+}
+
+// LocalizedName represents the SAML localizedNameType object.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.2.4
+type LocalizedName struct {
+	Lang  string `xml:"http://www.w3.org/XML/1998/namespace lang,attr" json:"lang"`
+	Value string `xml:",chardata" json:"value"`
+}
+
+// RequestedAttribute represents the SAML object of the same name. If
+// IsRequired is set, the service provider cannot work without the
+// attribute.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.4.4.2
+type RequestedAttribute struct {
+	FriendlyName string `xml:",attr,omitempty" json:"friendlyName,omitempty"`
+	Name         string `xml:",attr" json:"name"`
+	NameFormat   string `xml:",attr,omitempty" json:"nameFormat,omitempty"`
+	IsRequired   bool   `xml:"isRequired,attr,omitempty" json:"isRequired,omitempty"`
 }
 
 // IDPSSODescriptor represents the SAML IDPSSODescriptorType object.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.4.3
 type IDPSSODescriptor struct {
-	XMLName                    xml.Name        `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor"`
-	ProtocolSupportEnumeration string          `xml:"protocolSupportEnumeration,attr"`
-	KeyDescriptor              []KeyDescriptor `xml:"KeyDescriptor"`
-	NameIDFormat               []string        `xml:"NameIDFormat"`
-	SingleSignOnService        []Endpoint      `xml:"SingleSignOnService"`
+	XMLName                    xml.Name        `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor" json:"-"`
+	ProtocolSupportEnumeration string          `xml:"protocolSupportEnumeration,attr" json:"protocolSupportEnumeration"`
+	KeyDescriptor              []KeyDescriptor `xml:"KeyDescriptor" json:"keyDescriptors,omitempty"`
+	SingleLogoutService        []Endpoint      `xml:"SingleLogoutService" json:"singleLogoutServices,omitempty"`
+	NameIDFormat               []string        `xml:"NameIDFormat" json:"nameIDFormats,omitempty"`
+	SingleSignOnService        []Endpoint      `xml:"SingleSignOnService" json:"singleSignOnServices,omitempty"`
 }
@@ -1,7 +1,13 @@
 package saml
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/xml"
+	"math/big"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -66,3 +72,126 @@ cvCsEFiJZ4AbF+DgmO6TarJ8O05t8zvnOwJlNCASPZRH/JmF8tX0hoHuAQ==`,
 	c.Assert(string(buf), Equals, "<EntityDescriptor xmlns=\"urn:oasis:names:tc:SAML:2.0:metadata\" validUntil=\"2013-03-10T00:32:19.104Z\" entityID=\"http://localhost:5000/e087a985171710fb9fb30f30f41384f9/saml2/metadata/\"><SPSSODescriptor xmlns=\"urn:oasis:names:tc:SAML:2.0:metadata\" AuthnRequestsSigned=\"true\" WantAssertionsSigned=\"true\" protocolSupportEnumeration=\"urn:oasis:names:tc:SAML:2.0:protocol\"><KeyDescriptor use=\"encryption\"><KeyInfo xmlns=\"http://www.w3.org/2000/09/xmldsig#\"><X509Data><X509Certificate>MIIB7zCCAVgCCQDFzbKIp7b3MTANBgkqhkiG9w0BAQUFADA8MQswCQYDVQQGEwJVUzELMAkGA1UE&#xA;CAwCR0ExDDAKBgNVBAoMA2ZvbzESMBAGA1UEAwwJbG9jYWxob3N0MB4XDTEzMTAwMjAwMDg1MVoX&#xA;DTE0MTAwMjAwMDg1MVowPDELMAkGA1UEBhMCVVMxCzAJBgNVBAgMAkdBMQwwCgYDVQQKDANmb28x&#xA;EjAQBgNVBAMMCWxvY2FsaG9zdDCBnzANBgkqhkiG9w0BAQEFAAOBjQAwgYkCgYEA1PMHYmhZj308&#xA;kWLhZVT4vOulqx/9ibm5B86fPWwUKKQ2i12MYtz07tzukPymisTDhQaqyJ8Kqb/6JjhmeMnEOdTv&#xA;SPmHO8m1ZVveJU6NoKRn/mP/BD7FW52WhbrUXLSeHVSKfWkNk6S4hk9MV9TswTvyRIKvRsw0X/gf&#xA;nqkroJcCAwEAATANBgkqhkiG9w0BAQUFAAOBgQCMMlIO+GNcGekevKgkakpMdAqJfs24maGb90Dv&#xA;TLbRZRD7Xvn1MnVBBS9hzlXiFLYOInXACMW5gcoRFfeTQLSouMM8o57h0uKjfTmuoWHLQLi6hnF+&#xA;cvCsEFiJZ4AbF+DgmO6TarJ8O05t8zvnOwJlNCASPZRH/JmF8tX0hoHuAQ==</X509Certificate></X509Data></KeyInfo></KeyDescriptor><KeyDescriptor use=\"signing\"><KeyInfo xmlns=\"http://www.w3.org/2000/09/xmldsig#\"><X509Data><X509Certificate>MIIB7zCCAVgCCQDFzbKIp7b3MTANBgkqhkiG9w0BAQUFADA8MQswCQYDVQQGEwJVUzELMAkGA1UE&#xA;CAwCR0ExDDAKBgNVBAoMA2ZvbzESMBAGA1UEAwwJbG9jYWxob3N0MB4XDTEzMTAwMjAwMDg1MVoX&#xA;DTE0MTAwMjAwMDg1MVowPDELMAkGA1UEBhMCVVMxCzAJBgNVBAgMAkdBMQwwCgYDVQQKDANmb28x&#xA;EjAQBgNVBAMMCWxvY2FsaG9zdDCBnzANBgkqhkiG9w0BAQEFAAOBjQAwgYkCgYEA1PMHYmhZj308&#xA;kWLhZVT4vOulqx/9ibm5B86fPWwUKKQ2i12MYtz07tzukPymisTDhQaqyJ8Kqb/6JjhmeMnEOdTv&#xA;SPmHO8m1ZVveJU6NoKRn/mP/BD7FW52WhbrUXLSeHVSKfWkNk6S4hk9MV9TswTvyRIKvRsw0X/gf&#xA;nqkroJcCAwEAATANBgkqhkiG9w0BAQUFAAOBgQCMMlIO+GNcGekevKgkakpMdAqJfs24maGb90Dv&#xA;TLbRZRD7Xvn1MnVBBS9hzlXiFLYOInXACMW5gcoRFfeTQLSouMM8o57h0uKjfTmuoWHLQLi6hnF+&#xA;cvCsEFiJZ4AbF+DgmO6TarJ8O05t8zvnOwJlNCASPZRH/JmF8tX0hoHuAQ==</X509Certificate></X509Data></KeyInfo></KeyDescriptor><SingleLogoutService Binding=\"urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect\" Location=\"http://localhost:5000/e087a985171710fb9fb30f30f41384f9/saml2/ls/\"></SingleLogoutService><AssertionConsumerService Binding=\"urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST\" Location=\"http://localhost:5000/e087a985171710fb9fb30f30f41384f9/saml2/ls/\" index=\"1\"></AssertionConsumerService></SPSSODescriptor></EntityDescriptor>")
 
 }
+
+func (s *MetadataTest) TestDuration(c *C) {
+	for text, d := range map[string]time.Duration{
+		"PT0S":          0,
+		"PT1H30M":       time.Hour + 30*time.Minute,
+		"P2DT12H":       60 * time.Hour,
+		"PT0.5S":        500 * time.Millisecond,
+		"-PT15M":        -15 * time.Minute,
+		"P1DT2H3M4.25S": 26*time.Hour + 3*time.Minute + 4250*time.Millisecond,
+	} {
+		buf, err := Duration(d).MarshalText()
+		c.Assert(err, IsNil)
+		c.Assert(string(buf), Equals, text)
+
+		var parsed Duration
+		c.Assert(parsed.UnmarshalText([]byte(text)), IsNil)
+		c.Assert(time.Duration(parsed), Equals, d)
+	}
+
+	var d Duration
+	c.Assert(d.UnmarshalText([]byte("P1Y2M")), IsNil)
+	c.Assert(time.Duration(d), Equals, 425*24*time.Hour)
+
+	for _, text := range []string{"P", "PT", "P1DT", "1H", "P1H", "PT1D"} {
+		c.Assert(d.UnmarshalText([]byte(text)), ErrorMatches, "invalid duration .*")
+	}
+}
+
+func (s *MetadataTest) TestCacheDurationRoundTrip(c *C) {
+	buf := []byte(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" validUntil="2013-03-10T00:32:19.104Z" cacheDuration="PT6H" entityID="https://idp.example.com/metadata"></EntityDescriptor>`)
+	metadata := Metadata{}
+	c.Assert(xml.Unmarshal(buf, &metadata), IsNil)
+	c.Assert(metadata.CacheDuration, Equals, 6*time.Hour)
+
+	out, err := xml.Marshal(&metadata)
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" validUntil="2013-03-10T00:32:19.104Z" entityID="https://idp.example.com/metadata" cacheDuration="PT6H"></EntityDescriptor>`)
+}
+
+func makeTestCertificate(c *C, notBefore, notAfter time.Time) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	return base64.StdEncoding.EncodeToString(certDER)
+}
+
+func (s *MetadataTest) TestValidateIDPMetadata(c *C) {
+	timeNow := TimeNow
+	defer func() {
+		TimeNow = timeNow
+	}()
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	TimeNow = func() time.Time { return now }
+	validCert := makeTestCertificate(c, now.Add(-time.Hour), now.Add(365*24*time.Hour))
+
+	md := &Metadata{
+		EntityID:   "https://idp.example.com/metadata",
+		ValidUntil: now.Add(time.Hour),
+		IDPSSODescriptor: &IDPSSODescriptor{
+			KeyDescriptor: []KeyDescriptor{
+				{Use: "signing", KeyInfo: KeyInfo{Certificate: validCert}},
+			},
+			SingleSignOnService: []Endpoint{
+				{Binding: HTTPRedirectBinding, Location: "https://idp.example.com/sso"},
+				{Binding: HTTPPostBinding, Location: "https://idp.example.com/sso"},
+			},
+			SingleLogoutService: []Endpoint{
+				{Binding: HTTPRedirectBinding, Location: "https://idp.example.com/slo"},
+			},
+		},
+	}
+	c.Assert(ValidateIDPMetadata(md), IsNil)
+
+	// certificates without a use count for signing
+	md.IDPSSODescriptor.KeyDescriptor[0].Use = ""
+	c.Assert(ValidateIDPMetadata(md), IsNil)
+
+	md.IDPSSODescriptor.KeyDescriptor = []KeyDescriptor{
+		{Use: "encryption", KeyInfo: KeyInfo{Certificate: makeTestCertificate(c, now.Add(-48*time.Hour), now.Add(-24*time.Hour))}},
+		{Use: "signing", KeyInfo: KeyInfo{Certificate: makeTestCertificate(c, now.Add(-time.Hour), now.Add(7*24*time.Hour))}},
+		{Use: "signing", KeyInfo: KeyInfo{Certificate: makeTestCertificate(c, now.Add(time.Hour), now.Add(365*24*time.Hour))}},
+		{Use: "signing", KeyInfo: KeyInfo{Certificate: "not base64!"}},
+		{Use: "signing", KeyInfo: KeyInfo{Certificate: "bm90IGEgY2VydGlmaWNhdGU="}},
+	}
+	warnings := ValidateIDPMetadata(md)
+	c.Assert(warnings, HasLen, 5)
+	c.Assert(warnings[0].String(), Equals, `encryption certificate "idp.example.com" expired on 2017-05-31 12:00:00 +0000 UTC`)
+	c.Assert(warnings[1].String(), Equals, `signing certificate "idp.example.com" expires on 2017-06-08 12:00:00 +0000 UTC`)
+	c.Assert(warnings[2].String(), Equals, `signing certificate "idp.example.com" is not valid until 2017-06-01 13:00:00 +0000 UTC`)
+	c.Assert(warnings[3].String(), Matches, `cannot decode signing certificate: .*`)
+	c.Assert(warnings[4].String(), Matches, `cannot parse signing certificate: .*`)
+
+	md.ValidUntil = now.Add(-time.Hour)
+	md.IDPSSODescriptor.KeyDescriptor = []KeyDescriptor{
+		{Use: "encryption", KeyInfo: KeyInfo{Certificate: validCert}},
+	}
+	md.IDPSSODescriptor.SingleSignOnService = []Endpoint{
+		{Binding: HTTPPostBinding, Location: "/sso"},
+	}
+	md.IDPSSODescriptor.SingleLogoutService = nil
+	c.Assert(ValidateIDPMetadata(md), DeepEquals, []Warning{
+		{Message: "metadata expired on 2017-06-01 11:00:00 +0000 UTC"},
+		{Message: `SingleSignOnService location "/sso" is not an absolute URL`},
+		{Message: "there is no SingleSignOnService with the urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect binding"},
+		{Message: "there is no SingleLogoutService with the urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect binding, so logouts are not sent to the IDP"},
+		{Message: "there is no signing certificate"},
+	})
+
+	md.IDPSSODescriptor.SingleSignOnService = nil
+	c.Assert(ValidateIDPMetadata(md)[1], Equals, Warning{Message: "there is no SingleSignOnService"})
+
+	c.Assert(ValidateIDPMetadata(&Metadata{EntityID: "https://sp.example.com/metadata"}), DeepEquals, []Warning{
+		{Message: "there is no IDPSSODescriptor"},
+	})
+	c.Assert(ValidateIDPMetadata(nil), DeepEquals, []Warning{{Message: "there is no metadata"}})
+}
@@ -0,0 +1,177 @@
+package saml
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// recipientHint is the KeyInfo of the EncryptedKey within an EncryptedData,
+// which may name the certificate that the session key was encrypted to by
+// including it, its subject key identifier or its subject name. The
+// elements are matched by local name only, as the prefixes may be declared
+// outside of the EncryptedData.
+type recipientHint struct {
+	Certificates []string `xml:"KeyInfo>EncryptedKey>KeyInfo>X509Data>X509Certificate"`
+	SKIs         []string `xml:"KeyInfo>EncryptedKey>KeyInfo>X509Data>X509SKI"`
+	SubjectNames []string `xml:"KeyInfo>EncryptedKey>KeyInfo>X509Data>X509SubjectName"`
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+// matches returns true if the hint names certificate, which is in base64-d
+// DER format.
+func (h *recipientHint) matches(certificate string) bool {
+	certBytes, err := base64.StdEncoding.DecodeString(whitespace.ReplaceAllString(certificate, ""))
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return false
+	}
+
+	for _, hinted := range h.Certificates {
+		hintedBytes, err := base64.StdEncoding.DecodeString(whitespace.ReplaceAllString(hinted, ""))
+		if err == nil && bytes.Equal(hintedBytes, certBytes) {
+			return true
+		}
+	}
+	for _, ski := range h.SKIs {
+		skiBytes, err := base64.StdEncoding.DecodeString(whitespace.ReplaceAllString(ski, ""))
+		if err == nil && len(skiBytes) > 0 && bytes.Equal(skiBytes, cert.SubjectKeyId) {
+			return true
+		}
+	}
+	subject := normalizeDN(formatDN(cert.Subject))
+	for _, subjectName := range h.SubjectNames {
+		if normalizeDN(subjectName) == subject {
+			return true
+		}
+	}
+	return false
+}
+
+// decryptionKeys returns the keys that decrypt tries for cipher, in order.
+// These are the keys whose certificate the EncryptedKey of cipher names as
+// its recipient or, if it names none of them, all of our keys, starting
+// with EncryptionKey.
+func (sp *ServiceProvider) decryptionKeys(cipher string) []*rsa.PrivateKey {
+	keyPairs := append([]KeyPair{{Key: sp.EncryptionKey, Certificate: sp.EncryptionCertificate}}, sp.keyPairs()...)
+
+	hint := recipientHint{}
+	if err := xml.Unmarshal([]byte(cipher), &hint); err == nil {
+		keys := []*rsa.PrivateKey{}
+		for _, keyPair := range keyPairs {
+			if keyPair.Key != nil && hint.matches(keyPair.Certificate) {
+				keys = append(keys, keyPair.Key)
+			}
+		}
+		if len(keys) > 0 {
+			return keys
+		}
+	}
+
+	keys := []*rsa.PrivateKey{}
+	for _, keyPair := range keyPairs {
+		if keyPair.Key != nil {
+			keys = append(keys, keyPair.Key)
+		}
+	}
+	return keys
+}
+
+// dnAttributeTypes are the short names of the distinguished name attributes
+// that formatDN knows, from RFC 4514 and RFC 2985.
+var dnAttributeTypes = map[string]string{
+	"2.5.4.3":                    "CN",
+	"2.5.4.5":                    "SERIALNUMBER",
+	"2.5.4.6":                    "C",
+	"2.5.4.7":                    "L",
+	"2.5.4.8":                    "ST",
+	"2.5.4.9":                    "STREET",
+	"2.5.4.10":                   "O",
+	"2.5.4.11":                   "OU",
+	"0.9.2342.19200300.100.1.25": "DC",
+	"0.9.2342.19200300.100.1.1":  "UID",
+	"1.2.840.113549.1.9.1":       "EMAILADDRESS",
+}
+
+// formatDN returns name as a string of comma separated type=value pairs.
+// Attributes of an unknown type are written with their OID as the type.
+func formatDN(name pkix.Name) string {
+	parts := []string{}
+	for _, attribute := range name.Names {
+		attributeType, ok := dnAttributeTypes[attribute.Type.String()]
+		if !ok {
+			attributeType = attribute.Type.String()
+		}
+		value, ok := attribute.Value.(string)
+		if !ok {
+			continue
+		}
+		parts = append(parts, attributeType+"="+escapeDNValue(value))
+	}
+	return strings.Join(parts, ",")
+}
+
+// escapeDNValue escapes the characters of value that are special in a
+// distinguished name string.
+func escapeDNValue(value string) string {
+	buf := bytes.Buffer{}
+	for _, r := range value {
+		if strings.ContainsRune(`,+"\<>;=`, r) {
+			buf.WriteRune('\\')
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// normalizeDN returns dn in a form that can be compared with other
+// normalized names: its type=value pairs are sorted, their types are upper
+// case and OIDs are replaced with short names, and the spaces around
+// separators are removed. The order is ignored because producers disagree
+// on whether the most or least significant attribute comes first.
+func normalizeDN(dn string) string {
+	parts := []string{}
+	current := bytes.Buffer{}
+	escaped := false
+	for _, r := range dn {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',' || r == ';' || r == '+':
+			parts = append(parts, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	parts = append(parts, current.String())
+
+	for i, part := range parts {
+		attributeType, value := part, ""
+		if eq := strings.Index(part, "="); eq >= 0 {
+			attributeType, value = part[:eq], part[eq+1:]
+		}
+		attributeType = strings.ToUpper(strings.TrimSpace(attributeType))
+		attributeType = strings.TrimPrefix(attributeType, "OID.")
+		if short, ok := dnAttributeTypes[attributeType]; ok {
+			attributeType = short
+		} else if attributeType == "E" {
+			attributeType = "EMAILADDRESS"
+		}
+		parts[i] = attributeType + "=" + strings.TrimSpace(value)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
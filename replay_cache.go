@@ -0,0 +1,100 @@
+package saml
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrAssertionReplayed is the PrivateErr of the InvalidResponseError
+// returned by ParseResponse for an assertion that it has already accepted.
+var ErrAssertionReplayed = errors.New("assertion has already been used")
+
+// ReplayCache records the IDs of the assertions that ParseResponse accepts,
+// so that an assertion is not accepted twice. See
+// ServiceProvider.ReplayCache.
+//
+// A service with several instances behind a load balancer needs a cache
+// that they all share, or an assertion accepted by one instance can be
+// replayed to another; see StoreReplayCache.
+type ReplayCache interface {
+	// Add records id until expires, after which the assertion is rejected
+	// anyway. It returns ErrAssertionReplayed if id is already recorded.
+	// Checking and recording id must be a single atomic operation, so
+	// that of two concurrent calls for the same id only one succeeds. Any
+	// other error also makes ParseResponse reject the assertion.
+	Add(id string, expires time.Time) error
+}
+
+// DefaultReplayCache is the ReplayCache used for assertions with a
+// OneTimeUse condition when ServiceProvider.ReplayCache is nil.
+var DefaultReplayCache ReplayCache = NewMemoryReplayCache()
+
+// MemoryReplayCache is a ReplayCache that keeps the IDs in memory. It only
+// protects against replays if a single instance of the service receives
+// all the responses of the IDP.
+type MemoryReplayCache struct {
+	mu  sync.Mutex
+	ids map[string]time.Time
+}
+
+// NewMemoryReplayCache returns an empty MemoryReplayCache.
+func NewMemoryReplayCache() *MemoryReplayCache {
+	return &MemoryReplayCache{ids: map[string]time.Time{}}
+}
+
+// Add implements ReplayCache. It also forgets the IDs that have expired.
+func (c *MemoryReplayCache) Add(id string, expires time.Time) error {
+	now := TimeNow()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.ids {
+		if !now.Before(v) {
+			delete(c.ids, k)
+		}
+	}
+	if _, ok := c.ids[id]; ok {
+		return ErrAssertionReplayed
+	}
+	c.ids[id] = expires
+	return nil
+}
+
+// ReplayStore is a key value store with expiry shared by the instances of
+// a service, such as Redis or memcached, for a StoreReplayCache.
+type ReplayStore interface {
+	// AddIfAbsent atomically stores key for ttl and returns true, unless
+	// key is already stored, in which case it returns false. With Redis
+	// this is SET key value NX PX ttl, and with memcached an add.
+	AddIfAbsent(key string, ttl time.Duration) (bool, error)
+}
+
+// StoreReplayCache is a ReplayCache that records the IDs in a ReplayStore,
+// so that an assertion accepted by one instance of a service is rejected
+// by the others.
+type StoreReplayCache struct {
+	Store ReplayStore
+
+	// KeyPrefix is prepended to the IDs to form the keys in Store, to keep
+	// them apart from other data.
+	KeyPrefix string
+}
+
+// Add implements ReplayCache. IDs are kept for at least a second, as
+// stores may not support shorter expiries.
+func (c *StoreReplayCache) Add(id string, expires time.Time) error {
+	ttl := expires.Sub(TimeNow())
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	added, err := c.Store.AddIfAbsent(c.KeyPrefix+id, ttl)
+	if err != nil {
+		return fmt.Errorf("cannot record assertion %q: %s", id, err)
+	}
+	if !added {
+		return ErrAssertionReplayed
+	}
+	return nil
+}
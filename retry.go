@@ -0,0 +1,80 @@
+package saml
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls how requests to the IDP, such as fetching its
+// metadata, are retried when they fail transiently. Each field that is zero
+// takes its value from DefaultRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the second attempt. It doubles
+	// after each further failure, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy used for the fields of a
+// RetryPolicy that are zero.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+}
+
+// Do calls f until it succeeds, it reports that the error is not worth
+// retrying, or MaxAttempts attempts have been made, and returns the last
+// error. It waits for the backoff between attempts, but gives up early if
+// ctx is done or its deadline would pass before the next attempt.
+func (p RetryPolicy) Do(ctx context.Context, f func() (retry bool, err error)) error {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	backoff := p.InitialBackoff
+	if backoff == 0 {
+		backoff = DefaultRetryPolicy.InitialBackoff
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = DefaultRetryPolicy.MaxBackoff
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = f()
+		if err == nil || !retry || attempt >= maxAttempts {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// RetryableStatus returns true if an HTTP response with the given status
+// code reports a failure that may go away when the request is retried.
+func RetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
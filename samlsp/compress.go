@@ -0,0 +1,92 @@
+package samlsp
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// compressedTokenPrefix starts the compressed form of a state token. Like a
+// signed JWT, what follows it has three parts: the alg of the header, the
+// deflated payload and the signature. The rest of the header is left out,
+// as it is always that of tokenHeader.
+const compressedTokenPrefix = "DEF."
+
+// maxDecompressedTokenSize limits the size of a decompressed token, which is
+// read from a cookie before its signature can be checked.
+const maxDecompressedTokenSize = 1 << 20
+
+// tokenHeader returns the header of the state tokens signed with alg,
+// base64url encoded as jwt-go encodes it.
+func tokenHeader(alg string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `","typ":"JWT"}`))
+}
+
+// compressToken returns the signed JWT token in the compressed form, or
+// token itself if its header is not that of one of tokenSigningMethods.
+func compressToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return token, nil
+	}
+	alg := ""
+	for name := range tokenSigningMethods {
+		if parts[0] == tokenHeader(name) {
+			alg = name
+		}
+	}
+	if alg == "" {
+		return token, nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	buf := bytes.Buffer{}
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return compressedTokenPrefix + alg + "." + base64.RawURLEncoding.EncodeToString(buf.Bytes()) + "." + parts[2], nil
+}
+
+// isCompressedToken returns true if value is in the compressed form.
+func isCompressedToken(value string) bool {
+	return strings.HasPrefix(value, compressedTokenPrefix)
+}
+
+// decompressToken returns the signed JWT that compressToken compressed into
+// value.
+func decompressToken(value string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(value, compressedTokenPrefix), ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("cannot decompress token: expected 3 parts after the prefix, found %d", len(parts))
+	}
+	if _, ok := tokenSigningMethods[parts[0]]; !ok {
+		return "", fmt.Errorf("cannot decompress token: unexpected signing method %q", parts[0])
+	}
+	compressed, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("cannot decompress token: %s", err)
+	}
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+	payload, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedTokenSize+1))
+	if err != nil {
+		return "", fmt.Errorf("cannot decompress token: %s", err)
+	}
+	if len(payload) > maxDecompressedTokenSize {
+		return "", fmt.Errorf("cannot decompress token: it is larger than %d bytes", maxDecompressedTokenSize)
+	}
+	return tokenHeader(parts[0]) + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2], nil
+}
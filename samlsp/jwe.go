@@ -0,0 +1,120 @@
+package samlsp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// jweHeader is the protected header of the encrypted session tokens. They
+// are nested JWTs: the payload is the signed JWT, so that decrypting a
+// token does not replace verifying its signature.
+var jweHeader = map[string]string{
+	"alg": "RSA-OAEP",
+	"enc": "A256GCM",
+	"cty": "JWT",
+}
+
+// encryptToken returns token encrypted to pub as a JSON Web Encryption
+// (RFC 7516) in compact serialization. The content encryption key is
+// encrypted with RSA-OAEP and the token with AES-256 in GCM mode.
+func encryptToken(token string, pub *rsa.PublicKey) (string, error) {
+	header, err := json.Marshal(jweHeader)
+	if err != nil {
+		return "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(header)
+
+	cek := make([]byte, 32)
+	if _, err := rand.Read(cek); err != nil {
+		return "", err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, cek, nil)
+	if err != nil {
+		return "", err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+
+	// The protected header is authenticated as the additional data. Seal
+	// appends the tag to the ciphertext; JWE keeps them apart.
+	sealed := gcm.Seal(nil, iv, []byte(token), []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	return strings.Join([]string{
+		protected,
+		base64.RawURLEncoding.EncodeToString(encryptedKey),
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// isEncryptedToken returns true if value is in the JWE compact
+// serialization, which has five parts where a signed JWT has three.
+func isEncryptedToken(value string) bool {
+	return strings.Count(value, ".") == 4
+}
+
+// decryptToken returns the token that encryptToken encrypted into value.
+func decryptToken(value string, key *rsa.PrivateKey) (string, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 5 {
+		return "", fmt.Errorf("cannot decrypt token: expected 5 parts, found %d", len(parts))
+	}
+	decoded := make([][]byte, len(parts))
+	for i, part := range parts {
+		buf, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return "", fmt.Errorf("cannot decrypt token: %s", err)
+		}
+		decoded[i] = buf
+	}
+	header, encryptedKey, iv, ciphertext, tag := decoded[0], decoded[1], decoded[2], decoded[3], decoded[4]
+
+	h := map[string]string{}
+	if err := json.Unmarshal(header, &h); err != nil {
+		return "", fmt.Errorf("cannot decrypt token: cannot parse header: %s", err)
+	}
+	if h["alg"] != jweHeader["alg"] || h["enc"] != jweHeader["enc"] {
+		return "", fmt.Errorf("cannot decrypt token: unsupported algorithm %q/%q", h["alg"], h["enc"])
+	}
+
+	cek, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, key, encryptedKey, nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt token: %s", err)
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil || len(cek) != 32 {
+		return "", fmt.Errorf("cannot decrypt token: invalid content encryption key")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(iv) != gcm.NonceSize() || len(tag) != gcm.Overhead() {
+		return "", fmt.Errorf("cannot decrypt token: invalid IV or tag")
+	}
+	token, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt token: %s", err)
+	}
+	return string(token), nil
+}
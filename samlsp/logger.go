@@ -0,0 +1,26 @@
+package samlsp
+
+import "log"
+
+// Logger is the interface the middleware uses to report what happens to
+// requests. Debugf is used for messages that are expected during normal
+// operation, such as stale cookies, and that most operators will want to
+// discard. Printf is used for everything else.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Printf(format string, v ...interface{})
+}
+
+// DefaultLogger is the Logger used when Middleware.Logger is nil. It sends
+// all messages, including debug messages, to the standard logger.
+var DefaultLogger Logger = stdLogger{}
+
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
@@ -0,0 +1,144 @@
+package samlsp
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/tambeti/saml"
+)
+
+// minRefreshRetryDelay is the delay before the first retry after a failed
+// metadata refresh. It doubles on each consecutive failure, up to the
+// refresh interval.
+const minRefreshRetryDelay = 5 * time.Second
+
+// MetadataRefresher periodically re-fetches the IDP metadata from URL and
+// installs it on Middleware.
+//
+// The metadata is refreshed after Interval at most, but sooner if the
+// cacheDuration of the metadata in use is shorter, or its validUntil is
+// nearer. The requests are conditional on the ETag and Last-Modified
+// headers of the previous response, so metadata that has not changed is
+// neither transferred nor parsed again.
+//
+// To avoid many instances refreshing in lock-step, each delay is moved
+// randomly by up to Jitter (a fraction of Interval) in either direction.
+// Concurrent calls to Refresh are coalesced into a single HTTP request.
+// When a refresh fails the previous metadata remains in use and the next
+// attempt is made after an exponentially increasing delay.
+type MetadataRefresher struct {
+	Middleware *Middleware
+	URL        string
+	Interval   time.Duration
+	Jitter     float64
+
+	mu       sync.Mutex
+	inflight *refreshCall
+
+	// validators is only used by the refresh in flight.
+	validators metadataValidators
+}
+
+type refreshCall struct {
+	done chan struct{}
+	err  error
+
+	// waiters is the number of other calls waiting for this one.
+	waiters int
+}
+
+// Run refreshes the metadata until ctx is done, and then returns ctx.Err().
+// It is suitable for running in its own goroutine, e.g. as part of an
+// errgroup.
+func (r *MetadataRefresher) Run(ctx context.Context) error {
+	retryDelay := minRefreshRetryDelay
+	delay := r.nextDelay()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.jitter(delay)):
+		}
+
+		if err := r.refresh(ctx); err != nil {
+			r.Middleware.logger().Printf("ERROR: %s: %s (will retry in %s)", r.URL, err, retryDelay)
+			delay = retryDelay
+			retryDelay *= 2
+			if retryDelay > r.Interval {
+				retryDelay = r.Interval
+			}
+			continue
+		}
+		retryDelay = minRefreshRetryDelay
+		delay = r.nextDelay()
+	}
+}
+
+// nextDelay returns how long to wait before refreshing the metadata in use:
+// Interval, unless its cacheDuration or validUntil call for a refresh
+// sooner. Expired metadata is refreshed after minRefreshRetryDelay.
+func (r *MetadataRefresher) nextDelay() time.Duration {
+	delay := r.Interval
+	md := r.Middleware.serviceProvider().IDPMetadata
+	if md == nil {
+		return delay
+	}
+	if md.CacheDuration > 0 && md.CacheDuration < delay {
+		delay = md.CacheDuration
+	}
+	if !md.ValidUntil.IsZero() {
+		if d := md.ValidUntil.Sub(saml.TimeNow()); d < delay {
+			delay = d
+		}
+	}
+	if delay < minRefreshRetryDelay {
+		delay = minRefreshRetryDelay
+	}
+	return delay
+}
+
+// Refresh fetches the metadata now and installs it on the middleware. If a
+// refresh is already in progress, Refresh waits for it and returns its
+// result instead of making another request. Transient failures are retried
+// as ServiceProvider.RetryPolicy of the middleware says. On error, or if the
+// server reports that the metadata has not changed, the metadata in use is
+// left unchanged.
+func (r *MetadataRefresher) Refresh() error {
+	return r.refresh(context.Background())
+}
+
+// refresh is Refresh, but gives up retrying when ctx is done.
+func (r *MetadataRefresher) refresh(ctx context.Context) error {
+	r.mu.Lock()
+	if call := r.inflight; call != nil {
+		call.waiters++
+		r.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	r.inflight = call
+	r.mu.Unlock()
+
+	var entity *saml.Metadata
+	entity, call.err = r.Middleware.fetchMetadata(ctx, r.Middleware.ServiceProvider.RetryPolicy, r.URL, &r.validators)
+	if call.err == nil && entity != nil {
+		r.Middleware.SetIDPMetadata(entity)
+	}
+
+	r.mu.Lock()
+	r.inflight = nil
+	r.mu.Unlock()
+	close(call.done)
+	return call.err
+}
+
+// jitter returns d moved randomly by up to r.Jitter*d in either direction.
+func (r *MetadataRefresher) jitter(d time.Duration) time.Duration {
+	if r.Jitter <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*r.Jitter*float64(d))
+}
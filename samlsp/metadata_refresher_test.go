@@ -0,0 +1,283 @@
+package samlsp
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/tambeti/saml"
+)
+
+const refresherTestMetadata = `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com/metadata">` +
+	`<IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">` +
+	`<SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>` +
+	`</IDPSSODescriptor>` +
+	`</EntityDescriptor>`
+
+func (test *ParseTest) TestRefreshKeepsMetadataOnFailure(c *C) {
+	transport := mockTransport(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			Header:     http.Header{},
+			Request:    req,
+			StatusCode: http.StatusInternalServerError,
+			Status:     "Internal Server Error",
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	})
+
+	md := &saml.Metadata{EntityID: "https://idp.example.com/metadata"}
+	m := &Middleware{ServiceProvider: saml.ServiceProvider{
+		IDPMetadata: md,
+		HTTPClient:  &http.Client{Transport: transport},
+	}}
+	r := &MetadataRefresher{Middleware: m, URL: "https://idp.example.com/metadata", Interval: time.Hour}
+
+	err := r.Refresh()
+	c.Assert(err, NotNil)
+	c.Assert(m.serviceProvider().IDPMetadata, Equals, md)
+}
+
+func (test *ParseTest) TestRefreshReplacesMetadata(c *C) {
+	transport := mockTransport(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			Header:     http.Header{},
+			Request:    req,
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(refresherTestMetadata)),
+		}, nil
+	})
+
+	md := &saml.Metadata{EntityID: "https://idp.example.com/metadata"}
+	m := &Middleware{ServiceProvider: saml.ServiceProvider{
+		IDPMetadata: md,
+		HTTPClient:  &http.Client{Transport: transport},
+	}}
+	r := &MetadataRefresher{Middleware: m, URL: "https://idp.example.com/metadata", Interval: time.Hour}
+
+	err := r.Refresh()
+	c.Assert(err, IsNil)
+	c.Assert(m.serviceProvider().IDPMetadata, Not(Equals), md)
+	c.Assert(m.serviceProvider().GetSSOBindingLocation(saml.HTTPRedirectBinding), Equals, "https://idp.example.com/sso")
+}
+
+func (test *ParseTest) TestRefreshCoalescesConcurrentCalls(c *C) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	requests := 0
+	transport := mockTransport(func(req *http.Request) (*http.Response, error) {
+		requests++
+		if requests == 1 {
+			close(started)
+			<-release
+		}
+		return &http.Response{
+			Header:     http.Header{},
+			Request:    req,
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(refresherTestMetadata)),
+		}, nil
+	})
+
+	m := &Middleware{ServiceProvider: saml.ServiceProvider{
+		IDPMetadata: &saml.Metadata{},
+		HTTPClient:  &http.Client{Transport: transport},
+	}}
+	r := &MetadataRefresher{Middleware: m, URL: "https://idp.example.com/metadata", Interval: time.Hour}
+
+	wg := sync.WaitGroup{}
+	errs := make([]error, 2)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs[0] = r.Refresh()
+	}()
+	<-started
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs[1] = r.Refresh()
+	}()
+	// release the request only once the second call waits for it
+	for waiting := false; !waiting; {
+		runtime.Gosched()
+		r.mu.Lock()
+		waiting = r.inflight.waiters == 1
+		r.mu.Unlock()
+	}
+	close(release)
+	wg.Wait()
+
+	c.Assert(errs[0], IsNil)
+	c.Assert(errs[1], IsNil)
+	c.Assert(requests, Equals, 1)
+}
+
+func (test *ParseTest) TestRefreshJitter(c *C) {
+	r := &MetadataRefresher{Interval: time.Hour, Jitter: 0.1}
+	for i := 0; i < 100; i++ {
+		d := r.jitter(time.Hour)
+		c.Assert(d >= 54*time.Minute, Equals, true)
+		c.Assert(d <= 66*time.Minute, Equals, true)
+	}
+}
+
+func (test *ParseTest) TestFetchMetadataRetries(c *C) {
+	statuses := []int{}
+	transport := mockTransport(func(req *http.Request) (*http.Response, error) {
+		status := http.StatusOK
+		if len(statuses) == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		statuses = append(statuses, status)
+		return &http.Response{
+			Header:     http.Header{},
+			Request:    req,
+			StatusCode: status,
+			Status:     http.StatusText(status),
+			Body:       ioutil.NopCloser(strings.NewReader(refresherTestMetadata)),
+		}, nil
+	})
+
+	m, err := New(Options{
+		Key:                    test.Key,
+		IDPMetadataURL:         "https://idp.example.com/metadata",
+		IDPMetadataRetryPolicy: saml.RetryPolicy{InitialBackoff: time.Millisecond},
+		HTTPClient:             &http.Client{Transport: transport},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(statuses, DeepEquals, []int{http.StatusServiceUnavailable, http.StatusOK})
+	c.Assert(m.ServiceProvider.IDPMetadata.EntityID, Equals, "https://idp.example.com/metadata")
+}
+
+func (test *ParseTest) TestFetchMetadataGivesUp(c *C) {
+	requests := 0
+	status := http.StatusServiceUnavailable
+	transport := mockTransport(func(req *http.Request) (*http.Response, error) {
+		requests++
+		return &http.Response{
+			Header:     http.Header{},
+			Request:    req,
+			StatusCode: status,
+			Status:     http.StatusText(status),
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	})
+
+	m := &Middleware{ServiceProvider: saml.ServiceProvider{
+		IDPMetadata: &saml.Metadata{},
+		HTTPClient:  &http.Client{Transport: transport},
+	}}
+	retryPolicy := saml.RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Millisecond}
+	_, err := m.fetchMetadata(context.Background(), retryPolicy, "https://idp.example.com/metadata", nil)
+	c.Assert(err, ErrorMatches, "503 Service Unavailable")
+	c.Assert(requests, Equals, 4)
+
+	// client errors are not retried
+	requests = 0
+	status = http.StatusNotFound
+	_, err = m.fetchMetadata(context.Background(), retryPolicy, "https://idp.example.com/metadata", nil)
+	c.Assert(err, ErrorMatches, "404 Not Found")
+	c.Assert(requests, Equals, 1)
+
+	// nor are attempts made that the deadline would not allow
+	requests = 0
+	status = http.StatusServiceUnavailable
+	retryPolicy.InitialBackoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err = m.fetchMetadata(ctx, retryPolicy, "https://idp.example.com/metadata", nil)
+	c.Assert(err, ErrorMatches, "503 Service Unavailable")
+	c.Assert(requests, Equals, 1)
+}
+
+func (test *ParseTest) TestRefreshNotModified(c *C) {
+	requests := []*http.Request{}
+	transport := mockTransport(func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			return &http.Response{
+				Header:     http.Header{},
+				Request:    req,
+				StatusCode: http.StatusNotModified,
+				Status:     "Not Modified",
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+			}, nil
+		}
+		return &http.Response{
+			Header: http.Header{
+				"Etag":          []string{`"v1"`},
+				"Last-Modified": []string{"Tue, 01 Dec 2015 01:57:09 GMT"},
+			},
+			Request:    req,
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(refresherTestMetadata)),
+		}, nil
+	})
+
+	m := &Middleware{ServiceProvider: saml.ServiceProvider{
+		IDPMetadata: &saml.Metadata{},
+		HTTPClient:  &http.Client{Transport: transport},
+	}}
+	r := &MetadataRefresher{Middleware: m, URL: "https://idp.example.com/metadata", Interval: time.Hour}
+
+	c.Assert(r.Refresh(), IsNil)
+	md := m.serviceProvider().IDPMetadata
+	c.Assert(md.EntityID, Equals, "https://idp.example.com/metadata")
+
+	c.Assert(r.Refresh(), IsNil)
+	c.Assert(m.serviceProvider().IDPMetadata, Equals, md)
+
+	c.Assert(requests, HasLen, 2)
+	c.Assert(requests[0].Header.Get("If-None-Match"), Equals, "")
+	c.Assert(requests[0].Header.Get("If-Modified-Since"), Equals, "")
+	c.Assert(requests[1].Header.Get("If-None-Match"), Equals, `"v1"`)
+	c.Assert(requests[1].Header.Get("If-Modified-Since"), Equals, "Tue, 01 Dec 2015 01:57:09 GMT")
+}
+
+func (test *ParseTest) TestRefreshDelayFromMetadata(c *C) {
+	timeNow := saml.TimeNow
+	defer func() {
+		saml.TimeNow = timeNow
+	}()
+	now := time.Date(2015, 12, 1, 1, 57, 9, 0, time.UTC)
+	saml.TimeNow = func() time.Time { return now }
+
+	md := &saml.Metadata{}
+	m := &Middleware{ServiceProvider: saml.ServiceProvider{IDPMetadata: md}}
+	r := &MetadataRefresher{Middleware: m, Interval: time.Hour}
+	c.Assert(r.nextDelay(), Equals, time.Hour)
+
+	md.CacheDuration = 10 * time.Minute
+	c.Assert(r.nextDelay(), Equals, 10*time.Minute)
+
+	// the interval is the longest delay
+	md.CacheDuration = 2 * time.Hour
+	c.Assert(r.nextDelay(), Equals, time.Hour)
+
+	md.ValidUntil = now.Add(5 * time.Minute)
+	c.Assert(r.nextDelay(), Equals, 5*time.Minute)
+
+	// expired metadata is refreshed soon
+	md.ValidUntil = now.Add(-time.Minute)
+	c.Assert(r.nextDelay(), Equals, minRefreshRetryDelay)
+
+	// the delay follows the metadata installed by a refresh
+	transport := mockTransport(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			Header:     http.Header{},
+			Request:    req,
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(strings.Replace(refresherTestMetadata, `entityID=`, `cacheDuration="PT15M" entityID=`, 1))),
+		}, nil
+	})
+	m.ServiceProvider.HTTPClient = &http.Client{Transport: transport}
+	r.URL = "https://idp.example.com/metadata"
+	c.Assert(r.Refresh(), IsNil)
+	c.Assert(r.nextDelay(), Equals, 15*time.Minute)
+}
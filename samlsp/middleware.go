@@ -1,13 +1,26 @@
 package samlsp
 
 import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
-	"log"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -19,7 +32,8 @@ import (
 // to support SAML.
 //
 // It implements http.Handler so that it can provide the metadata and ACS endpoints,
-// typically /saml/metadata and /saml/acs, respectively.
+// typically /saml/metadata and /saml/acs, respectively, and an endpoint
+// that starts a login, typically /saml/login.
 //
 // It also provides middleware, RequireAccount which redirects users to
 // the auth process if they do not have session credentials.
@@ -48,277 +62,2811 @@ import (
 //
 // When issuing JSON Web Tokens, a signing key is required. Because the
 // SAML service provider already has a private key, we borrow that key
-// to sign the JWTs as well.
+// to sign the JWTs as well, unless TokenKey is set.
+//
+// If JWTIssuer or JWTAudience are set, the session token carries them as
+// the `iss` and `aud` claims, and IsAuthorized rejects tokens whose claims
+// do not match.
+//
+// If the IDP metadata may change while the middleware is serving requests
+// (see MetadataRefresher) it must be replaced with SetIDPMetadata rather than
+// by assigning ServiceProvider.IDPMetadata directly.
 type Middleware struct {
 	ServiceProvider   saml.ServiceProvider
 	AllowIDPInitiated bool
+	JWTIssuer         string
+	JWTAudience       string
+	MetadataRefresher *MetadataRefresher
+
+	// LoginEndpointURL, if set, is the URL of an endpoint that starts a
+	// login as RequireAccount does, e.g. for a "Log in with SSO" button.
+	// The user is sent to the target in its next parameter afterwards, if
+	// that is an allowed redirect (see AllowedRedirectHosts), and to "/"
+	// otherwise. A user who already has a session is sent there at once.
+	// New sets it to URL + "/saml/login".
+	LoginEndpointURL string
+
+	// IDPEntityID, if set, is the entityID of the IDP. It selects the IDP
+	// from metadata fetched from a URL, as by MetadataRefresher, that is
+	// an EntitiesDescriptor, such as the aggregate that a federation
+	// publishes, and is checked against the entityID of metadata that
+	// describes a single entity. Without it, the first IDP in an aggregate
+	// is used.
+	IDPEntityID string
+
+	// Logger receives the messages logged by the middleware. If nil,
+	// DefaultLogger is used.
+	Logger Logger
+
+	// RelayStateLength is the number of random bytes in the RelayState
+	// that RequireAccount sends to the IDP. If zero, DefaultRelayStateLength
+	// is used. The bytes are sent unpadded base64url encoded, i.e. as
+	// 4/3 as many characters, and SAML limits the RelayState to 80 bytes,
+	// so it may not be more than 60. Use a smaller value for IDPs that
+	// restrict the RelayState further.
+	RelayStateLength int
+
+	// Rand is the source of the random bytes of the RelayState, and so of
+	// the names of the saml_ cookies that RequireAccount sets. If nil,
+	// saml.RandReader is used. Tests may set it to get predictable values.
+	Rand io.Reader
+
+	// TrustedProxies are the networks of the proxies whose
+	// X-Forwarded-Proto and X-Forwarded-Host headers are honored, both when
+	// RequireAccount records the URL to return to after login and by
+	// RequireSecureTransport. The headers of a request are only honored if
+	// its RemoteAddr is in one of them, as anyone else can set them too.
+	TrustedProxies []*net.IPNet
+
+	// TrustForwardedHeaders honors the X-Forwarded-* headers of requests
+	// from any address if TrustedProxies is empty. Only set it when the
+	// middleware is reached exclusively through a proxy that sets (or
+	// strips) these headers.
+	//
+	// Deprecated: set TrustedProxies instead.
+	TrustForwardedHeaders bool
+
+	// PathPrefix is a prefix of the paths of ServiceProvider.MetadataURL and
+	// ServiceProvider.AcsURL that a reverse proxy, or a router such as
+	// http.StripPrefix, strips before passing requests on, e.g. "/app" when
+	// https://example.com/app/saml/acs reaches the middleware as /saml/acs.
+	// ServeHTTP serves the endpoints both with and without it.
+	PathPrefix string
+
+	// SkipPaths are the paths of requests that RequireAccount passes
+	// straight to its handler, without a session, e.g. "/healthz". A path
+	// ending in a slash, such as "/static/", also matches all the paths
+	// under it. The request is passed on as is, so the handler gets no
+	// X-Saml-* headers or RequestAttributes even if there is a session.
+	SkipPaths []string
+
+	// IsAPIRequest, if not nil, tells the requests of API clients, such as
+	// XHRs, that cannot follow a redirect to the login page of the IDP.
+	// RequireAccount answers them with 401 Unauthorized, and the URL of the
+	// login page in the Location member of a JSON body and in a
+	// WWW-Authenticate header, for the client to navigate to itself.
+	// DetectAPIRequest is a suitable value.
+	IsAPIRequest func(r *http.Request) bool
+
+	// LoginRedirectStatus is the status code with which RequireAccount
+	// redirects the user to the IDP, and PostLoginRedirectStatus the one
+	// with which the ACS redirects the user back after login. If zero,
+	// http.StatusFound is used. http.StatusSeeOther guarantees that
+	// browsers follow the redirect after the POST to the ACS with a GET, so
+	// that reloading the page does not post the response again.
+	LoginRedirectStatus     int
+	PostLoginRedirectStatus int
+
+	// RequireSecureTransport causes the ACS to reject responses that were
+	// not received over HTTPS, and the session cookie to be marked Secure.
+	// A request counts as received over HTTPS if it came over TLS or, from
+	// one of TrustedProxies, if its X-Forwarded-Proto is https. It is off
+	// for compatibility, but assertions are bearer tokens: anyone who sees
+	// one on its way to the ACS over plain HTTP can log in with it, as can
+	// anyone who sees the session cookie.
+	RequireSecureTransport bool
+
+	// AllowedRedirectHosts are the hosts, as host or host:port, besides
+	// that of ServiceProvider.AcsURL, to which the user may be redirected
+	// after login. This applies both to the URL recorded by RequireAccount
+	// and to the RelayState of an IDP-initiated login.
+	AllowedRedirectHosts []string
+
+	// CookiePath and CookieDomain are the Path and Domain of the session
+	// cookie. If CookiePath is empty, "/" is used; set it when the
+	// application is mounted under a sub-path. If CookieDomain is empty, the
+	// cookie is only sent to the host that set it; set it to share the
+	// session across subdomains. It must be the host of
+	// ServiceProvider.AcsURL or a parent domain of it. The state cookie set
+	// by RequireAccount is always scoped to the path of the ACS URL.
+	CookiePath   string
+	CookieDomain string
+
+	// CookiePartitioned adds the Partitioned attribute of CHIPS to the
+	// session and state cookies, so that browsers that block third-party
+	// cookies still keep them when the application is embedded in another
+	// site, in a cookie jar of that site. As browsers require partitioned
+	// cookies to be Secure, it also marks them Secure.
+	CookiePartitioned bool
+
+	// EncryptSessionToken causes the session cookie to hold the signed JWT
+	// encrypted to the signing key, as a JWE using RSA-OAEP and A256GCM,
+	// so that the attributes in it cannot be read in the browser. Sessions
+	// whose tokens are only signed remain valid, so that it can be turned
+	// on without logging everyone out.
+	EncryptSessionToken bool
+
+	// CompressState causes the state of each login in progress, in its
+	// saml_ cookie, StateHeader or StateStore, to be kept with its payload
+	// deflated and without its header, which is always the same, so that
+	// many logins in progress take less room in the cookies sent to the
+	// ACS. State in either form is accepted, so that it can be turned on
+	// and off while logins are in progress.
+	CompressState bool
+
+	// TokenSigningMethod is the JWT alg of the session and state tokens,
+	// RS256 or PS256 for keys that only make RSASSA-PSS signatures. If
+	// empty, RS256 is used. Tokens signed with either are accepted, so that
+	// it can be changed without logging everyone out.
+	TokenSigningMethod string
+
+	// TokenKey, if not nil, signs (and encrypts) the session and state
+	// tokens instead of ServiceProvider.Key. RetiredTokenKeys are the keys
+	// that signed tokens before, whose tokens are accepted until they
+	// expire. To rotate the key without logging everyone out, move the
+	// current TokenKey to RetiredTokenKeys when setting a new one, and
+	// remove it once the longest lived token signed with it has expired.
+	// Tokens signed with one of the keys of ServiceProvider are always
+	// accepted, so that TokenKey can be introduced the same way.
+	TokenKey         *rsa.PrivateKey
+	RetiredTokenKeys []*rsa.PrivateKey
+
+	// IssuedAtAssertion sets the `iat` claim of the session token to the
+	// IssueInstant of the assertion rather than the time of Authorize, so
+	// that sessions can be joined with the logs of the IDP on it, unless
+	// the clock of the IDP is ahead and the IssueInstant is in the future.
+	// The time the user authenticated with the IDP is in the `auth_time`
+	// claim either way. The token is still only valid from the time of
+	// Authorize.
+	IssuedAtAssertion bool
+
+	// ClaimsModifier, if not nil, is called by Authorize with the claims of
+	// the session token before it is signed, to add or change claims, e.g.
+	// to derive a tenant from the mail attribute. It is called after the
+	// attributes and the `sub`, `name_id`, `auth_time`, `acr` and
+	// `authn_authorities` claims have been set, and before `iat`, `nbf`,
+	// `exp`, `iss` and `aud`, so those cannot be changed. Claims whose
+	// values are strings or lists of strings are presented as attributes
+	// by IsAuthorized, others are ignored.
+	ClaimsModifier func(assertion *saml.Assertion, claims jwt.MapClaims)
+
+	// HeaderNameFunc, if not nil, chooses the name of the request header
+	// that IsAuthorized sets for each attribute of the session, instead of
+	// X-Saml-<name>, e.g. to give attributes named by OID readable names.
+	// If include is false, the attribute is not set as a header, but it is
+	// still available from RequestAttributes. Any header of the returned
+	// name that the client sent is removed first, but a client can still
+	// send headers for attributes that the session does not have, so only
+	// return names that a proxy in front of the application strips.
+	HeaderNameFunc func(attributeName string) (headerName string, include bool)
+
+	// HeaderValueSeparator, if not empty, makes IsAuthorized join the
+	// values of a multi-valued attribute into a single header, separated
+	// by it, e.g. ", ", for proxies that only read the first of repeated
+	// headers. By default each value is set as a separate header of the
+	// same name. Joined values are not split again when RequireAttribute
+	// falls back to the headers, so the separator should not appear in
+	// the values.
+	HeaderValueSeparator string
+
+	// SplitAttributes maps the FriendlyName or Name of attributes whose
+	// values are lists, e.g. of groups, to the delimiter, such as ";", that
+	// separates the items. Authorize splits each value of such an attribute
+	// into its items, trimmed of spaces, so that they become separate
+	// values in the session token, in its headers and in RequestAttributes,
+	// and RequireAttribute can match any one of them. Empty items are
+	// dropped.
+	SplitAttributes map[string]string
+
+	// ExcludeAttributes are the FriendlyNames or Names of attributes that
+	// Authorize leaves out of the session, e.g. large ones such as photos
+	// or ones that must not be stored in the browser, so that they appear
+	// neither in the session token nor in its headers. ClaimsModifier and
+	// OnResponse still see them in the assertion. By default all
+	// attributes are kept.
+	ExcludeAttributes []string
+
+	// NameFormatPrefixes maps the NameFormat of attributes, e.g.
+	// saml.AttributeNameFormatURI, to a prefix, e.g. "uri:", that Authorize
+	// puts before the names of their claims in the session token, and so
+	// before the names of their headers. Attributes of the same name in
+	// different NameFormats then get claims of their own, rather than
+	// sharing one. RequestAttributes still has their names without the
+	// prefix. As a colon is not allowed in header names, choose another
+	// prefix, or HeaderNameFunc, if the headers are passed on to another
+	// server. By default no claim name is prefixed.
+	NameFormatPrefixes map[string]string
+
+	// OnResponse, if not nil, is called with every SAML response that the
+	// ACS receives, once it has been parsed and either accepted or
+	// rejected, e.g. to archive it for auditing. If it returns an error for
+	// a response that was accepted, the login fails with 500 Internal
+	// Server Error; errors for rejected responses are only logged.
+	OnResponse func(r *http.Request, response *ReceivedResponse) error
+
+	// RequestID, if not nil, returns the ID of the AuthnRequest that
+	// RequireAccount sends for r, e.g. to embed a trace ID so that the
+	// login can be followed through the logs of both us and the IDP. The
+	// ID must be a valid XML ID (see saml.WithID) and should be unique; if
+	// RequestID returns an empty string, a random ID is used.
+	RequestID func(r *http.Request) string
+
+	// OnLogin, if not nil, is called by RequireAccount when it starts a
+	// login for r, and returns the URL to send the user back to once the
+	// login completes, which is signed into the state of the login instead
+	// of the URL of r, e.g. to encode a tenant in it or to check that it
+	// belongs to the application. If it returns an error, the login is not
+	// started and the request fails with 403 Forbidden. The URL is still
+	// subject to AllowedRedirectHosts when the user returns.
+	OnLogin func(r *http.Request) (originalURL string, err error)
+
+	// DenyNameID, if not nil, is consulted with the NameID of the subject of
+	// each session, as recorded in the session token, and a session for
+	// which it returns true is treated as if there were none, e.g. to
+	// revoke the access of a user at once rather than when their session
+	// expires. It is also consulted when the ACS would issue a session,
+	// which is then refused with 403 Forbidden, so that the user is not
+	// sent back and forth between us and the IDP. It is called for every
+	// request with a session, so it should be fast. Transient NameIDs
+	// (see saml.NameID.IsTransient) differ at each login, so they cannot
+	// be denied in advance; a warning is logged for logins with one.
+	DenyNameID func(nameID saml.NameID) bool
+
+	// RequireSameNameID, if set, makes the ACS refuse, with 403 Forbidden,
+	// a login by a browser that already has a valid session unless the
+	// NameID of the assertion equals the NameID of that session, so that
+	// a re-authentication, e.g. for step-up, cannot swap in another
+	// account. It cannot be used with transient NameIDs, which differ at
+	// each login; the user must log out before logging in as someone else.
+	RequireSameNameID bool
+
+	// OnSession, if not nil, is called once for each login, with the
+	// accepted assertion, just before the session cookie is set and the
+	// user redirected, e.g. to provision an account for the user or to
+	// record the login. It may set headers on w, but must not write the
+	// response. If it returns an error, the error is logged, no session is
+	// issued and the login fails with 403 Forbidden.
+	OnSession func(w http.ResponseWriter, r *http.Request, assertion *saml.Assertion) error
+
+	// TokenCacheSize, if non-zero, causes IsAuthorized to remember up to
+	// this many verified session tokens, so that requests presenting the
+	// same cookie again skip verifying its signature. TokenCacheTTL is how
+	// long a token is remembered; if zero, DefaultTokenCacheTTL is used.
+	// A token is never remembered past its expiry, but one signed with a
+	// key that has since been removed is accepted until the TTL elapses.
+	TokenCacheSize int
+	TokenCacheTTL  time.Duration
+
+	// StateStore, if not nil, keeps the state of the logins started by
+	// RequireAccount, keyed by their RelayState, instead of the saml_
+	// cookie of each login, which then only holds a random value that is
+	// stored with the state. Browsers that start many logins then send the
+	// ACS small cookies rather than whole states. The ACS only accepts a
+	// stored state from the browser that has its cookie, so that a login
+	// started by someone else cannot be completed in the user's browser,
+	// and each state can be used only once.
+	StateStore StateStore
+
+	// SessionStore, if not nil, keeps a record of each session that the
+	// ACS issues, and a session token is only accepted while its record is
+	// there, so that sessions can be ended on the server: by Logout, and by
+	// the IDP with a back-channel LogoutRequest to ServiceProvider.SloURL,
+	// which ServeHTTP serves when both are set. Sessions issued before it
+	// was set have no record, so those users must log in again.
+	SessionStore SessionStore
+
+	// StateHeader, if not empty, is the name of a header that carries the
+	// state of a login besides the saml_ cookie, for native apps whose
+	// embedded web view does not reliably keep cookies. RequireAccount
+	// sets it on its redirect to the IDP, and Authorize accepts it on the
+	// request to the ACS when there is no cookie for the RelayState. The
+	// header carries the same signed token as the cookie, bound to the
+	// RelayState, but unlike the cookie it is not tied to the browser, so
+	// an app must not let other origins see it. It is not used with
+	// StateStore.
+	StateHeader string
+
+	// MaxStateCookies is the most saml_ state cookies, one per login in
+	// progress, that a browser is left with. When RequireAccount starts a
+	// login or the ACS completes one, the oldest state cookies beyond it
+	// are expired, and the ACS only looks at the newest ones, which bounds
+	// the size of the Cookie header and the tokens verified per response.
+	// Browsers only send the state cookies to the ACS path, so
+	// RequireAccount sees them only if it protects that path too. If zero,
+	// DefaultMaxStateCookies is used; if negative, there is no limit.
+	MaxStateCookies int
+
+	// RateLimiter, if not nil, is asked whether to handle each request to
+	// the ACS before its response is parsed; requests that it does not
+	// allow are answered with 429 Too Many Requests.
+	RateLimiter RateLimiter
+
+	// ReplayPostBodySize, if positive, makes RequireAccount keep the body
+	// of a form POST that starts a login, if it is no larger than this many
+	// bytes, in the state of the login. After the login the ACS then shows
+	// a form that the user submits to post it again to the original URL,
+	// rather than redirecting there with a GET, so that the data the user
+	// submitted is not lost. Only application/x-www-form-urlencoded bodies
+	// of requests that the browser says came from the same origin, with
+	// Sec-Fetch-Site or Origin, are kept, lest another site use the login
+	// to post on behalf of the user. The body travels in the state cookie,
+	// which is then HttpOnly and which browsers limit to about 4 KB, unless
+	// StateStore is set.
+	ReplayPostBodySize int64
+
+	// SessionRenewalWindow, if non-zero, makes sessions sliding: when
+	// RequireAccount lets through a request whose session token expires
+	// within this time, it issues a new token, valid for as long again as
+	// a new session, so that active users are not logged out mid-session.
+	// Sessions are never renewed past SessionMaxLifetime after the login,
+	// or past the SessionNotOnOrAfter of the IDP. If SessionMaxLifetime is
+	// zero, DefaultSessionMaxLifetime is used. Only sessions issued while
+	// SessionRenewalWindow is set are renewed.
+	SessionRenewalWindow time.Duration
+	SessionMaxLifetime   time.Duration
+
+	idpMetadataMu  sync.RWMutex
+	tokenCacheOnce sync.Once
+	tokenCache     *tokenCache
 }
 
 const cookieMaxAge = time.Hour // TODO(ross): must be configurable
 const cookieName = "token"
 
-func randomBytes(n int) []byte {
+// DefaultRelayStateLength is the default for Middleware.RelayStateLength.
+// It is encoded as 56 characters.
+const DefaultRelayStateLength = 42
+
+// DefaultSessionMaxLifetime is the default for Middleware.SessionMaxLifetime.
+const DefaultSessionMaxLifetime = 8 * time.Hour
+
+// DefaultMaxStateCookies is the default for Middleware.MaxStateCookies.
+const DefaultMaxStateCookies = 5
+
+// stateBindingLength is how many random bytes bind a login whose state is
+// in the StateStore to the browser that started it.
+const stateBindingLength = 32
+
+// maxRelayStateSize is the longest RelayState that SAML allows, in bytes.
+const maxRelayStateSize = 80
+
+// checkRelayStateLength returns an error if n random bytes would not fit in
+// a RelayState once encoded.
+func checkRelayStateLength(n int) error {
+	if n < 0 || base64.RawURLEncoding.EncodedLen(n) > maxRelayStateSize {
+		return fmt.Errorf("RelayStateLength %d does not fit in the %d byte RelayState", n, maxRelayStateSize)
+	}
+	return nil
+}
+
+// sessionTokenCache returns the cache of verified session tokens, or nil if
+// TokenCacheSize is zero.
+func (m *Middleware) sessionTokenCache() *tokenCache {
+	if m.TokenCacheSize <= 0 {
+		return nil
+	}
+	m.tokenCacheOnce.Do(func() {
+		ttl := m.TokenCacheTTL
+		if ttl == 0 {
+			ttl = DefaultTokenCacheTTL
+		}
+		m.tokenCache = newTokenCache(m.TokenCacheSize, ttl)
+	})
+	return m.tokenCache
+}
+
+func (m *Middleware) cookiePath() string {
+	if m.CookiePath == "" {
+		return "/"
+	}
+	return m.CookiePath
+}
+
+// checkRedirectStatus returns an error unless status is zero or a 3xx
+// status code.
+func checkRedirectStatus(status int) error {
+	if status != 0 && (status < 300 || status > 399) {
+		return fmt.Errorf("redirect status %d is not a 3xx status code", status)
+	}
+	return nil
+}
+
+// redirectStatus returns status, or http.StatusFound if it is zero.
+func redirectStatus(status int) int {
+	if status == 0 {
+		return http.StatusFound
+	}
+	return status
+}
+
+// checkCookieDomain returns an error if a cookie with the given Domain
+// would not be sent to the host of acsURL.
+func checkCookieDomain(domain, acsURL string) error {
+	if domain == "" {
+		return nil
+	}
+	u, err := url.Parse(acsURL)
+	if err != nil {
+		return fmt.Errorf("cannot parse ACS URL: %s", err)
+	}
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	d := strings.ToLower(strings.TrimPrefix(domain, "."))
+	if d == "" || (host != d && !strings.HasSuffix(host, "."+d)) {
+		return fmt.Errorf("CookieDomain %q does not match the ACS URL host %q", domain, host)
+	}
+	return nil
+}
+
+func (m *Middleware) maxStateCookies() int {
+	if m.MaxStateCookies == 0 {
+		return DefaultMaxStateCookies
+	}
+	return m.MaxStateCookies
+}
+
+func (m *Middleware) relayStateLength() int {
+	if m.RelayStateLength == 0 {
+		return DefaultRelayStateLength
+	}
+	return m.RelayStateLength
+}
+
+// originalURL returns the URL of r to redirect back to once the SAML flow
+// has completed. If the request came through a trusted proxy, the URL is
+// made absolute using the scheme and host the client used to reach the
+// proxy.
+func (m *Middleware) originalURL(r *http.Request) string {
+	if !m.trustForwardedHeaders(r) {
+		return r.URL.String()
+	}
+	proto := firstHeaderValue(r, "X-Forwarded-Proto")
+	host := firstHeaderValue(r, "X-Forwarded-Host")
+	if proto == "" && host == "" {
+		return r.URL.String()
+	}
+
+	u := *r.URL
+	u.Scheme = strings.ToLower(proto)
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	u.Host = host
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	return u.String()
+}
+
+// isSecure returns true if r was received over TLS, or came through a
+// trusted proxy that says that it was.
+func (m *Middleware) isSecure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return m.trustForwardedHeaders(r) && strings.EqualFold(firstHeaderValue(r, "X-Forwarded-Proto"), "https")
+}
+
+// trustForwardedHeaders returns true if the X-Forwarded-* headers of r may
+// be honored, see TrustedProxies.
+func (m *Middleware) trustForwardedHeaders(r *http.Request) bool {
+	if len(m.TrustedProxies) == 0 {
+		return m.TrustForwardedHeaders
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range m.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstHeaderValue returns the first of the comma separated values of the
+// header name, which for X-Forwarded-* is the one set by the proxy nearest
+// the client.
+func firstHeaderValue(r *http.Request, name string) string {
+	v := r.Header.Get(name)
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
+
+func (m *Middleware) randomBytes(n int) []byte {
+	rand := m.Rand
+	if rand == nil {
+		rand = saml.RandReader
+	}
 	rv := make([]byte, n)
-	if _, err := saml.RandReader.Read(rv); err != nil {
+	if _, err := io.ReadFull(rand, rv); err != nil {
 		panic(err)
 	}
 	return rv
 }
 
+// SetIDPMetadata replaces the IDP metadata used by the middleware. It is
+// safe to call while requests are being served.
+func (m *Middleware) SetIDPMetadata(md *saml.Metadata) {
+	m.idpMetadataMu.Lock()
+	defer m.idpMetadataMu.Unlock()
+	m.ServiceProvider.IDPMetadata = md
+}
+
+// serviceProvider returns a copy of m.ServiceProvider whose IDP metadata
+// won't change underneath the caller.
+func (m *Middleware) serviceProvider() *saml.ServiceProvider {
+	m.idpMetadataMu.RLock()
+	defer m.idpMetadataMu.RUnlock()
+	sp := m.ServiceProvider
+	return &sp
+}
+
+func (m *Middleware) logger() Logger {
+	if m.Logger == nil {
+		return DefaultLogger
+	}
+	return m.Logger
+}
+
+type contextKey int
+
+const (
+	appRelayStateContextKey contextKey = iota
+	attributesContextKey
+	authnContextContextKey
+	nameIDContextKey
+	replayBodyContextKey
+)
+
+// WithAppRelayState returns a shallow copy of r that carries state, an
+// application defined value, through the SAML flow. When RequireAccount
+// redirects such a request to the IDP it stores state in the signed state
+// cookie, so it is integrity protected and not subject to the size limit
+// of the RelayState parameter. When the flow completes, the request passed
+// to Authorize carries the value again; use AppRelayState to retrieve it.
+func WithAppRelayState(r *http.Request, state string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), appRelayStateContextKey, state))
+}
+
+// AppRelayState returns the application defined state carried by r, or an
+// empty string if there is none. See WithAppRelayState.
+func AppRelayState(r *http.Request) string {
+	state, _ := r.Context().Value(appRelayStateContextKey).(string)
+	return state
+}
+
+// AttributeKey identifies a SAML attribute by its NameFormat and Name, as
+// attributes with the same Name in different formats, e.g. a basic and a
+// uri one, are different attributes.
+type AttributeKey struct {
+	NameFormat string
+	Name       string
+}
+
+// Attributes are the SAML attributes of a session. Unlike the X-Saml-*
+// headers, they keep attributes that share a name apart, and preserve the
+// NameFormat of each attribute and the xsi:type of each value.
+type Attributes map[AttributeKey]saml.Attribute
+
+// Get returns the first value of the named attribute, or an empty string.
+// See Values.
+func (a Attributes) Get(name string) string {
+	values := a.Values(name)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Values returns the values of the attributes whose FriendlyName or Name is
+// name, in any NameFormat, as the X-Saml-* headers do. The values of
+// attributes in different formats are merged in the order of their keys.
+func (a Attributes) Values(name string) []string {
+	keys := []AttributeKey{}
+	for key, attr := range a {
+		if attr.FriendlyName == name || attr.Name == name {
+			keys = append(keys, key)
+		}
+	}
+	sort.Sort(attributeKeys(keys))
+
+	var values []string
+	for _, key := range keys {
+		for _, value := range a[key].Values {
+			values = append(values, value.Value)
+		}
+	}
+	return values
+}
+
+// RequestAttributes returns the SAML attributes of the session of a request
+// that was allowed through by RequireAccount, or nil.
+func RequestAttributes(r *http.Request) Attributes {
+	attributes, _ := r.Context().Value(attributesContextKey).(Attributes)
+	return attributes
+}
+
+// AuthnContext describes how and when the user of a session authenticated
+// to the IDP, as stated in the AuthnStatement of the assertion.
+type AuthnContext struct {
+	// AuthnInstant is when the user authenticated, or the zero time if
+	// the assertion had no AuthnStatement.
+	AuthnInstant time.Time
+
+	// ClassRef is the AuthnContextClassRef, e.g.
+	// "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
+	// or an empty string if the IDP did not state one.
+	ClassRef string
+
+	// AuthenticatingAuthorities are the entity IDs of the IDPs that took
+	// part in authenticating the user on behalf of the IDP, e.g. the
+	// upstream IDP of a proxying IDP, as stated by the
+	// AuthenticatingAuthority elements of the assertion.
+	AuthenticatingAuthorities []string
+}
+
+// RequestAuthnContext returns the AuthnContext of the session of a request
+// that was allowed through by RequireAccount, or nil.
+func RequestAuthnContext(r *http.Request) *AuthnContext {
+	authnContext, _ := r.Context().Value(authnContextContextKey).(*AuthnContext)
+	return authnContext
+}
+
+// RequestNameID returns the NameID of the subject of the session of a
+// request that was allowed through by RequireAccount, or nil if there is
+// none. Check its Format before keying persistent data on its Value: a
+// transient NameID (see saml.NameID.IsTransient) changes at every login.
+func RequestNameID(r *http.Request) *saml.NameID {
+	nameID, _ := r.Context().Value(nameIDContextKey).(*saml.NameID)
+	return nameID
+}
+
+type attributeKeys []AttributeKey
+
+func (k attributeKeys) Len() int      { return len(k) }
+func (k attributeKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k attributeKeys) Less(i, j int) bool {
+	if k[i].NameFormat != k[j].NameFormat {
+		return k[i].NameFormat < k[j].NameFormat
+	}
+	return k[i].Name < k[j].Name
+}
+
+// nameIDQualifiers records what the "sub" claim of the session token loses
+// of the NameID of the subject, so that Logout can send the IDP the NameID
+// as it was. It is stored in the "name_id" claim.
+type nameIDQualifiers struct {
+	Format          string `json:"format,omitempty"`
+	NameQualifier   string `json:"name_qualifier,omitempty"`
+	SPNameQualifier string `json:"sp_name_qualifier,omitempty"`
+}
+
+// sessionNameID returns the NameID of the subject of the session with the
+// given claims.
+func sessionNameID(claims jwt.MapClaims) saml.NameID {
+	var qualifiers nameIDQualifiers
+	if qualifiersClaim, ok := claims["name_id"]; ok {
+		buf, _ := json.Marshal(qualifiersClaim)
+		json.Unmarshal(buf, &qualifiers)
+	}
+	value, _ := claims["sub"].(string)
+	return saml.NameID{
+		Format:          qualifiers.Format,
+		NameQualifier:   qualifiers.NameQualifier,
+		SPNameQualifier: qualifiers.SPNameQualifier,
+		Value:           value,
+	}
+}
+
+// attributeTypes records what the string valued attribute claims of the
+// session token lose: the name, name format and value types of the SAML
+// attribute. It is stored in the "attr_types" claim, keyed by claim name.
+// Types has an entry for each value, so when attributes share a claim, More
+// records the attributes whose values follow those of the first. Prefix is
+// the prefix of the claim name from NameFormatPrefixes, if any.
+type attributeTypes struct {
+	Name       string           `json:"name,omitempty"`
+	NameFormat string           `json:"format,omitempty"`
+	Prefix     string           `json:"prefix,omitempty"`
+	Types      []string         `json:"types,omitempty"`
+	More       []attributeTypes `json:"more,omitempty"`
+}
+
 // ServeHTTP implements http.Handler and serves the SAML-specific HTTP endpoints
 // on the URIs specified by m.ServiceProvider.MetadataURL and
-// m.ServiceProvider.AcsURL.
+// m.ServiceProvider.AcsURL. The metadata is also served as JSON, for
+// tooling, on MetadataURL with ".json" appended, e.g. /saml/metadata.json.
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	metadataURL, _ := url.Parse(m.ServiceProvider.MetadataURL)
-	if r.URL.Path == metadataURL.Path {
-		buf, _ := xml.MarshalIndent(m.ServiceProvider.Metadata(), "", "  ")
-		w.Header().Set("Content-Type", "application/samlmetadata+xml")
-		w.Write(buf)
+	if m.isEndpointPath(r.URL.Path, m.ServiceProvider.MetadataURL) {
+		m.serveMetadata(w, r)
 		return
 	}
 
-	acsURL, _ := url.Parse(m.ServiceProvider.AcsURL)
-	if r.URL.Path == acsURL.Path {
-		r.ParseForm()
-		assertion, err := m.ServiceProvider.ParseResponse(r, m.getPossibleRequestIDs(r))
+	if m.ServiceProvider.MetadataURL != "" && m.isEndpointPath(r.URL.Path, m.ServiceProvider.MetadataURL+".json") {
+		m.serveMetadataJSON(w, r)
+		return
+	}
+
+	if m.isEndpointPath(r.URL.Path, m.ServiceProvider.AcsURL) {
+		m.serveACS(w, r)
+		return
+	}
+
+	if m.LoginEndpointURL != "" && m.isEndpointPath(r.URL.Path, m.LoginEndpointURL) {
+		m.serveLogin(w, r)
+		return
+	}
+
+	if m.SessionStore != nil && m.ServiceProvider.SloURL != "" && m.isEndpointPath(r.URL.Path, m.ServiceProvider.SloURL) {
+		m.serveSLO(w, r)
+		return
+	}
+
+	http.NotFoundHandler().ServeHTTP(w, r)
+}
+
+// isEndpointPath returns true if requestPath is the path of endpointURL,
+// ignoring a trailing slash, with or without PathPrefix.
+func (m *Middleware) isEndpointPath(requestPath string, endpointURL string) bool {
+	u, err := url.Parse(endpointURL)
+	if err != nil {
+		return false
+	}
+	endpointPath := trimTrailingSlash(u.Path)
+	requestPath = trimTrailingSlash(requestPath)
+	if requestPath == endpointPath {
+		return true
+	}
+	prefix := trimTrailingSlash(m.PathPrefix)
+	if prefix == "" || prefix == "/" || !strings.HasPrefix(endpointPath, prefix+"/") {
+		return false
+	}
+	return requestPath == strings.TrimPrefix(endpointPath, prefix)
+}
+
+// isSkipPath returns true if requestPath is one of SkipPaths, or under one
+// of them that ends in a slash. Paths that are not clean, such as
+// /static/../admin or /static//app.js, never match, since the handler
+// might resolve them to somewhere outside the skipped path.
+func (m *Middleware) isSkipPath(requestPath string) bool {
+	cleanPath := path.Clean(requestPath)
+	if strings.HasSuffix(requestPath, "/") && cleanPath != "/" {
+		cleanPath += "/"
+	}
+	if cleanPath != requestPath {
+		return false
+	}
+	for _, skipPath := range m.SkipPaths {
+		if requestPath == skipPath || strings.HasSuffix(skipPath, "/") && strings.HasPrefix(requestPath, skipPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func trimTrailingSlash(path string) string {
+	if len(path) > 1 {
+		return strings.TrimSuffix(path, "/")
+	}
+	return path
+}
+
+// MetadataHandler returns a handler that serves the service provider
+// metadata on any path. It is for mounting the metadata endpoint on a route
+// of your own router instead of mounting m itself. The metadata still
+// advertises m.ServiceProvider.MetadataURL, which should be the URL of that
+// route.
+func (m *Middleware) MetadataHandler() http.Handler {
+	return http.HandlerFunc(m.serveMetadata)
+}
+
+// ACSHandler returns a handler that consumes the SAML responses posted by the
+// IDP on any path, like MetadataHandler does for the metadata. The IDP posts
+// to m.ServiceProvider.AcsURL, which should be the URL of the route the
+// handler is mounted on, as responses for any other destination are rejected.
+func (m *Middleware) ACSHandler() http.Handler {
+	return http.HandlerFunc(m.serveACS)
+}
+
+// WhoamiHandler returns a handler that serves the claims of the session of
+// the request as a JSON object, e.g. for a single page application to show
+// who is logged in, or 401 Unauthorized if the request has no valid
+// session. It is meant to be mounted on a path such as /saml/whoami, outside
+// of RequireAccount. The claims are the SAML attributes, as lists of
+// strings, along with those such as `sub` and `exp` described for
+// ClaimsModifier. If claimNames are given, only those claims are served.
+func (m *Middleware) WhoamiHandler(claimNames ...string) http.Handler {
+	wanted := map[string]bool{}
+	for _, name := range claimNames {
+		wanted[name] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := m.sessionClaims(r)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		rv := jwt.MapClaims{}
+		for name, value := range claims {
+			if name != "attr_types" && (len(claimNames) == 0 || wanted[name]) {
+				rv[name] = value
+			}
+		}
+		buf, err := json.Marshal(rv)
 		if err != nil {
-			if parseErr, ok := err.(*saml.InvalidResponseError); ok {
-				log.Printf("RESPONSE: ===\n%s\n===\nNOW: %s\nERROR: %s",
-					parseErr.Response, parseErr.Now, parseErr.PrivateErr)
+			m.logger().Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(buf)
+	})
+}
+
+func (m *Middleware) serveMetadata(w http.ResponseWriter, r *http.Request) {
+	buf, err := m.ServiceProvider.MarshalMetadata()
+	if err != nil {
+		m.logger().Printf("%s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(buf)
+}
+
+// serveLogin starts a login that returns the user to the target in the
+// next parameter of r. See LoginEndpointURL.
+func (m *Middleware) serveLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	next := r.URL.Query().Get("next")
+	if next == "" {
+		next = "/"
+	} else if !m.allowedRedirect(next) {
+		m.logger().Printf("not redirecting to next %q: it is not an allowed redirect target", next)
+		next = "/"
+	}
+	if _, ok := m.sessionClaims(r); ok {
+		http.Redirect(w, r, next, redirectStatus(m.PostLoginRedirectStatus))
+		return
+	}
+	m.startLogin(w, r, next)
+}
+
+// serveSLO ends the sessions that a back-channel LogoutRequest of the IDP
+// names, see SessionStore, and answers it with a LogoutResponse.
+func (m *Middleware) serveSLO(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	sp := m.serviceProvider()
+	req, err := sp.ParseBackChannelLogoutRequest(r)
+	if err != nil {
+		m.logger().Printf("rejecting LogoutRequest: %s", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	status := saml.StatusSuccess
+	n, err := m.SessionStore.DeleteNameID(*req.NameID, req.SessionIndex)
+	if err != nil {
+		m.logger().Printf("cannot end the sessions of NameID %q: %s", req.NameID.Value, err)
+		status = saml.StatusResponder
+	} else {
+		m.logger().Debugf("ended %d sessions of NameID %q", n, req.NameID.Value)
+	}
+	resp, err := sp.MakeLogoutResponse(req, status)
+	if err != nil {
+		m.logger().Printf("cannot make LogoutResponse: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := resp.WriteSOAP(w); err != nil {
+		m.logger().Printf("cannot write LogoutResponse: %s", err)
+	}
+}
+
+func (m *Middleware) serveMetadataJSON(w http.ResponseWriter, r *http.Request) {
+	buf, err := m.ServiceProvider.MarshalMetadataJSON()
+	if err != nil {
+		m.logger().Printf("%s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+func (m *Middleware) serveACS(w http.ResponseWriter, r *http.Request) {
+	if m.RequireSecureTransport && !m.isSecure(r) {
+		m.logger().Printf("rejecting response to %s: it was not received over HTTPS", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if m.RateLimiter != nil && !m.RateLimiter.Allow(r) {
+		m.logger().Printf("rejecting response to %s: rate limit exceeded", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	receivedAt := saml.TimeNow()
+	sp := m.serviceProvider()
+	unsolicited := m.AllowIDPInitiated && m.isUnsolicited(r)
+	var assertion *saml.Assertion
+	var err error
+	if unsolicited {
+		assertion, err = sp.ParseUnsolicitedResponseContext(r.Context(), r)
+	} else {
+		assertion, err = sp.ParseResponseContext(r.Context(), r, m.getPossibleRequestIDs(r))
+	}
+	if m.OnResponse != nil {
+		form, _, _ := sp.ResponseValues(r)
+		hookErr := m.OnResponse(r, &ReceivedResponse{
+			SAMLResponse: form.Get("SAMLResponse"),
+			RelayState:   form.Get("RelayState"),
+			ReceivedAt:   receivedAt,
+			Assertion:    assertion,
+			Err:          err,
+		})
+		if hookErr != nil {
+			m.logger().Printf("OnResponse: %s", hookErr)
+			if err == nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
 			}
-			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		}
+	}
+	if err != nil {
+		if isMessageTooLarge(err) {
+			m.logger().Printf("rejecting response to %s: %s", r.URL.Path, err)
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
 			return
 		}
+		if parseErr, ok := err.(*saml.InvalidResponseError); ok {
+			m.logger().Printf("RESPONSE: ===\n%s\n===\nNOW: %s\nERROR: %s",
+				parseErr.Response, parseErr.Now, parseErr.PrivateErr)
+		}
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
 
-		m.Authorize(w, r, assertion)
+	if unsolicited {
+		// The RelayState of an IDP-initiated login was not issued by
+		// us, so there is no state cookie to redirect back with.
+		m.logger().Printf("accepted IDP-initiated login from %s", assertion.Issuer.Value)
+		m.authorize(w, r, assertion, m.unsolicitedRedirect(r))
 		return
 	}
+	m.Authorize(w, r, assertion)
+}
+
+// isMessageTooLarge reports whether err, as returned by ParseResponse, is
+// because the response or the request body carrying it was too large.
+func isMessageTooLarge(err error) bool {
+	if parseErr, ok := err.(*saml.InvalidResponseError); ok {
+		err = parseErr.PrivateErr
+	}
+	_, ok := err.(*saml.MessageTooLargeError)
+	return ok
+}
+
+// ReceivedResponse is a SAML response received by the ACS, as passed to
+// Middleware.OnResponse.
+type ReceivedResponse struct {
+	// SAMLResponse is the SAMLResponse form value exactly as it was
+	// posted, i.e. base64 encoded.
+	SAMLResponse string
+
+	// RelayState is the RelayState form value, if any.
+	RelayState string
+
+	// ReceivedAt is when the ACS received the response.
+	ReceivedAt time.Time
+
+	// Assertion is the assertion of the response if it was accepted, or
+	// nil if it was rejected, in which case Err says why. Err is then a
+	// *saml.InvalidResponseError, whose PrivateErr tells e.g. an assertion
+	// that is not yet valid, saml.ErrAssertionNotYetValid, which suggests
+	// that a clock is off, from one that has expired.
+	Assertion *saml.Assertion
+	Err       error
+}
+
+// RequireAccount is HTTP middleware that requires that each request be
+// associated with a valid session. If the request is not associated with a valid
+// session, then rather than serve the request, the middlware redirects the user
+// to start the SAML auth flow. Requests for SkipPaths are served without a
+// session, and those of API clients are answered with 401 Unauthorized if
+// IsAPIRequest is set.
+func (m *Middleware) RequireAccount(handler http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if m.isSkipPath(r.URL.Path) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if claims, ok := m.sessionClaims(r); ok {
+			m.renewSession(w, claims)
+			handler.ServeHTTP(w, m.sessionRequest(r, claims))
+			return
+		}
+
+		// If we try to redirect when the original request is the ACS URL we'll
+		// end up in a loop. This is a programming error, so we panic here. In
+		// general this means a 500 to the user, which is preferable to a
+		// redirect loop.
+		acsURL, _ := url.Parse(m.ServiceProvider.AcsURL)
+		if r.URL.Path == acsURL.Path {
+			panic("don't wrap Middleware with RequireAccount")
+		}
+
+		m.startLogin(w, r, m.originalURL(r))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// startLogin redirects the user to the IDP to log in, and to originalURL
+// once the login completes, unless OnLogin says otherwise.
+func (m *Middleware) startLogin(w http.ResponseWriter, r *http.Request, originalURL string) {
+	loginURL, stateCookie, err := m.loginURL(r, originalURL)
+	if loginErr, ok := err.(*loginError); ok {
+		if loginErr.status == http.StatusForbidden {
+			m.logger().Printf("not starting SAML flow: %s", loginErr.err)
+		} else {
+			m.logger().Printf("cannot start SAML flow: %s", loginErr.err)
+		}
+		http.Error(w, http.StatusText(loginErr.status), loginErr.status)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if stateCookie != nil {
+		m.expireStateCookies(w, m.excessStateCookies(stateCookies(r), 1))
+		m.setCookie(w, stateCookie)
+		if m.StateHeader != "" && m.StateStore == nil {
+			w.Header().Set(m.StateHeader, stateCookie.Value)
+		}
+	}
+
+	if m.IsAPIRequest != nil && m.IsAPIRequest(r) {
+		buf, _ := json.Marshal(loginRequired{Error: "login required", Location: loginURL})
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("SAML location=%q", loginURL))
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(buf)
+		return
+	}
+
+	w.Header().Add("Location", loginURL)
+	w.WriteHeader(redirectStatus(m.LoginRedirectStatus))
+}
+
+// LoginURL starts the SAML flow for r as RequireAccount does, but rather
+// than redirecting, it returns the URL of the IDP to which the user is to
+// be sent, with the AuthnRequest and RelayState, and the cookie that
+// carries the state of the login, so that the caller can present the URL
+// as it likes, e.g. as a link in a server-side rendered page. The cookie,
+// which is Secure if RequireSecureTransport or CookiePartitioned is set,
+// must be set, e.g. with http.SetCookie, in the same response; if
+// CookiePartitioned is set, it must also be marked Partitioned, which
+// net/http does not know. If StateStore is set, the state is stored there
+// and the cookie only binds the login to the browser.
+//
+// Unlike RequireAccount, LoginURL does not expire state cookies in excess
+// of MaxStateCookies, as it does not write a response.
+func (m *Middleware) LoginURL(r *http.Request) (loginURL string, stateCookie *http.Cookie, err error) {
+	return m.loginURL(r, m.originalURL(r))
+}
+
+// loginURL is LoginURL, but returns the user to originalURL after login.
+func (m *Middleware) loginURL(r *http.Request, originalURL string) (loginURL string, stateCookie *http.Cookie, err error) {
+	sp := m.serviceProvider()
+	ssoURL := sp.GetSSOBindingLocation(saml.HTTPRedirectBinding)
+	if ssoURL == "" {
+		return "", nil, fmt.Errorf("IDP metadata does not contain a SingleSignOnService with the %s binding", saml.HTTPRedirectBinding)
+	}
+	var opts []saml.AuthnRequestOption
+	if m.RequestID != nil {
+		if id := m.RequestID(r); id != "" {
+			opts = append(opts, saml.WithID(id))
+		}
+	}
+	req, err := sp.MakeAuthenticationRequest(ssoURL, opts...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// relayState is limited to 80 bytes but also must be integrety protected.
+	// this means that we cannot use a JWT because it is way to long. Instead
+	// we set a cookie that corresponds to the state
+	if err := checkRelayStateLength(m.relayStateLength()); err != nil {
+		return "", nil, err
+	}
+	relayState := base64.RawURLEncoding.EncodeToString(m.randomBytes(m.relayStateLength()))
+
+	state := jwt.New(m.tokenSigningMethod())
+	claims := state.Claims.(jwt.MapClaims)
+	if m.OnLogin != nil {
+		originalURL, err = m.OnLogin(r)
+		if err != nil {
+			return "", nil, &loginError{status: http.StatusForbidden, err: err}
+		}
+	}
+	claims["id"] = req.ID
+	claims["uri"] = originalURL
+	if m.StateHeader != "" && m.StateStore == nil {
+		claims["relay_state"] = relayState
+	}
+	if appState := AppRelayState(r); appState != "" {
+		claims["app_state"] = appState
+	}
+	body, replay := m.replayableBody(r)
+	if replay {
+		claims["method"] = r.Method
+		claims["body"] = body
+	}
+	var binding string
+	if m.StateStore != nil {
+		binding = base64.RawURLEncoding.EncodeToString(m.randomBytes(stateBindingLength))
+		claims["binding"] = binding
+	}
+	key := m.tokenKey()
+	if key == nil {
+		return "", nil, &loginError{status: http.StatusInternalServerError, err: ErrNoKey}
+	}
+	signedState, err := state.SignedString(key)
+	if err != nil {
+		return "", nil, err
+	}
+	if m.CompressState {
+		if signedState, err = compressToken(signedState); err != nil {
+			return "", nil, err
+		}
+	}
+
+	acsURL, _ := url.Parse(sp.AcsURL)
+	stateCookie = &http.Cookie{
+		Name:     fmt.Sprintf("saml_%s", relayState),
+		Value:    signedState,
+		MaxAge:   int(saml.MaxIssueDelay.Seconds()),
+		HttpOnly: replay,
+		Path:     acsURL.Path,
+		Secure:   m.RequireSecureTransport || m.CookiePartitioned,
+	}
+	if m.StateStore != nil {
+		// the cookie only carries the binding, see storedState
+		stateCookie.Value = binding
+		stateCookie.HttpOnly = true
+		if err := m.StateStore.Put(relayState, signedState, saml.TimeNow().Add(saml.MaxIssueDelay)); err != nil {
+			return "", nil, &loginError{status: http.StatusInternalServerError, err: fmt.Errorf("cannot store state: %s", err)}
+		}
+	}
+	redirectURL, err := sp.AuthnRequestRedirect(req, relayState)
+	if err != nil {
+		return "", nil, err
+	}
+	return redirectURL.String(), stateCookie, nil
+}
+
+// replayableBody returns the body of r if it is a form POST that is to be
+// replayed after login, see ReplayPostBodySize. r.Body can still be read
+// afterwards.
+func (m *Middleware) replayableBody(r *http.Request) (string, bool) {
+	if m.ReplayPostBodySize <= 0 || r.Method != "POST" || r.Body == nil {
+		return "", false
+	}
+	if !m.isSameOrigin(r) {
+		m.logger().Debugf("not keeping the body of POST %s: it may come from another site", r.URL.Path)
+		return "", false
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/x-www-form-urlencoded" {
+		return "", false
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, m.ReplayPostBodySize+1))
+	r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(buf), r.Body))
+	if err != nil {
+		return "", false
+	}
+	if int64(len(buf)) > m.ReplayPostBodySize {
+		m.logger().Debugf("not keeping the body of POST %s: it is larger than %d bytes", r.URL.Path, m.ReplayPostBodySize)
+		return "", false
+	}
+	return string(buf), true
+}
+
+// isSameOrigin returns true if the browser says that r was made by a page
+// of the origin it is sent to: with Sec-Fetch-Site, or failing that with
+// Origin. Requests that carry neither are assumed to come from elsewhere.
+func (m *Middleware) isSameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		return false
+	}
+	u, err := url.Parse(m.originalURL(r))
+	if err != nil {
+		return false
+	}
+	scheme, host := u.Scheme, u.Host
+	if scheme == "" {
+		scheme = "http"
+		if m.isSecure(r) {
+			scheme = "https"
+		}
+	}
+	if host == "" {
+		host = r.Host
+	}
+	return strings.EqualFold(origin, scheme+"://"+host)
+}
+
+// loginError is an error of LoginURL that RequireAccount logs, rather than
+// writing it to the response, and answers with status.
+type loginError struct {
+	status int
+	err    error
+}
+
+func (e *loginError) Error() string {
+	return e.err.Error()
+}
+
+// loginRequired is the body of the 401 Unauthorized response with which
+// RequireAccount answers API requests.
+type loginRequired struct {
+	Error    string `json:"error"`
+	Location string `json:"location"`
+}
+
+// DetectAPIRequest returns true if r accepts a JSON response but not HTML,
+// or has an X-Requested-With header, as XHRs made by many JavaScript
+// libraries do. See Middleware.IsAPIRequest.
+func DetectAPIRequest(r *http.Request) bool {
+	if r.Header.Get("X-Requested-With") != "" {
+		return true
+	}
+	accept := strings.Join(r.Header["Accept"], ",")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+func (m *Middleware) getPossibleRequestIDs(r *http.Request) []string {
+	rv := []string{}
+	if m.StateStore != nil {
+		form, _, err := m.serviceProvider().ResponseValues(r)
+		if err != nil || form.Get("RelayState") == "" {
+			return rv
+		}
+		state, err := m.storedState(r, form.Get("RelayState"))
+		if err != nil {
+			m.logger().Debugf("... %s", err)
+			return rv
+		}
+		if id, ok := state.Claims.(jwt.MapClaims)["id"].(string); ok {
+			rv = append(rv, id)
+		}
+		return rv
+	}
+	excess := len(m.excessStateCookies(stateCookies(r), 0))
+	for i, cookie := range stateCookies(r) {
+		if i < excess || cookie.Value == "" {
+			continue
+		}
+		token, err := m.parseStateToken(cookie.Value)
+		if err != nil || !token.Valid {
+			m.logger().Debugf("... invalid token %s", err)
+			continue
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		rv = append(rv, claims["id"].(string))
+	}
+	if m.StateHeader != "" && r.Header.Get(m.StateHeader) != "" {
+		token, err := m.parseStateToken(r.Header.Get(m.StateHeader))
+		if err != nil || !token.Valid {
+			m.logger().Debugf("... invalid token in %s header %s", m.StateHeader, err)
+		} else if id, ok := token.Claims.(jwt.MapClaims)["id"].(string); ok {
+			rv = append(rv, id)
+		}
+	}
+
+	return rv
+}
+
+// isUnsolicited returns true if the SAMLResponse received in r does not
+// claim to answer an AuthnRequest, i.e. it is an IDP-initiated login. The
+// response is not validated, and only its start tag is parsed. A response
+// whose RelayState belongs to a login that we started is never unsolicited,
+// so that it must answer the AuthnRequest of that login.
+func (m *Middleware) isUnsolicited(r *http.Request) bool {
+	form, binding, err := m.serviceProvider().ResponseValues(r)
+	if err != nil || m.hasLoginState(r, form.Get("RelayState")) {
+		return false
+	}
+	buf, err := saml.DecodeMessage(binding, form.Get("SAMLResponse"))
+	if err != nil {
+		return false
+	}
+	d := xml.NewDecoder(bytes.NewReader(buf))
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return false
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			for _, attr := range start.Attr {
+				if attr.Name.Space == "" && attr.Name.Local == "InResponseTo" {
+					return attr.Value == ""
+				}
+			}
+			return true
+		}
+	}
+}
+
+// hasLoginState returns true if there is state for a login started with
+// relayState, in the StateStore, in a state cookie of r or in the
+// StateHeader of r.
+func (m *Middleware) hasLoginState(r *http.Request, relayState string) bool {
+	if relayState == "" {
+		return false
+	}
+	if m.StateStore != nil {
+		_, err := m.StateStore.Get(relayState)
+		return err == nil
+	}
+	if _, err := r.Cookie(fmt.Sprintf("saml_%s", relayState)); err == nil {
+		return true
+	}
+	return m.StateHeader != "" && r.Header.Get(m.StateHeader) != ""
+}
+
+// sessionMaxAge returns how long the session established by assertion may
+// last from now: cookieMaxAge, unless the IDP ends its session sooner with
+// the SessionNotOnOrAfter of the AuthnStatement.
+func sessionMaxAge(assertion *saml.Assertion, now time.Time) time.Duration {
+	maxAge := cookieMaxAge
+	if s := assertion.AuthnStatement; s != nil && s.SessionNotOnOrAfter != nil {
+		if d := s.SessionNotOnOrAfter.Sub(now); d < maxAge {
+			maxAge = d
+		}
+	}
+	return maxAge
+}
+
+// tokenKey returns the key that signs new tokens: TokenKey if set, and
+// ServiceProvider.Key otherwise.
+func (m *Middleware) tokenKey() *rsa.PrivateKey {
+	if m.TokenKey != nil {
+		return m.TokenKey
+	}
+	return m.ServiceProvider.Key
+}
+
+// tokenKeys returns the keys whose tokens are accepted: TokenKey and
+// RetiredTokenKeys, followed by the keys of the service provider.
+func (m *Middleware) tokenKeys() []*rsa.PrivateKey {
+	var keys []*rsa.PrivateKey
+	if m.TokenKey != nil {
+		keys = append(keys, m.TokenKey)
+	}
+	keys = append(keys, m.RetiredTokenKeys...)
+	return append(keys, m.ServiceProvider.Keys()...)
+}
+
+// Init checks TokenSigningMethod and the keys that the middleware signs
+// with, so that a bad setting fails at startup rather than at the first
+// login: TokenKey, if set, and ServiceProvider.Key must be valid RSA keys
+// with which a test token can be signed and verified, and, if
+// EncryptSessionToken is set, encrypted and decrypted. The keys'
+// precomputed values, which speed up signing, are filled in if they are
+// missing. New calls Init; call it yourself if you build a Middleware
+// directly or replace its keys.
+func (m *Middleware) Init() error {
+	if _, ok := tokenSigningMethods[m.TokenSigningMethod]; !ok && m.TokenSigningMethod != "" {
+		return fmt.Errorf("unsupported token signing method %q", m.TokenSigningMethod)
+	}
+	if m.tokenKey() == nil {
+		return ErrNoKey
+	}
+	keys := []*rsa.PrivateKey{m.tokenKey()}
+	if m.ServiceProvider.Key != nil && m.ServiceProvider.Key != m.tokenKey() {
+		keys = append(keys, m.ServiceProvider.Key)
+	}
+	for _, key := range keys {
+		name := "key"
+		if key == m.TokenKey {
+			name = "token key"
+		}
+		if err := key.Validate(); err != nil {
+			return fmt.Errorf("invalid %s: %s", name, err)
+		}
+		key.Precompute()
+
+		const signingString = "samlsp.init"
+		signature, err := m.tokenSigningMethod().Sign(signingString, key)
+		if err != nil {
+			return fmt.Errorf("cannot sign with %s: %s", name, err)
+		}
+		if err := m.tokenSigningMethod().Verify(signingString, signature, &key.PublicKey); err != nil {
+			return fmt.Errorf("cannot verify signature of %s: %s", name, err)
+		}
+		if m.EncryptSessionToken && key == m.tokenKey() {
+			encrypted, err := encryptToken(signingString, &key.PublicKey)
+			if err == nil {
+				var decrypted string
+				decrypted, err = decryptToken(encrypted, key)
+				if err == nil && decrypted != signingString {
+					err = fmt.Errorf("decrypted token does not match")
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("cannot encrypt session tokens with %s: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// tokenSigningMethods are the signing methods of the state and session
+// tokens, by alg. parseToken accepts no other, so that no token can be
+// forged with "none" or by using the public key as an HMAC secret.
+var tokenSigningMethods = map[string]jwt.SigningMethod{
+	jwt.SigningMethodRS256.Alg(): jwt.SigningMethodRS256,
+	jwt.SigningMethodPS256.Alg(): jwt.SigningMethodPS256,
+}
+
+// tokenSigningMethod returns the signing method of new tokens, as set by
+// TokenSigningMethod.
+func (m *Middleware) tokenSigningMethod() jwt.SigningMethod {
+	if method, ok := tokenSigningMethods[m.TokenSigningMethod]; ok {
+		return method
+	}
+	return jwt.SigningMethodRS256
+}
+
+// parseToken parses a JWT and verifies that it was signed with one of
+// tokenKeys using one of tokenSigningMethods. Its exp, iat and nbf claims
+// are checked against saml.TimeNow, the clock that Authorize sets them by,
+// rather than the clock of jwt-go.
+func (m *Middleware) parseToken(value string) (*jwt.Token, error) {
+	var token *jwt.Token
+	var err error
+	err = ErrNoKey
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	for _, key := range m.tokenKeys() {
+		if key == nil {
+			continue
+		}
+		key := key
+		token, err = parser.Parse(value, func(t *jwt.Token) (interface{}, error) {
+			if method, ok := tokenSigningMethods[t.Method.Alg()]; !ok || t.Method != method {
+				return nil, fmt.Errorf("Unexpected signing method: %v", t.Header["alg"])
+			}
+
+			return key.Public(), nil
+		})
+		if err == nil && token.Valid {
+			if err := checkTimeClaims(token.Claims.(jwt.MapClaims), saml.TimeNow()); err != nil {
+				token.Valid = false
+				return token, err
+			}
+			return token, nil
+		}
+	}
+	return token, err
+}
+
+// checkTimeClaims returns an error if the token with claims has expired,
+// was issued after now or is not valid yet.
+func checkTimeClaims(claims jwt.MapClaims, now time.Time) error {
+	if !claims.VerifyExpiresAt(now.Unix(), false) {
+		return fmt.Errorf("token is expired")
+	}
+	if !claims.VerifyIssuedAt(now.Unix(), false) {
+		return fmt.Errorf("token used before issued")
+	}
+	if !claims.VerifyNotBefore(now.Unix(), false) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	return nil
+}
+
+// parseStateToken is like parseToken, but first decompresses value if it
+// is a state token in the compressed form, see CompressState.
+func (m *Middleware) parseStateToken(value string) (*jwt.Token, error) {
+	if !isCompressedToken(value) {
+		return m.parseToken(value)
+	}
+	token, err := decompressToken(value)
+	if err != nil {
+		return nil, err
+	}
+	return m.parseToken(token)
+}
+
+// parseSessionToken is like parseToken, but first decrypts value with one
+// of tokenKeys if it is an encrypted session token.
+func (m *Middleware) parseSessionToken(value string) (*jwt.Token, error) {
+	if !isEncryptedToken(value) {
+		return m.parseToken(value)
+	}
+	err := ErrNoKey
+	for _, key := range m.tokenKeys() {
+		if key == nil {
+			continue
+		}
+		var token string
+		token, err = decryptToken(value, key)
+		if err == nil {
+			return m.parseToken(token)
+		}
+	}
+	return nil, err
+}
+
+// Authorize is invoked by ServeHTTP when we have a new, valid SAML assertion.
+// It sets a cookie that contains a signed JWT containing the assertion attributes.
+// It then redirects the user's browser to the original URL contained in RelayState.
+func (m *Middleware) Authorize(w http.ResponseWriter, r *http.Request, assertion *saml.Assertion) {
+	form, _, err := m.serviceProvider().ResponseValues(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	redirectURI := "/"
+	if relayState := form.Get("RelayState"); relayState != "" && m.StateStore != nil {
+		state, err := m.storedState(r, relayState)
+		if err != nil {
+			m.logger().Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if err := m.StateStore.Delete(relayState); err != nil {
+			m.logger().Printf("cannot delete state for RelayState %q: %s", relayState, err)
+		}
+		redirectURI, r = m.restoreState(state.Claims.(jwt.MapClaims), r)
+		used, others := []*http.Cookie{}, []*http.Cookie{}
+		for _, cookie := range stateCookies(r) {
+			if cookie.Name == fmt.Sprintf("saml_%s", relayState) {
+				used = append(used, cookie)
+			} else {
+				others = append(others, cookie)
+			}
+		}
+		m.expireStateCookies(w, append(used, m.excessStateCookies(others, 0)...))
+	} else if relayState != "" && m.useStateHeader(r, relayState) {
+		state, err := m.headerState(r, relayState)
+		if err != nil {
+			m.logger().Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		redirectURI, r = m.restoreState(state.Claims.(jwt.MapClaims), r)
+	} else if relayState != "" {
+		stateCookie, err := r.Cookie(fmt.Sprintf("saml_%s", relayState))
+		if err != nil {
+			m.logger().Printf("%s", &StateCookieError{RelayState: relayState, CookieNames: stateCookieNames(r)})
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		state, err := m.parseStateToken(stateCookie.Value)
+		if err != nil || !state.Valid {
+			if err == nil {
+				err = errors.New("token is not valid")
+			}
+			m.logger().Printf("%s", &StateCookieError{RelayState: relayState, CookieNames: stateCookieNames(r), Err: err})
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		redirectURI, r = m.restoreState(state.Claims.(jwt.MapClaims), r)
+
+		// delete the cookie
+		stateCookie.Value = ""
+		stateCookie.Expires = time.Time{}
+		m.setCookie(w, stateCookie)
+		others := []*http.Cookie{}
+		for _, cookie := range stateCookies(r) {
+			if cookie.Name != stateCookie.Name {
+				others = append(others, cookie)
+			}
+		}
+		m.expireStateCookies(w, m.excessStateCookies(others, 0))
+	}
+	m.authorize(w, r, assertion, redirectURI)
+}
+
+// setCookie adds cookie to the headers of w like http.SetCookie, but with
+// the Partitioned attribute if CookiePartitioned is set, which net/http
+// does not know.
+func (m *Middleware) setCookie(w http.ResponseWriter, cookie *http.Cookie) {
+	if !m.CookiePartitioned {
+		http.SetCookie(w, cookie)
+		return
+	}
+	partitioned := *cookie
+	partitioned.Secure = true
+	if v := partitioned.String(); v != "" {
+		w.Header().Add("Set-Cookie", v+"; Partitioned")
+	}
+}
+
+// useStateHeader returns true if Authorize should take the state of the
+// login with relayState from the StateHeader of r, because it is set and
+// there is no state cookie.
+func (m *Middleware) useStateHeader(r *http.Request, relayState string) bool {
+	if m.StateHeader == "" || r.Header.Get(m.StateHeader) == "" {
+		return false
+	}
+	_, err := r.Cookie(fmt.Sprintf("saml_%s", relayState))
+	return err != nil
+}
+
+// headerState returns the state in the StateHeader of r, if it is valid and
+// was issued for relayState.
+func (m *Middleware) headerState(r *http.Request, relayState string) (*jwt.Token, error) {
+	state, err := m.parseStateToken(r.Header.Get(m.StateHeader))
+	if err == nil && !state.Valid {
+		err = errors.New("token is not valid")
+	}
+	if err == nil {
+		if issuedFor, _ := state.Claims.(jwt.MapClaims)["relay_state"].(string); issuedFor != relayState {
+			err = errors.New("token was issued for another RelayState")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid state in %s header for RelayState %q: %s", m.StateHeader, relayState, err)
+	}
+	return state, nil
+}
+
+// storedState returns the state that RequireAccount put in the StateStore
+// for relayState, if r comes from the browser that started the login, i.e.
+// has the saml_ cookie whose value is the binding claim of the state.
+func (m *Middleware) storedState(r *http.Request, relayState string) (*jwt.Token, error) {
+	value, err := m.StateStore.Get(relayState)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find state for RelayState %q: %s", relayState, err)
+	}
+	state, err := m.parseStateToken(value)
+	if err == nil && !state.Valid {
+		err = errors.New("token is not valid")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid state for RelayState %q: %s", relayState, err)
+	}
+	binding, _ := state.Claims.(jwt.MapClaims)["binding"].(string)
+	cookie, err := r.Cookie(fmt.Sprintf("saml_%s", relayState))
+	if err != nil || binding == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(binding)) != 1 {
+		return nil, fmt.Errorf("state for RelayState %q was stored for another browser", relayState)
+	}
+	return state, nil
+}
+
+// restoreState returns where to redirect the user to after the login whose
+// state has the given claims, and r carrying its application state.
+func (m *Middleware) restoreState(claims jwt.MapClaims, r *http.Request) (string, *http.Request) {
+	redirectURI, _ := claims["uri"].(string)
+	allowed := m.allowedRedirect(redirectURI)
+	if !allowed {
+		m.logger().Printf("not redirecting to %q: it is not an allowed redirect target", redirectURI)
+		redirectURI = "/"
+	}
+	if appState, ok := claims["app_state"].(string); ok {
+		r = WithAppRelayState(r, appState)
+	}
+	if body, ok := claims["body"].(string); ok && claims["method"] == "POST" && allowed {
+		r = r.WithContext(context.WithValue(r.Context(), replayBodyContextKey, body))
+	}
+	return redirectURI, r
+}
+
+// replayPost answers the request to the ACS with a form that posts body,
+// the form encoded body of the request that started the login, to
+// redirectURI once the user submits it. It is not submitted automatically,
+// so that the user sees what is being posted again. If it returns an
+// error, nothing has been written.
+func (m *Middleware) replayPost(w http.ResponseWriter, redirectURI string, body string) error {
+	values, err := url.ParseQuery(body)
+	if err != nil {
+		return err
+	}
+	type field struct {
+		Name  string
+		Value string
+	}
+	data := struct {
+		URL    string
+		Fields []field
+	}{
+		URL: redirectURI,
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range values[name] {
+			data.Fields = append(data.Fields, field{Name: name, Value: value})
+		}
+	}
+
+	buf := bytes.Buffer{}
+	if err := replayPostTemplate.Execute(&buf, data); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	w.Header().Set("Content-Type", "text/html")
+	w.Write(buf.Bytes())
+	return nil
+}
+
+var replayPostTemplate = template.Must(template.New("replay-post-form").Parse(`` +
+	`<form method="post" action="{{.URL}}" id="ReplayForm">` +
+	`{{range .Fields}}<input type="hidden" name="{{.Name}}" value="{{.Value}}" />{{end}}` +
+	`<p>You are logged in. Submit the form you filled in before?</p>` +
+	`<input type="submit" value="Continue" />` +
+	`</form>`))
+
+// StateCookieError describes why Authorize rejected a response that came
+// back with a RelayState: the state cookie that RequireAccount set for it
+// is missing, e.g. because it expired or the login was started in another
+// browser, or it is invalid. It is passed to Logger.Printf as the argument
+// of a "%s", so a Logger can recover it with a type assertion. To keep the
+// state tokens out of the logs it names the state cookies that the browser
+// sent, but does not include their values.
+type StateCookieError struct {
+	// RelayState is the RelayState of the response.
+	RelayState string
+
+	// CookieNames are the names of the saml_ cookies in the request.
+	CookieNames []string
+
+	// Err is why the state cookie for RelayState was rejected, or nil if
+	// there was none.
+	Err error
+}
+
+func (e *StateCookieError) Error() string {
+	present := "none"
+	if len(e.CookieNames) > 0 {
+		present = strings.Join(e.CookieNames, ", ")
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("invalid state cookie saml_%s: %s (state cookies present: %s)", e.RelayState, e.Err, present)
+	}
+	return fmt.Sprintf("cannot find state cookie saml_%s for RelayState %q (state cookies present: %s)", e.RelayState, e.RelayState, present)
+}
+
+// stateCookies returns the saml_ cookies of r. Browsers send the cookies of
+// a path in the order they were set, so the oldest come first.
+func stateCookies(r *http.Request) []*http.Cookie {
+	cookies := []*http.Cookie{}
+	for _, cookie := range r.Cookies() {
+		if strings.HasPrefix(cookie.Name, "saml_") {
+			cookies = append(cookies, cookie)
+		}
+	}
+	return cookies
+}
+
+// stateCookieNames returns the names of the stateCookies of r.
+func stateCookieNames(r *http.Request) []string {
+	names := []string{}
+	for _, cookie := range stateCookies(r) {
+		names = append(names, cookie.Name)
+	}
+	return names
+}
+
+// excessStateCookies returns the oldest of the state cookies that must go
+// so that at most MaxStateCookies remain once adding more are set.
+func (m *Middleware) excessStateCookies(cookies []*http.Cookie, adding int) []*http.Cookie {
+	max := m.maxStateCookies()
+	if max < 0 || len(cookies)+adding <= max {
+		return nil
+	}
+	excess := len(cookies) + adding - max
+	if excess > len(cookies) {
+		excess = len(cookies)
+	}
+	return cookies[:excess]
+}
+
+// expireStateCookies tells the browser to delete cookies, which are state
+// cookies of the ACS path.
+func (m *Middleware) expireStateCookies(w http.ResponseWriter, cookies []*http.Cookie) {
+	acsURL, _ := url.Parse(m.ServiceProvider.AcsURL)
+	for _, cookie := range cookies {
+		m.setCookie(w, &http.Cookie{
+			Name:   cookie.Name,
+			Value:  "",
+			MaxAge: -1,
+			Path:   acsURL.Path,
+		})
+	}
+}
+
+// unsolicitedRedirect returns where to send the user after the
+// IDP-initiated login r. Some IDPs send the URL of the resource to go to as
+// the RelayState, which is honored if it is an allowed redirect target.
+// Otherwise the user is sent to "/".
+func (m *Middleware) unsolicitedRedirect(r *http.Request) string {
+	form, _, err := m.serviceProvider().ResponseValues(r)
+	if err != nil {
+		return "/"
+	}
+	relayState := form.Get("RelayState")
+	if relayState == "" {
+		return "/"
+	}
+	if !m.allowedRedirect(relayState) {
+		m.logger().Printf("not redirecting to RelayState %q: it is not an allowed redirect target", relayState)
+		return "/"
+	}
+	return relayState
+}
+
+// allowedRedirect returns true if the user may be sent to target after
+// login: a path on this host, or an http or https URL on the host of
+// ServiceProvider.AcsURL or one of AllowedRedirectHosts. Anything else
+// would make the middleware an open redirect.
+func (m *Middleware) allowedRedirect(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "" && u.Host == "" && u.Opaque == "" {
+		// Browsers treat "//host" and "/\host" as URLs on another host.
+		return strings.HasPrefix(target, "/") &&
+			!strings.HasPrefix(target, "//") &&
+			!strings.HasPrefix(target, "/\\")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return false
+	}
+	if acsURL, err := url.Parse(m.ServiceProvider.AcsURL); err == nil && strings.EqualFold(u.Host, acsURL.Host) {
+		return true
+	}
+	for _, host := range m.AllowedRedirectHosts {
+		if strings.EqualFold(u.Host, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize does the work of Authorize: it issues the session cookie for
+// assertion and redirects to redirectURI.
+func (m *Middleware) authorize(w http.ResponseWriter, r *http.Request, assertion *saml.Assertion, redirectURI string) {
+	token := jwt.New(m.tokenSigningMethod())
+	claims := token.Claims.(jwt.MapClaims)
+	types := map[string]attributeTypes{}
+	var attributes []saml.Attribute
+	if assertion.AttributeStatement != nil {
+		attributes = assertion.AttributeStatement.Attributes
+	}
+	for _, attr := range attributes {
+		if m.excludedAttribute(attr) {
+			continue
+		}
+		claimName := attr.FriendlyName
+		if claimName == "" {
+			claimName = attr.Name
+		}
+		prefix := m.NameFormatPrefixes[attr.NameFormat]
+		claimName = prefix + claimName
+		delimiter := m.attributeDelimiter(attr)
+		valueStrings := []string{}
+		valueTypes := []string{}
+		for _, v := range attr.Values {
+			items := []string{v.Value}
+			if delimiter != "" {
+				items = splitAttributeValue(v.Value, delimiter)
+			}
+			for _, item := range items {
+				valueStrings = append(valueStrings, item)
+				valueTypes = append(valueTypes, v.Type)
+			}
+		}
+		attrTypes := attributeTypes{
+			Name:       attr.Name,
+			NameFormat: attr.NameFormat,
+			Prefix:     prefix,
+			Types:      valueTypes,
+		}
+		if first, ok := types[claimName]; ok {
+			// another attribute with the same name, e.g. in another
+			// NameFormat: its values follow in the same claim
+			claims[claimName] = append(claims[claimName].([]string), valueStrings...)
+			first.More = append(first.More, attrTypes)
+			types[claimName] = first
+			continue
+		}
+		claims[claimName] = valueStrings
+		types[claimName] = attrTypes
+	}
+	claims["attr_types"] = types
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		nameID := assertion.Subject.NameID
+		claims["sub"] = nameID.Value
+		qualifiers := nameIDQualifiers{
+			Format:          nameID.Format,
+			NameQualifier:   nameID.NameQualifier,
+			SPNameQualifier: nameID.SPNameQualifier,
+		}
+		if qualifiers != (nameIDQualifiers{}) {
+			claims["name_id"] = qualifiers
+		}
+	}
+	if s := assertion.AuthnStatement; s != nil {
+		if !s.AuthnInstant.IsZero() {
+			claims["auth_time"] = s.AuthnInstant.Unix()
+		}
+		if s.AuthnContext.AuthnContextClassRef != nil {
+			claims["acr"] = s.AuthnContext.AuthnContextClassRef.Value
+		}
+		if len(s.AuthnContext.AuthenticatingAuthority) > 0 {
+			claims["authn_authorities"] = s.AuthnContext.AuthenticatingAuthority
+		}
+	}
+	if m.ClaimsModifier != nil {
+		m.ClaimsModifier(assertion, claims)
+	}
+	now := saml.TimeNow()
+	maxAge := sessionMaxAge(assertion, now)
+	if maxAge <= 0 {
+		m.logger().Printf("not issuing session: the IDP session ended at %s", assertion.AuthnStatement.SessionNotOnOrAfter)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	claims["iat"] = now.Unix()
+	if m.IssuedAtAssertion && !assertion.IssueInstant.IsZero() && !assertion.IssueInstant.After(now) {
+		claims["iat"] = assertion.IssueInstant.Unix()
+	}
+	claims["nbf"] = now.Unix()
+	claims["exp"] = now.Add(maxAge).Unix()
+	if m.SessionRenewalWindow > 0 {
+		claims["renew_until"] = m.sessionRenewalLimit(assertion, now).Unix()
+	}
+	if m.JWTIssuer != "" {
+		claims["iss"] = m.JWTIssuer
+	}
+	if m.JWTAudience != "" {
+		claims["aud"] = m.JWTAudience
+	}
+	key := m.tokenKey()
+	if key == nil {
+		m.logger().Printf("cannot issue session: %s", ErrNoKey)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := checkCookieDomain(m.CookieDomain, m.ServiceProvider.AcsURL); err != nil {
+		m.logger().Printf("cannot issue session: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if m.DenyNameID != nil {
+		nameID := sessionNameID(claims)
+		if m.DenyNameID(nameID) {
+			m.logger().Printf("not issuing session: NameID %q is denied", nameID.Value)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if nameID.IsTransient() {
+			m.logger().Printf("warning: NameID %q is transient, so DenyNameID cannot deny it at the next login", nameID.Value)
+		}
+	}
+	if m.RequireSameNameID {
+		if existingClaims, ok := m.sessionClaims(r); ok {
+			nameID, existingNameID := sessionNameID(claims), sessionNameID(existingClaims)
+			if nameID != existingNameID {
+				m.logger().Printf("not issuing session: NameID %q does not match NameID %q of the existing session", nameID.Value, existingNameID.Value)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+	}
+	if m.OnSession != nil {
+		if err := m.OnSession(w, r, assertion); err != nil {
+			m.logger().Printf("not issuing session: %s", err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+	if m.SessionStore != nil {
+		id := base64.RawURLEncoding.EncodeToString(m.randomBytes(16))
+		sessionIndex := ""
+		if assertion.AuthnStatement != nil {
+			sessionIndex = assertion.AuthnStatement.SessionIndex
+		}
+		expires := now.Add(maxAge)
+		if m.SessionRenewalWindow > 0 {
+			expires = m.sessionRenewalLimit(assertion, now)
+		}
+		if err := m.SessionStore.Put(id, sessionNameID(claims), sessionIndex, expires); err != nil {
+			m.logger().Printf("cannot issue session: cannot store session: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		claims["sid"] = id
+	}
+	if err := m.setSessionCookie(w, token, key, maxAge); err != nil {
+		m.logger().Printf("cannot issue session: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if body, ok := r.Context().Value(replayBodyContextKey).(string); ok {
+		if err := m.replayPost(w, redirectURI, body); err != nil {
+			m.logger().Printf("cannot replay POST to %s: %s", redirectURI, err)
+			http.Redirect(w, r, redirectURI, redirectStatus(m.PostLoginRedirectStatus))
+		}
+		return
+	}
+	http.Redirect(w, r, redirectURI, redirectStatus(m.PostLoginRedirectStatus))
+}
+
+// setSessionCookie signs token with key, encrypts it if EncryptSessionToken
+// is set, and sets it as the session cookie for maxAge.
+func (m *Middleware) setSessionCookie(w http.ResponseWriter, token *jwt.Token, key *rsa.PrivateKey, maxAge time.Duration) error {
+	signedToken, err := token.SignedString(key)
+	if err != nil {
+		panic(err)
+	}
+	if m.EncryptSessionToken {
+		signedToken, err = encryptToken(signedToken, &key.PublicKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.setCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    signedToken,
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: false,
+		Secure:   m.RequireSecureTransport,
+		Path:     m.cookiePath(),
+		Domain:   m.CookieDomain,
+	})
+	return nil
+}
+
+// sessionRenewalLimit returns the time past which the session established
+// by assertion at now may not be renewed: SessionMaxLifetime after now,
+// or the SessionNotOnOrAfter of the IDP if that is sooner.
+func (m *Middleware) sessionRenewalLimit(assertion *saml.Assertion, now time.Time) time.Time {
+	maxLifetime := m.SessionMaxLifetime
+	if maxLifetime == 0 {
+		maxLifetime = DefaultSessionMaxLifetime
+	}
+	limit := now.Add(maxLifetime)
+	if s := assertion.AuthnStatement; s != nil && s.SessionNotOnOrAfter != nil && s.SessionNotOnOrAfter.Before(limit) {
+		limit = *s.SessionNotOnOrAfter
+	}
+	return limit
+}
+
+// renewSession issues a new session token with claims, those of the
+// session token of the current request, if SessionRenewalWindow is set
+// and the token expires within it. The new token expires cookieMaxAge from
+// now, but not past the renew_until claim.
+func (m *Middleware) renewSession(w http.ResponseWriter, claims jwt.MapClaims) {
+	if m.SessionRenewalWindow <= 0 {
+		return
+	}
+	renewUntil, ok := claimTime(claims["renew_until"])
+	if !ok {
+		return
+	}
+	expires, ok := claimTime(claims["exp"])
+	if !ok {
+		return
+	}
+	now := saml.TimeNow()
+	if expires.Sub(now) > m.SessionRenewalWindow {
+		return
+	}
+	renewed := now.Add(cookieMaxAge)
+	if renewed.After(renewUntil) {
+		renewed = renewUntil
+	}
+	if !renewed.After(expires) {
+		return
+	}
+	key := m.tokenKey()
+	if key == nil {
+		return
+	}
+
+	token := jwt.New(m.tokenSigningMethod())
+	newClaims := token.Claims.(jwt.MapClaims)
+	for name, value := range claims {
+		newClaims[name] = value
+	}
+	newClaims["exp"] = renewed.Unix()
+	if err := m.setSessionCookie(w, token, key, renewed.Sub(now)); err != nil {
+		m.logger().Printf("cannot renew session: %s", err)
+		return
+	}
+	m.logger().Debugf("renewed session until %s", renewed)
+}
+
+// claimTime returns the time of value, a NumericDate claim of a parsed
+// token.
+func claimTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case float64:
+		return time.Unix(int64(v), 0).UTC(), true
+	case json.Number:
+		n, err := v.Int64()
+		return time.Unix(n, 0).UTC(), err == nil
+	}
+	return time.Time{}, false
+}
+
+// Logout is an http.HandlerFunc that ends the user's session. The session
+// cookie is always cleared. If the IDP advertises a Single Logout Service,
+// the user is then sent to it, preferring the HTTP-Redirect binding over the
+// HTTP-POST binding, so that the session with the IDP ends as well. If the
+// IDP does not advertise one, the user is redirected to "/".
+func (m *Middleware) Logout(w http.ResponseWriter, r *http.Request) {
+	nameID := saml.NameID{}
+	if cookie, err := r.Cookie(cookieName); err == nil {
+		token, err := m.parseSessionToken(cookie.Value)
+		if err == nil && token.Valid {
+			claims := token.Claims.(jwt.MapClaims)
+			nameID = sessionNameID(claims)
+			if id, ok := claims["sid"].(string); ok && m.SessionStore != nil {
+				if err := m.SessionStore.Delete(id); err != nil {
+					m.logger().Printf("cannot delete session: %s", err)
+				}
+			}
+		}
+		if cache := m.sessionTokenCache(); cache != nil {
+			cache.remove(cookie.Value)
+		}
+	}
 
-	http.NotFoundHandler().ServeHTTP(w, r)
-}
+	m.setCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    "",
+		MaxAge:   -1,
+		HttpOnly: false,
+		Path:     m.cookiePath(),
+		Domain:   m.CookieDomain,
+	})
 
-// RequireAccount is HTTP middleware that requires that each request be
-// associated with a valid session. If the request is not associated with a valid
-// session, then rather than serve the request, the middlware redirects the user
-// to start the SAML auth flow.
-func (m *Middleware) RequireAccount(handler http.Handler) http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		if m.IsAuthorized(r) {
-			handler.ServeHTTP(w, r)
+	sp := m.serviceProvider()
+	if location := sp.GetSLOBindingLocation(saml.HTTPRedirectBinding); location != "" {
+		req, err := sp.MakeLogoutRequestForNameID(location, nameID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		// If we try to redirect when the original request is the ACS URL we'll
-		// end up in a loop. This is a programming error, so we panic here. In
-		// general this means a 500 to the user, which is preferable to a
-		// redirect loop.
-		acsURL, _ := url.Parse(m.ServiceProvider.AcsURL)
-		if r.URL.Path == acsURL.Path {
-			panic("don't wrap Middleware with RequireAccount")
-		}
-
-		req, err := m.ServiceProvider.MakeAuthenticationRequest(
-			m.ServiceProvider.GetSSOBindingLocation(saml.HTTPRedirectBinding))
+		redirectURL, err := sp.LogoutRequestRedirect(req, "")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		http.Redirect(w, r, redirectURL.String(), http.StatusFound)
+		return
+	}
 
-		// relayState is limited to 80 bytes but also must be integrety protected.
-		// this means that we cannot use a JWT because it is way to long. Instead
-		// we set a cookie that corresponds to the state
-		relayState := base64.URLEncoding.EncodeToString(randomBytes(42))
-
-		state := jwt.New(jwt.GetSigningMethod("RS256"))
-		claims := state.Claims.(jwt.MapClaims)
-		claims["id"] = req.ID
-		claims["uri"] = r.URL.String()
-		signedState, err := state.SignedString(m.ServiceProvider.Key)
+	if location := sp.GetSLOBindingLocation(saml.HTTPPostBinding); location != "" {
+		req, err := sp.MakeLogoutRequestForNameID(location, nameID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if err := req.WritePostWith(w, "", sp.PostTemplate); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     fmt.Sprintf("saml_%s", relayState),
-			Value:    signedState,
-			MaxAge:   int(saml.MaxIssueDelay.Seconds()),
-			HttpOnly: false,
-			Path:     acsURL.Path,
-		})
-		redirectURL, _ := req.Redirect(relayState)
+	// The IDP does not support single logout, so ending our own session is
+	// all we can do.
+	http.Redirect(w, r, "/", http.StatusFound)
+}
 
-		w.Header().Add("Location", redirectURL.String())
-		w.WriteHeader(http.StatusFound)
-		return
+// IsAuthorized is invoked by RequireAccount to determine if the request
+// is already authorized or if the user's browser should be redirected to the
+// SAML login flow. If the request is authorized, then the request headers
+// starting with X-Saml- for each SAML assertion attribute are set. For example,
+// if an attribute "uid" has the value "alice@example.com", then the following
+// header would be added to the request:
+//
+//     X-Saml-Uid: alice@example.com
+//
+// HeaderNameFunc may choose other header names, and HeaderValueSeparator
+// joins the values of multi-valued attributes into one header.
+//
+// It is an error for this function to be invoked with a request containing
+// any headers starting with X-Saml. This function will panic if you do.
+func (m *Middleware) IsAuthorized(r *http.Request) bool {
+	_, ok := m.authorizedRequest(r)
+	return ok
+}
+
+// authorizedRequest does the work of IsAuthorized. If the request is
+// authorized, it also returns a shallow copy of r that carries the
+// Attributes of the session.
+func (m *Middleware) authorizedRequest(r *http.Request) (*http.Request, bool) {
+	claims, ok := m.sessionClaims(r)
+	if !ok {
+		return r, false
 	}
-	return http.HandlerFunc(fn)
+	return m.sessionRequest(r, claims), true
 }
 
-func (m *Middleware) getPossibleRequestIDs(r *http.Request) []string {
-	rv := []string{}
-	for _, cookie := range r.Cookies() {
-		if !strings.HasPrefix(cookie.Name, "saml_") || cookie.Value == "" {
-			continue
+// sessionRequest returns a shallow copy of r that carries the Attributes of
+// the session with claims, which also become headers of r.
+func (m *Middleware) sessionRequest(r *http.Request, claims jwt.MapClaims) *http.Request {
+	// It is an error for the request to include any X-SAML* headers,
+	// because those might be confused with ours. If we encounter any
+	// such headers, we abort the request, so there is no confustion.
+	for headerName := range r.Header {
+		if strings.HasPrefix(headerName, "X-Saml") {
+			panic("X-Saml-* headers should not exist when this function is called")
 		}
-		token, err := jwt.Parse(cookie.Value, func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
-				return nil, fmt.Errorf("Unexpected signing method: %v", t.Header["alg"])
-			}
+	}
 
-			return m.ServiceProvider.Key.Public(), nil
-		})
-		if err != nil || !token.Valid {
-			log.Printf("... invalid token %s", err)
+	for claimName, claimValue := range claims {
+		if isRegisteredClaim(claimName) {
 			continue
 		}
-		claims := token.Claims.(jwt.MapClaims)
-		rv = append(rv, claims["id"].(string))
+		headerName, include := m.headerName(claimName)
+		if !include {
+			continue
+		}
+		r.Header.Del(headerName)
+		values, _ := claimStrings(claimValue)
+		if m.HeaderValueSeparator != "" && len(values) > 1 {
+			r.Header.Set(headerName, strings.Join(values, m.HeaderValueSeparator))
+			continue
+		}
+		for _, value := range values {
+			r.Header.Add(headerName, value)
+		}
 	}
 
-	// If IDP initiated requests are allowed, then we can expect an empty response ID.
-	if m.AllowIDPInitiated {
-		rv = append(rv, "")
+	ctx := context.WithValue(r.Context(), attributesContextKey, sessionAttributes(claims))
+	ctx = context.WithValue(ctx, authnContextContextKey, sessionAuthnContext(claims))
+	if _, ok := claims["sub"]; ok {
+		nameID := sessionNameID(claims)
+		ctx = context.WithValue(ctx, nameIDContextKey, &nameID)
 	}
-
-	return rv
+	return r.WithContext(ctx)
 }
 
-// Authorize is invoked by ServeHTTP when we have a new, valid SAML assertion.
-// It sets a cookie that contains a signed JWT containing the assertion attributes.
-// It then redirects the user's browser to the original URL contained in RelayState.
-func (m *Middleware) Authorize(w http.ResponseWriter, r *http.Request, assertion *saml.Assertion) {
-	redirectURI := "/"
-	if r.Form.Get("RelayState") != "" {
-		stateCookie, err := r.Cookie(fmt.Sprintf("saml_%s", r.Form.Get("RelayState")))
+// sessionClaims returns the claims of the valid session token of r, if it
+// has one.
+func (m *Middleware) sessionClaims(r *http.Request) (jwt.MapClaims, bool) {
+	cookie, err := r.Cookie(cookieName)
+	if err != nil {
+		return nil, false
+	}
+	token, err := m.verifiedSessionToken(cookie.Value)
+	if err != nil {
+		return nil, false
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if m.JWTIssuer != "" && !claims.VerifyIssuer(m.JWTIssuer, true) {
+		return nil, false
+	}
+	if m.JWTAudience != "" && !claims.VerifyAudience(m.JWTAudience, true) {
+		return nil, false
+	}
+	if m.DenyNameID != nil {
+		if nameID := sessionNameID(claims); m.DenyNameID(nameID) {
+			m.logger().Debugf("... NameID %q is denied", nameID.Value)
+			return nil, false
+		}
+	}
+	if m.SessionStore != nil {
+		id, _ := claims["sid"].(string)
+		exists, err := m.SessionStore.Exists(id)
 		if err != nil {
-			log.Printf("cannot find corresponding cookie: %s", fmt.Sprintf("saml_%s", r.Form.Get("RelayState")))
-			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-			return
+			m.logger().Printf("cannot look up session: %s", err)
+			return nil, false
 		}
-
-		state, err := jwt.Parse(stateCookie.Value, func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
-				return nil, fmt.Errorf("Unexpected signing method: %v", t.Header["alg"])
-			}
-
-			return m.ServiceProvider.Key.Public(), nil
-		})
-		if err != nil || !state.Valid {
-			log.Printf("Cannot decode state JWT: %s (%s)", err, stateCookie.Value)
-			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-			return
+		if !exists {
+			m.logger().Debugf("... session %q has ended", id)
+			return nil, false
 		}
-		claims := state.Claims.(jwt.MapClaims)
-		redirectURI = claims["uri"].(string)
-
-		// delete the cookie
-		stateCookie.Value = ""
-		stateCookie.Expires = time.Time{}
-		http.SetCookie(w, stateCookie)
 	}
+	return claims, true
+}
 
-	token := jwt.New(jwt.GetSigningMethod("RS256"))
-	claims := token.Claims.(jwt.MapClaims)
-	for _, attr := range assertion.AttributeStatement.Attributes {
-		valueStrings := []string{}
-		for _, v := range attr.Values {
-			valueStrings = append(valueStrings, v.Value)
-		}
-		claimName := attr.FriendlyName
-		if claimName == "" {
-			claimName = attr.Name
+// verifiedSessionToken is like parseSessionToken, but returns an error
+// unless the token is valid, and consults the token cache, if any, first.
+func (m *Middleware) verifiedSessionToken(value string) (*jwt.Token, error) {
+	cache := m.sessionTokenCache()
+	now := saml.TimeNow()
+	if cache != nil {
+		if token, ok := cache.get(value, now); ok {
+			return token, nil
 		}
-		claims[claimName] = valueStrings
 	}
-	claims["exp"] = saml.TimeNow().Add(cookieMaxAge).Unix()
-	signedToken, err := token.SignedString(m.ServiceProvider.Key)
+	token, err := m.parseSessionToken(value)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if cache != nil {
+		cache.add(value, token, now)
 	}
+	return token, nil
+}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     cookieName,
-		Value:    signedToken,
-		MaxAge:   int(cookieMaxAge.Seconds()),
-		HttpOnly: false,
-		Path:     "/",
-	})
+// AttributeRole is what the configuration of a Middleware does with an
+// attribute, see AttributeSpec.
+type AttributeRole string
+
+// The roles of attributes. AttributeRequested attributes are advertised in
+// the metadata by ServiceProvider.RequestedAttributes, AttributeRequired
+// ones are ServiceProvider.RequiredAttributes, and AttributeSplit and
+// AttributeExcluded ones are SplitAttributes and ExcludeAttributes.
+const (
+	AttributeRequested AttributeRole = "requested"
+	AttributeRequired  AttributeRole = "required"
+	AttributeSplit     AttributeRole = "split"
+	AttributeExcluded  AttributeRole = "excluded"
+)
 
-	http.Redirect(w, r, redirectURI, http.StatusFound)
+// AttributeSpec describes an attribute that the configuration of a
+// Middleware refers to, by its Name or FriendlyName. FriendlyName and
+// NameFormat are only known for requested attributes. Delimiter is the
+// delimiter of split attributes.
+type AttributeSpec struct {
+	Name         string          `json:"name"`
+	FriendlyName string          `json:"friendlyName,omitempty"`
+	NameFormat   string          `json:"nameFormat,omitempty"`
+	Roles        []AttributeRole `json:"roles"`
+	Delimiter    string          `json:"delimiter,omitempty"`
 }
 
-// IsAuthorized is invoked by RequireAccount to determine if the request
-// is already authorized or if the user's browser should be redirected to the
-// SAML login flow. If the request is authorized, then the request headers
-// starting with X-Saml- for each SAML assertion attribute are set. For example,
-// if an attribute "uid" has the value "alice@example.com", then the following
-// header would be added to the request:
-//
-//     X-Saml-Uid: alice@example.com
+// DescribeAttributes returns the attributes that m is configured to
+// consume and what it does with them, e.g. to document the attributes that
+// the IDP is to release. The requested attributes come first, in order,
+// followed by the others as the required, split and excluded attributes
+// name them. A requested attribute is also matched by its FriendlyName,
+// so that it is described once however the settings refer to it.
 //
-// It is an error for this function to be invoked with a request containing
-// any headers starting with X-Saml. This function will panic if you do.
-func (m *Middleware) IsAuthorized(r *http.Request) bool {
-	cookie, err := r.Cookie(cookieName)
-	if err != nil {
-		return false
+// The rules of RequireAttribute and its relatives wrap handlers of their
+// own and are not known to m, so their attributes are not included.
+func (m *Middleware) DescribeAttributes() []AttributeSpec {
+	specs := []AttributeSpec{}
+	add := func(name string, role AttributeRole) *AttributeSpec {
+		for i := range specs {
+			spec := &specs[i]
+			if name != spec.Name && (spec.FriendlyName == "" || name != spec.FriendlyName) {
+				continue
+			}
+			for _, r := range spec.Roles {
+				if r == role {
+					return spec
+				}
+			}
+			spec.Roles = append(spec.Roles, role)
+			return spec
+		}
+		specs = append(specs, AttributeSpec{Name: name, Roles: []AttributeRole{role}})
+		return &specs[len(specs)-1]
+	}
+
+	for _, attr := range m.ServiceProvider.RequestedAttributes {
+		spec := add(attr.Name, AttributeRequested)
+		spec.FriendlyName = attr.FriendlyName
+		spec.NameFormat = attr.NameFormat
+	}
+	for _, name := range m.ServiceProvider.RequiredAttributes {
+		add(name, AttributeRequired)
 	}
-	token, err := jwt.Parse(cookie.Value, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", t.Header["alg"])
+	splitNames := []string{}
+	for name := range m.SplitAttributes {
+		splitNames = append(splitNames, name)
+	}
+	sort.Strings(splitNames)
+	for _, name := range splitNames {
+		add(name, AttributeSplit).Delimiter = m.SplitAttributes[name]
+	}
+	for _, name := range m.ExcludeAttributes {
+		if name != "" {
+			add(name, AttributeExcluded)
 		}
+	}
+	return specs
+}
 
-		return m.ServiceProvider.Key.Public(), nil
-	})
-	if err != nil || !token.Valid {
-		return false
+// attributeDelimiter returns the delimiter that SplitAttributes sets for
+// attr, by its FriendlyName or else its Name, or "" if its values are not
+// to be split.
+func (m *Middleware) attributeDelimiter(attr saml.Attribute) string {
+	if attr.FriendlyName != "" {
+		if delimiter, ok := m.SplitAttributes[attr.FriendlyName]; ok {
+			return delimiter
+		}
 	}
+	return m.SplitAttributes[attr.Name]
+}
 
-	// It is an error for the request to include any X-SAML* headers,
-	// because those might be confused with ours. If we encounter any
-	// such headers, we abort the request, so there is no confustion.
-	for headerName := range r.Header {
-		if strings.HasPrefix(headerName, "X-Saml") {
-			panic("X-Saml-* headers should not exist when this function is called")
+// excludedAttribute returns true if ExcludeAttributes names attr by its
+// FriendlyName or its Name.
+func (m *Middleware) excludedAttribute(attr saml.Attribute) bool {
+	for _, name := range m.ExcludeAttributes {
+		if name != "" && (name == attr.FriendlyName || name == attr.Name) {
+			return true
 		}
 	}
+	return false
+}
 
-	claims := token.Claims.(jwt.MapClaims)
+// splitAttributeValue returns the non-empty items of value separated by
+// delimiter, trimmed of spaces.
+func splitAttributeValue(value string, delimiter string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, delimiter) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// sessionAttributes reassembles the SAML attributes stored in the claims of
+// a session token.
+func sessionAttributes(claims jwt.MapClaims) Attributes {
+	types := map[string]attributeTypes{}
+	if typesClaim, ok := claims["attr_types"]; ok {
+		buf, _ := json.Marshal(typesClaim)
+		json.Unmarshal(buf, &types)
+	}
+
+	attributes := Attributes{}
 	for claimName, claimValue := range claims {
-		if claimName == "exp" {
+		if isRegisteredClaim(claimName) {
+			continue
+		}
+		values, ok := claimStrings(claimValue)
+		if !ok {
 			continue
 		}
-		for _, claimValueStr := range claimValue.([]interface{}) {
-			r.Header.Add(fmt.Sprintf("X-Saml-%s", claimName), claimValueStr.(string))
+		first := types[claimName]
+		for i, attrTypes := range append([]attributeTypes{first}, first.More...) {
+			attr := saml.Attribute{
+				Name:       attrTypes.Name,
+				NameFormat: attrTypes.NameFormat,
+			}
+			name := strings.TrimPrefix(claimName, attrTypes.Prefix)
+			if attr.Name == "" {
+				attr.Name = name
+			}
+			if attr.Name != name {
+				attr.FriendlyName = name
+			}
+			// the last attribute takes the remaining values, e.g. those
+			// of a claim set by ClaimsModifier, which has no types
+			n := len(attrTypes.Types)
+			if i == len(first.More) || n > len(values) {
+				n = len(values)
+			}
+			for j, claimValueStr := range values[:n] {
+				value := saml.AttributeValue{Value: claimValueStr}
+				if j < len(attrTypes.Types) {
+					value.Type = attrTypes.Types[j]
+				}
+				attr.Values = append(attr.Values, value)
+			}
+			values = values[n:]
+
+			key := AttributeKey{NameFormat: attr.NameFormat, Name: attr.Name}
+			if existing, ok := attributes[key]; ok {
+				existing.Values = append(existing.Values, attr.Values...)
+				attr = existing
+			}
+			attributes[key] = attr
+		}
+	}
+	return attributes
+}
+
+// headerName returns the name of the request header for the attribute
+// named attributeName, and whether to set it at all.
+func (m *Middleware) headerName(attributeName string) (string, bool) {
+	if m.HeaderNameFunc != nil {
+		return m.HeaderNameFunc(attributeName)
+	}
+	return fmt.Sprintf("X-Saml-%s", attributeName), true
+}
+
+// sessionAuthnContext returns the AuthnContext stored in the `auth_time`,
+// `acr` and `authn_authorities` claims of a session token.
+func sessionAuthnContext(claims jwt.MapClaims) *AuthnContext {
+	authnContext := &AuthnContext{}
+	if authTime, ok := claims["auth_time"].(float64); ok {
+		authnContext.AuthnInstant = time.Unix(int64(authTime), 0).UTC()
+	}
+	authnContext.ClassRef, _ = claims["acr"].(string)
+	if authorities, ok := claimStrings(claims["authn_authorities"]); ok {
+		authnContext.AuthenticatingAuthorities = authorities
+	}
+	return authnContext
+}
+
+// claimStrings returns the values of a claim that holds a string or a list
+// of strings, as the attribute claims do. It returns false for claims that
+// hold anything else, which a ClaimsModifier may have added.
+func claimStrings(claimValue interface{}) ([]string, bool) {
+	switch v := claimValue.(type) {
+	case string:
+		return []string{v}, true
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, value := range v {
+			s, ok := value.(string)
+			if !ok {
+				return nil, false
+			}
+			values[i] = s
 		}
+		return values, true
 	}
-	return true
+	return nil, false
+}
+
+// isRegisteredClaim returns true if name is one of the JWT registered claims,
+// or one of our own claims, that we set on the session token, as opposed to
+// a SAML attribute.
+func isRegisteredClaim(name string) bool {
+	switch name {
+	case "exp", "iat", "nbf", "iss", "aud", "sub", "name_id", "auth_time", "acr", "authn_authorities", "attr_types", "renew_until", "sid":
+		return true
+	}
+	return false
 }
 
 // RequireAttribute returns a middleware function that requires that the
 // SAML attribute `name` be set to `value`. This can be used to require
-// that a remote user be a member of a group. It relies on the X-Saml-* headers
-// that RequireAccount adds to the request.
+// that a remote user be a member of a group. It looks the attribute up in
+// the RequestAttributes that RequireAccount adds to the request, or, if
+// there are none, in the X-Saml-* headers.
 //
 // For example:
 //
 //     goji.Use(m.RequireAccount)
 //     goji.Use(RequireAttributeMiddleware("eduPersonAffiliation", "Staff"))
 //
-func RequireAttribute(name, value string) func(http.Handler) http.Handler {
+//
+// Requests that do not have the attribute get a 403 Forbidden, unless the
+// WithDeniedHandler option says otherwise. Values must be exactly equal,
+// unless the WithIgnoreCase or WithTrimSpace options relax the comparison.
+func RequireAttribute(name, value string, opts ...RequireOption) func(http.Handler) http.Handler {
+	return RequireAttributeMatch(name, newRequireOptions(opts).equals(value), opts...)
+}
+
+// RequireOption customizes the middleware functions returned by
+// RequireAttribute, RequireAttributeMatch and RequireAttributes.
+type RequireOption func(o *requireOptions)
+
+type requireOptions struct {
+	denied     http.Handler
+	ignoreCase bool
+	trimSpace  bool
+}
+
+// newRequireOptions returns the options that opts set.
+func newRequireOptions(opts []RequireOption) requireOptions {
+	o := requireOptions{denied: http.HandlerFunc(forbidden)}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// equals returns an AttributeMatcher that accepts values equal to value,
+// as compared by the options.
+func (o requireOptions) equals(value string) AttributeMatcher {
+	if o.trimSpace {
+		value = strings.TrimSpace(value)
+	}
+	return func(actualValue string) bool {
+		if o.trimSpace {
+			actualValue = strings.TrimSpace(actualValue)
+		}
+		if o.ignoreCase {
+			return strings.EqualFold(actualValue, value)
+		}
+		return actualValue == value
+	}
+}
+
+// WithDeniedHandler causes requests that do not meet the requirement to be
+// served by handler, e.g. to redirect to an "access denied" page, instead
+// of getting a plain 403 Forbidden.
+func WithDeniedHandler(handler http.Handler) RequireOption {
+	return func(o *requireOptions) {
+		o.denied = handler
+	}
+}
+
+// WithIgnoreCase causes RequireAttribute and RequireAttributes to compare
+// values case-insensitively, e.g. for IDPs that send "Staff" for "staff".
+func WithIgnoreCase() RequireOption {
+	return func(o *requireOptions) {
+		o.ignoreCase = true
+	}
+}
+
+// WithTrimSpace causes RequireAttribute and RequireAttributes to ignore
+// leading and trailing white space in values.
+func WithTrimSpace() RequireOption {
+	return func(o *requireOptions) {
+		o.trimSpace = true
+	}
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+// AttributeMatcher reports whether value is an acceptable value of an
+// attribute. See RequireAttributeMatch.
+type AttributeMatcher func(value string) bool
+
+// RequireAttributeMatch is like RequireAttribute, but requires that one of
+// the values of the SAML attribute `name` is accepted by match instead of
+// being equal to a fixed value. opts are as for RequireAttribute.
+//
+// For example, to require a eduPersonPrincipalName in the example.edu scope:
+//
+//     goji.Use(m.RequireAccount)
+//     goji.Use(RequireAttributeMatch("eduPersonPrincipalName", InScope("example.edu")))
+//
+func RequireAttributeMatch(name string, match AttributeMatcher, opts ...RequireOption) func(http.Handler) http.Handler {
+	o := newRequireOptions(opts)
+	return func(handler http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if hasAttributeMatch(r, name, match) {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			o.denied.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// RequireAttributes is like RequireAttribute, but requires every SAML
+// attribute in reqs to be set to its value, e.g. both dept=Eng and
+// role=Lead. opts are as for RequireAttribute; requests that miss any of
+// the attributes are denied alike. If reqs is empty, all requests are
+// denied, so that a missing configuration does not let everyone in.
+func RequireAttributes(reqs map[string]string, opts ...RequireOption) func(http.Handler) http.Handler {
+	o := newRequireOptions(opts)
+	return func(handler http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if len(reqs) == 0 {
+				o.denied.ServeHTTP(w, r)
+				return
+			}
+			for name, value := range reqs {
+				if !hasAttributeMatch(r, name, o.equals(value)) {
+					o.denied.ServeHTTP(w, r)
+					return
+				}
+			}
+			handler.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// hasAttributeMatch returns true if one of the values of the SAML attribute
+// name of r is accepted by match. It looks the attribute up in the
+// RequestAttributes, or, if there are none, in the X-Saml-* headers.
+func hasAttributeMatch(r *http.Request, name string, match AttributeMatcher) bool {
+	var values []string
+	if attributes := RequestAttributes(r); attributes != nil {
+		values = attributes.Values(name)
+	} else {
+		values = r.Header[http.CanonicalHeaderKey(fmt.Sprintf("X-Saml-%s", name))]
+	}
+	for _, actualValue := range values {
+		if match(actualValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireAuthnContextClassRef returns a middleware function that allows the
+// request through only if the user authenticated with one of classRefs,
+// e.g. a multi-factor authentication context, and responds with 403
+// Forbidden otherwise. Like RequireAttribute, it must be used after
+// RequireAccount.
+func RequireAuthnContextClassRef(classRefs ...string) func(http.Handler) http.Handler {
 	return func(handler http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
-			if values, ok := r.Header[http.CanonicalHeaderKey(fmt.Sprintf("X-Saml-%s", name))]; ok {
-				for _, actualValue := range values {
-					if actualValue == value {
+			if authnContext := RequestAuthnContext(r); authnContext != nil {
+				for _, classRef := range classRefs {
+					if authnContext.ClassRef == classRef {
 						handler.ServeHTTP(w, r)
 						return
 					}
 				}
 			}
-			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			forbidden(w, r)
 		}
 		return http.HandlerFunc(fn)
 	}
 }
+
+// EqualFold returns an AttributeMatcher that accepts values equal to value
+// under Unicode case-folding.
+func EqualFold(value string) AttributeMatcher {
+	return func(actualValue string) bool {
+		return strings.EqualFold(actualValue, value)
+	}
+}
+
+// InScope returns an AttributeMatcher for scoped attributes, such as
+// eduPersonPrincipalName, that accepts values of the form "value@scope"
+// where scope is equal to the given scope, ignoring case. Subdomains of
+// scope are not accepted.
+func InScope(scope string) AttributeMatcher {
+	return func(actualValue string) bool {
+		i := strings.LastIndex(actualValue, "@")
+		return i > 0 && strings.EqualFold(actualValue[i+1:], scope)
+	}
+}
+
+// Unscoped returns an AttributeMatcher for scoped attributes, such as
+// eduPersonScopedAffiliation, that accepts values of the form "value@scope"
+// where the value before the scope is equal to the given value, ignoring
+// case, whatever the scope.
+func Unscoped(value string) AttributeMatcher {
+	return func(actualValue string) bool {
+		i := strings.LastIndex(actualValue, "@")
+		return i > 0 && strings.EqualFold(actualValue[:i], value)
+	}
+}
@@ -0,0 +1,19 @@
+package samlsp
+
+import "net/http"
+
+// RateLimiter limits the responses that the ACS verifies, each of which
+// costs a signature check and possibly a decryption, as anyone can post to
+// it. See Middleware.RateLimiter.
+type RateLimiter interface {
+	// Allow returns false if r, a request to the ACS, is over the limit.
+	Allow(r *http.Request) bool
+}
+
+// RateLimiterFunc adapts an ordinary function to a RateLimiter.
+type RateLimiterFunc func(r *http.Request) bool
+
+// Allow returns f(r).
+func (f RateLimiterFunc) Allow(r *http.Request) bool {
+	return f(r)
+}
@@ -3,90 +3,560 @@
 package samlsp
 
 import (
+	"context"
 	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"html/template"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
+
 	"github.com/tambeti/saml"
 )
 
 // Options represents the parameters for creating a new middleware
+//
+// The key and certificate may be given either parsed, in Key and
+// Certificate, or as PEM in KeyPEM and CertificatePEM. Likewise the IDP
+// metadata may be given parsed, in IDPMetadata, as XML in IDPMetadataXML,
+// or fetched from IDPMetadataURL.
 type Options struct {
 	URL               string
 	Key               *rsa.PrivateKey
 	Certificate       string
+	KeyPEM            []byte
+	CertificatePEM    []byte
 	AllowIDPInitiated bool
 	IDPMetadata       *saml.Metadata
+	IDPMetadataXML    []byte
 	IDPMetadataURL    string
+	JWTIssuer         string
+	JWTAudience       string
+	Logger            Logger
+	RelayStateLength  int
+
+	// TrustedProxies sets Middleware.TrustedProxies.
+	TrustedProxies []*net.IPNet
+
+	// TrustForwardedHeaders sets Middleware.TrustForwardedHeaders.
+	//
+	// Deprecated: set TrustedProxies instead.
+	TrustForwardedHeaders bool
+
+	// PathPrefix sets Middleware.PathPrefix.
+	PathPrefix string
+
+	// SkipPaths sets Middleware.SkipPaths.
+	SkipPaths []string
+
+	// IsAPIRequest sets Middleware.IsAPIRequest.
+	IsAPIRequest func(r *http.Request) bool
+
+	// LoginRedirectStatus and PostLoginRedirectStatus set
+	// Middleware.LoginRedirectStatus and Middleware.PostLoginRedirectStatus.
+	LoginRedirectStatus     int
+	PostLoginRedirectStatus int
+
+	// RequireSecureTransport sets Middleware.RequireSecureTransport.
+	RequireSecureTransport bool
+
+	// AllowedRedirectHosts sets Middleware.AllowedRedirectHosts.
+	AllowedRedirectHosts []string
+
+	// CookiePath and CookieDomain set Middleware.CookiePath and
+	// Middleware.CookieDomain.
+	CookiePath   string
+	CookieDomain string
+
+	// CookiePartitioned sets Middleware.CookiePartitioned.
+	CookiePartitioned bool
+
+	// EncryptSessionToken sets Middleware.EncryptSessionToken.
+	EncryptSessionToken bool
+
+	// CompressState sets Middleware.CompressState.
+	CompressState bool
+
+	// TokenSigningMethod sets Middleware.TokenSigningMethod.
+	TokenSigningMethod string
+
+	// IssuedAtAssertion sets Middleware.IssuedAtAssertion.
+	IssuedAtAssertion bool
+
+	// TokenKey and RetiredTokenKeys set Middleware.TokenKey and
+	// Middleware.RetiredTokenKeys.
+	TokenKey         *rsa.PrivateKey
+	RetiredTokenKeys []*rsa.PrivateKey
+
+	// ClaimsModifier sets Middleware.ClaimsModifier.
+	ClaimsModifier func(assertion *saml.Assertion, claims jwt.MapClaims)
+
+	// HeaderNameFunc sets Middleware.HeaderNameFunc.
+	HeaderNameFunc func(attributeName string) (headerName string, include bool)
+
+	// HeaderValueSeparator sets Middleware.HeaderValueSeparator.
+	HeaderValueSeparator string
+
+	// SplitAttributes sets Middleware.SplitAttributes.
+	SplitAttributes map[string]string
+
+	// ExcludeAttributes sets Middleware.ExcludeAttributes.
+	ExcludeAttributes []string
+
+	// NameFormatPrefixes sets Middleware.NameFormatPrefixes.
+	NameFormatPrefixes map[string]string
+
+	// OnResponse sets Middleware.OnResponse.
+	OnResponse func(r *http.Request, response *ReceivedResponse) error
+
+	// RequestID sets Middleware.RequestID.
+	RequestID func(r *http.Request) string
+
+	// OnLogin sets Middleware.OnLogin.
+	OnLogin func(r *http.Request) (originalURL string, err error)
+
+	// DenyNameID sets Middleware.DenyNameID.
+	DenyNameID func(nameID saml.NameID) bool
+
+	// RequireSameNameID sets Middleware.RequireSameNameID.
+	RequireSameNameID bool
+
+	// OnSession sets Middleware.OnSession.
+	OnSession func(w http.ResponseWriter, r *http.Request, assertion *saml.Assertion) error
+
+	// TokenCacheSize and TokenCacheTTL set Middleware.TokenCacheSize and
+	// Middleware.TokenCacheTTL.
+	TokenCacheSize int
+	TokenCacheTTL  time.Duration
+
+	// StateStore sets Middleware.StateStore.
+	StateStore StateStore
+
+	// SessionStore sets Middleware.SessionStore. If it is set, the
+	// ServiceProvider.SloURL is URL with saml.DefaultEndpointPaths.Slo appended.
+	SessionStore SessionStore
+
+	// StateHeader sets Middleware.StateHeader.
+	StateHeader string
+
+	// MaxStateCookies sets Middleware.MaxStateCookies.
+	MaxStateCookies int
+
+	// RateLimiter sets Middleware.RateLimiter.
+	RateLimiter RateLimiter
+
+	// ReplayPostBodySize sets Middleware.ReplayPostBodySize.
+	ReplayPostBodySize int64
+
+	// SessionRenewalWindow and SessionMaxLifetime set
+	// Middleware.SessionRenewalWindow and Middleware.SessionMaxLifetime.
+	SessionRenewalWindow time.Duration
+	SessionMaxLifetime   time.Duration
+
+	// RetryPolicy sets ServiceProvider.RetryPolicy, which also applies to
+	// refreshing the metadata from IDPMetadataURL.
+	RetryPolicy saml.RetryPolicy
+
+	// IDPMetadataRetryPolicy controls how New retries fetching the metadata
+	// from IDPMetadataURL, which may be slow to come up when started along
+	// with the SP. Each field that is zero takes its value from
+	// DefaultIDPMetadataRetryPolicy.
+	IDPMetadataRetryPolicy saml.RetryPolicy
+
+	// HTTPClient sets ServiceProvider.HTTPClient, which is also used to
+	// fetch the metadata from IDPMetadataURL.
+	HTTPClient *http.Client
+
+	// PostTemplate sets ServiceProvider.PostTemplate, which renders the
+	// form that posts a LogoutRequest to the IDP.
+	PostTemplate *template.Template
+
+	// MaxMessageSize sets ServiceProvider.MaxMessageSize.
+	MaxMessageSize int
+
+	// IDPEntityID sets Middleware.IDPEntityID. It also selects the IDP
+	// from IDPMetadataXML.
+	IDPEntityID string
+
+	// IDPMetadataRefreshInterval, if non-zero, causes New to set
+	// Middleware.MetadataRefresher so that the metadata fetched from
+	// IDPMetadataURL can be refreshed in the background. It is the longest
+	// time between refreshes; see MetadataRefresher.
+	// IDPMetadataRefreshJitter is the fraction of the interval by which
+	// each refresh is randomly moved earlier or later.
+	IDPMetadataRefreshInterval time.Duration
+	IDPMetadataRefreshJitter   float64
 }
 
 // New creates a new Middleware
 func New(opts Options) (*Middleware, error) {
+	if err := opts.parse(); err != nil {
+		return nil, err
+	}
+
 	m := &Middleware{
 		ServiceProvider: saml.ServiceProvider{
-			Key:         opts.Key,
-			Certificate: opts.Certificate,
-			MetadataURL: opts.URL + "/saml/metadata",
-			AcsURL:      opts.URL + "/saml/acs",
-			IDPMetadata: opts.IDPMetadata,
+			Key:                  opts.Key,
+			Certificate:          opts.Certificate,
+			MetadataURL:          opts.URL + saml.DefaultEndpointPaths.Metadata,
+			AcsURL:               opts.URL + saml.DefaultEndpointPaths.Acs,
+			IDPMetadata:          opts.IDPMetadata,
+			WantAssertionsSigned: true,
+			RetryPolicy:          opts.RetryPolicy,
+			HTTPClient:           opts.HTTPClient,
+			PostTemplate:         opts.PostTemplate,
+			MaxMessageSize:       opts.MaxMessageSize,
 		},
 		AllowIDPInitiated: opts.AllowIDPInitiated,
+		IDPEntityID:       opts.IDPEntityID,
+		LoginEndpointURL:  opts.URL + "/saml/login",
+		JWTIssuer:         opts.JWTIssuer,
+		JWTAudience:       opts.JWTAudience,
+		Logger:            opts.Logger,
+		RelayStateLength:  opts.RelayStateLength,
+
+		TrustedProxies:          opts.TrustedProxies,
+		TrustForwardedHeaders:   opts.TrustForwardedHeaders,
+		PathPrefix:              opts.PathPrefix,
+		SkipPaths:               opts.SkipPaths,
+		IsAPIRequest:            opts.IsAPIRequest,
+		LoginRedirectStatus:     opts.LoginRedirectStatus,
+		PostLoginRedirectStatus: opts.PostLoginRedirectStatus,
+		RequireSecureTransport:  opts.RequireSecureTransport,
+		AllowedRedirectHosts:    opts.AllowedRedirectHosts,
+		CookiePath:              opts.CookiePath,
+		CookieDomain:            opts.CookieDomain,
+		CookiePartitioned:       opts.CookiePartitioned,
+		EncryptSessionToken:     opts.EncryptSessionToken,
+		CompressState:           opts.CompressState,
+		TokenSigningMethod:      opts.TokenSigningMethod,
+		IssuedAtAssertion:       opts.IssuedAtAssertion,
+		TokenKey:                opts.TokenKey,
+		RetiredTokenKeys:        opts.RetiredTokenKeys,
+		ClaimsModifier:          opts.ClaimsModifier,
+		HeaderNameFunc:          opts.HeaderNameFunc,
+		HeaderValueSeparator:    opts.HeaderValueSeparator,
+		SplitAttributes:         opts.SplitAttributes,
+		ExcludeAttributes:       opts.ExcludeAttributes,
+		NameFormatPrefixes:      opts.NameFormatPrefixes,
+		OnResponse:              opts.OnResponse,
+		RequestID:               opts.RequestID,
+		OnLogin:                 opts.OnLogin,
+		DenyNameID:              opts.DenyNameID,
+		RequireSameNameID:       opts.RequireSameNameID,
+		OnSession:               opts.OnSession,
+		TokenCacheSize:          opts.TokenCacheSize,
+		TokenCacheTTL:           opts.TokenCacheTTL,
+		StateStore:              opts.StateStore,
+		SessionStore:            opts.SessionStore,
+		StateHeader:             opts.StateHeader,
+		MaxStateCookies:         opts.MaxStateCookies,
+		RateLimiter:             opts.RateLimiter,
+		ReplayPostBodySize:      opts.ReplayPostBodySize,
+		SessionRenewalWindow:    opts.SessionRenewalWindow,
+		SessionMaxLifetime:      opts.SessionMaxLifetime,
+	}
+	if opts.SessionStore != nil {
+		m.ServiceProvider.SloURL = opts.URL + saml.DefaultEndpointPaths.Slo
+	}
+	if err := m.Init(); err != nil {
+		return nil, err
+	}
+	if err := checkRelayStateLength(m.RelayStateLength); err != nil {
+		return nil, err
+	}
+	if err := checkCookieDomain(m.CookieDomain, m.ServiceProvider.AcsURL); err != nil {
+		return nil, err
+	}
+	for _, status := range []int{m.LoginRedirectStatus, m.PostLoginRedirectStatus} {
+		if err := checkRedirectStatus(status); err != nil {
+			return nil, err
+		}
 	}
 
 	// fetch the IDP metadata if needed.
 	if opts.IDPMetadataURL == "" {
+		m.logIDPMetadataWarnings()
 		return m, nil
 	}
 
-	for i := 0; true; i++ {
-		resp, err := http.Get(opts.IDPMetadataURL)
-		if err == nil && resp.StatusCode != http.StatusOK {
-			err = fmt.Errorf("%d %s", resp.StatusCode, resp.Status)
+	validators := metadataValidators{}
+	retryPolicy := opts.IDPMetadataRetryPolicy
+	if retryPolicy.MaxAttempts == 0 {
+		retryPolicy.MaxAttempts = DefaultIDPMetadataRetryPolicy.MaxAttempts
+	}
+	if retryPolicy.InitialBackoff == 0 {
+		retryPolicy.InitialBackoff = DefaultIDPMetadataRetryPolicy.InitialBackoff
+	}
+	if retryPolicy.MaxBackoff == 0 {
+		retryPolicy.MaxBackoff = DefaultIDPMetadataRetryPolicy.MaxBackoff
+	}
+	entity, err := m.fetchMetadata(context.Background(), retryPolicy, opts.IDPMetadataURL, &validators)
+	if err != nil {
+		return nil, err
+	}
+	m.ServiceProvider.IDPMetadata = entity
+	m.logIDPMetadataWarnings()
+	if opts.IDPMetadataRefreshInterval > 0 {
+		m.MetadataRefresher = &MetadataRefresher{
+			Middleware: m,
+			URL:        opts.IDPMetadataURL,
+			Interval:   opts.IDPMetadataRefreshInterval,
+			Jitter:     opts.IDPMetadataRefreshJitter,
+			validators: validators,
+		}
+	}
+	return m, nil
+}
+
+// logIDPMetadataWarnings logs the problems that saml.ValidateIDPMetadata
+// finds in the IDP metadata, if it is set, and a signing key that
+// CheckIDPSigningKey rejects, as ParseResponse will then reject every
+// response.
+func (m *Middleware) logIDPMetadataWarnings() {
+	if m.ServiceProvider.IDPMetadata == nil {
+		return
+	}
+	for _, warning := range saml.ValidateIDPMetadata(m.ServiceProvider.IDPMetadata) {
+		m.logger().Printf("IDP metadata: %s", warning)
+	}
+	if err := m.ServiceProvider.CheckIDPSigningKey(); err != nil {
+		m.logger().Printf("IDP metadata: %s", err)
+	}
+}
+
+// parse checks opts and fills in Key, Certificate and IDPMetadata from
+// their PEM and XML counterparts. A key is required.
+func (opts *Options) parse() error {
+	if opts.URL != "" {
+		u, err := url.Parse(opts.URL)
+		if err != nil {
+			return fmt.Errorf("cannot parse URL: %s", err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("URL %q is not absolute", opts.URL)
+		}
+	}
+
+	if opts.KeyPEM != nil {
+		if opts.Key != nil {
+			return fmt.Errorf("only one of Key and KeyPEM may be set")
+		}
+		key, err := parseKeyPEM(opts.KeyPEM)
+		if err != nil {
+			return err
+		}
+		opts.Key = key
+	}
+
+	if opts.CertificatePEM != nil {
+		if opts.Certificate != "" {
+			return fmt.Errorf("only one of Certificate and CertificatePEM may be set")
 		}
-		var data []byte
-		if err == nil {
-			data, err = ioutil.ReadAll(resp.Body)
-			resp.Body.Close()
+		block, _ := pem.Decode(opts.CertificatePEM)
+		if block == nil || block.Type != "CERTIFICATE" {
+			return fmt.Errorf("CertificatePEM does not contain a PEM encoded CERTIFICATE")
 		}
+		cert, err := x509.ParseCertificate(block.Bytes)
 		if err != nil {
-			if i > 10 {
-				return nil, err
+			return fmt.Errorf("cannot parse certificate: %s", err)
+		}
+		if opts.Key != nil {
+			if pub, ok := cert.PublicKey.(*rsa.PublicKey); !ok || pub.N.Cmp(opts.Key.N) != 0 || pub.E != opts.Key.E {
+				return fmt.Errorf("certificate does not match the key")
 			}
-			log.Printf("ERROR: %s: %s (will retry)", opts.IDPMetadataURL, err)
-			time.Sleep(5 * time.Second)
-			continue
 		}
+		opts.Certificate = base64.StdEncoding.EncodeToString(block.Bytes)
+	}
 
-		entity := &saml.Metadata{}
+	if opts.IDPMetadataXML != nil {
+		if opts.IDPMetadata != nil || opts.IDPMetadataURL != "" {
+			return fmt.Errorf("only one of IDPMetadata, IDPMetadataXML and IDPMetadataURL may be set")
+		}
+		entity, err := parseMetadata(opts.IDPMetadataXML, opts.IDPEntityID)
+		if err != nil {
+			return fmt.Errorf("cannot parse IDP metadata: %s", err)
+		}
+		opts.IDPMetadata = entity
+	}
 
-		err = xml.Unmarshal(data, entity)
+	if opts.Key == nil {
+		return ErrNoKey
+	}
+	if err := opts.Key.Validate(); err != nil {
+		return fmt.Errorf("invalid key: %s", err)
+	}
+	return nil
+}
 
-		// this comparison is ugly, but it is how the error is generated in encoding/xml
-		if err != nil && err.Error() == "expected element type <EntityDescriptor> but have <EntitiesDescriptor>" {
-			entities := &saml.EntitiesDescriptor{}
-			if err := xml.Unmarshal(data, entities); err != nil {
-				return nil, err
-			}
+// ErrNoKey is returned by New when neither Key nor KeyPEM is set. The key
+// is needed to sign the JSON Web Tokens of the middleware, so a Middleware
+// whose ServiceProvider has no Key refuses to start the SAML flow with it.
+var ErrNoKey = errors.New("no key: one of Key and KeyPEM must be set")
 
-			err = fmt.Errorf("no entity found with IDPSSODescriptor")
-			for _, e := range entities.EntityDescriptor {
-				if e.IDPSSODescriptor != nil {
-					entity = e
-					err = nil
-				}
-			}
+// parseKeyPEM returns the RSA private key in the PKCS #1 or PKCS #8 PEM
+// block in buf.
+func parseKeyPEM(buf []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("KeyPEM does not contain a PEM encoded key")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse key: %s", err)
 		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("cannot parse key: %s", err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key is not an RSA key")
+		}
+		return rsaKey, nil
+	}
+	return nil, fmt.Errorf("KeyPEM contains a %q block, not an RSA private key", block.Type)
+}
+
+// metadataValidators are the ETag and Last-Modified headers of the last
+// metadata fetched, which are sent back so that the server can answer
+// 304 Not Modified if the metadata has not changed.
+type metadataValidators struct {
+	ETag         string
+	LastModified string
+}
+
+// DefaultIDPMetadataRetryPolicy is the retry policy with which New fetches
+// the metadata from Options.IDPMetadataURL, for the fields of
+// Options.IDPMetadataRetryPolicy that are zero: twelve attempts, five
+// seconds apart.
+var DefaultIDPMetadataRetryPolicy = saml.RetryPolicy{
+	MaxAttempts:    12,
+	InitialBackoff: 5 * time.Second,
+	MaxBackoff:     5 * time.Second,
+}
+
+// fetchMetadata fetches the IDP metadata at url, retrying transient
+// failures as retryPolicy says.
+func (m *Middleware) fetchMetadata(ctx context.Context, retryPolicy saml.RetryPolicy, url string, validators *metadataValidators) (*saml.Metadata, error) {
+	var entity *saml.Metadata
+	err := retryPolicy.Do(ctx, func() (bool, error) {
+		var retry bool
+		var err error
+		entity, retry, err = fetchMetadata(ctx, m.httpClient(), url, m.IDPEntityID, validators)
+		if err != nil && retry {
+			m.logger().Printf("ERROR: %s: %s", url, err)
 		}
+		return retry, err
+	})
+	return entity, err
+}
 
-		m.ServiceProvider.IDPMetadata = entity
-		return m, nil
+// httpClient returns ServiceProvider.HTTPClient, or http.DefaultClient if
+// it is not set.
+func (m *Middleware) httpClient() *http.Client {
+	if m.ServiceProvider.HTTPClient == nil {
+		return http.DefaultClient
 	}
+	return m.ServiceProvider.HTTPClient
+}
 
-	panic("unreachable")
+// fetchMetadata fetches the IDP metadata at url with client and parses it
+// with parseMetadata, selecting entityID. On error, it also returns whether
+// retrying may help.
+//
+// If validators is not nil, the request is made conditional on them, and
+// they are updated from the response. If the server then reports that the
+// metadata has not changed, fetchMetadata returns neither metadata nor an
+// error.
+func fetchMetadata(ctx context.Context, client *http.Client, url string, entityID string, validators *metadataValidators) (*saml.Metadata, bool, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if validators != nil {
+		if validators.ETag != "" {
+			req.Header.Set("If-None-Match", validators.ETag)
+		}
+		if validators.LastModified != "" {
+			req.Header.Set("If-Modified-Since", validators.LastModified)
+		}
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && validators != nil {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, saml.RetryableStatus(resp.StatusCode), fmt.Errorf("%d %s", resp.StatusCode, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	entity, err := parseMetadata(data, entityID)
+	if err != nil {
+		return nil, false, err
+	}
+	if validators != nil {
+		validators.ETag = resp.Header.Get("ETag")
+		validators.LastModified = resp.Header.Get("Last-Modified")
+	}
+	return entity, false, nil
+}
+
+// parseMetadata parses the IDP metadata in data. If the document is an
+// EntitiesDescriptor, such as a federation aggregate, the entity with
+// entityID is used or, if entityID is empty, the first entity with an
+// IDPSSODescriptor. Otherwise the entityID of the document, if given, must
+// match.
+func parseMetadata(data []byte, entityID string) (*saml.Metadata, error) {
+	entity := &saml.Metadata{}
+	err := xml.Unmarshal(data, entity)
+
+	// this comparison is ugly, but it is how the error is generated in encoding/xml
+	if err != nil && err.Error() == "expected element type <EntityDescriptor> but have <EntitiesDescriptor>" {
+		entities := &saml.EntitiesDescriptor{}
+		if err := xml.Unmarshal(data, entities); err != nil {
+			return nil, err
+		}
+		if entityID != "" {
+			entity = entities.Entity(entityID)
+			if entity == nil {
+				return nil, fmt.Errorf("no entity found with entityID %q", entityID)
+			}
+			if entity.IDPSSODescriptor == nil {
+				return nil, fmt.Errorf("entity %q has no IDPSSODescriptor", entityID)
+			}
+			return entity, nil
+		}
+		idps := entities.IDPEntities()
+		if len(idps) == 0 {
+			return nil, fmt.Errorf("no entity found with IDPSSODescriptor")
+		}
+		return idps[0], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if entityID != "" && entity.EntityID != entityID {
+		return nil, fmt.Errorf("metadata is for entity %q, not %q", entity.EntityID, entityID)
+	}
+	return entity, nil
 }
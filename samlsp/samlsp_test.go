@@ -1,20 +1,36 @@
 package samlsp
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/xml"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	. "gopkg.in/check.v1"
+
+	"github.com/tambeti/saml"
 )
 
 var _ = Suite(&ParseTest{})
 
 type ParseTest struct {
+	Key *rsa.PrivateKey
 }
 
 func (test *ParseTest) SetUpTest(c *C) {
+	// MiddlewareTest pins both clocks to 2015 and TestRequireAccountExpiredCreds
+	// moves jwt.TimeFunc a century ahead; neither is put back.
+	saml.TimeNow = time.Now
+	jwt.TimeFunc = time.Now
 
+	var err error
+	test.Key, err = rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, IsNil)
 }
 
 type mockTransport func(req *http.Request) (*http.Response, error)
@@ -24,7 +40,7 @@ func (mt mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 }
 
 func (test *ParseTest) TestCanParseTestshibMetadata(c *C) {
-	http.DefaultTransport = mockTransport(func(req *http.Request) (*http.Response, error) {
+	transport := mockTransport(func(req *http.Request) (*http.Response, error) {
 		responseBody := `<EntitiesDescriptor Name="urn:mace:shibboleth:testshib:two"
     xmlns="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ds="http://www.w3.org/2000/09/xmldsig#"
     xmlns:mdalg="urn:oasis:names:tc:SAML:metadata:algsupport" xmlns:mdui="urn:oasis:names:tc:SAML:metadata:ui"
@@ -411,12 +427,16 @@ func (test *ParseTest) TestCanParseTestshibMetadata(c *C) {
 		}, nil
 	})
 
-	_, err := New(Options{IDPMetadataURL: "https://idp.testshib.org/idp/shibboleth"})
+	_, err := New(Options{
+		Key:            test.Key,
+		IDPMetadataURL: "https://idp.testshib.org/idp/shibboleth",
+		HTTPClient:     &http.Client{Transport: transport},
+	})
 	c.Assert(err, IsNil)
 }
 
 func (test *ParseTest) TestCanParseGoogleMetadata(c *C) {
-	http.DefaultTransport = mockTransport(func(req *http.Request) (*http.Response, error) {
+	transport := mockTransport(func(req *http.Request) (*http.Response, error) {
 		responseBody := `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
 <md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://accounts.google.com/o/saml2?idpid=123456789" validUntil="2021-01-03T16:17:49.000Z">
   <md:IDPSSODescriptor WantAuthnRequestsSigned="false" protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
@@ -457,12 +477,16 @@ MUsphIQXHXtrx4Z3qRgE/uZ8z98LA35XfA==</ds:X509Certificate>
 		}, nil
 	})
 
-	_, err := New(Options{IDPMetadataURL: "https://accounts.google.com/o/saml2?idpid=123456789"})
+	_, err := New(Options{
+		Key:            test.Key,
+		IDPMetadataURL: "https://accounts.google.com/o/saml2?idpid=123456789",
+		HTTPClient:     &http.Client{Transport: transport},
+	})
 	c.Assert(err, IsNil)
 }
 
 func (test *ParseTest) TestCanParseFreeIPAMetadata(c *C) {
-	http.DefaultTransport = mockTransport(func(req *http.Request) (*http.Response, error) {
+	transport := mockTransport(func(req *http.Request) (*http.Response, error) {
 		responseBody := `<?xml version='1.0' encoding='UTF-8'?>
 <md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ds="http://www.w3.org/2000/09/xmldsig#" validUntil="2021-10-11T12:03:21.537380" entityID="https://ipa.example.com/idp/saml2/metadata">
   <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
@@ -533,6 +557,148 @@ MUsphIQXHXtrx4Z3qRgE/uZ8z98LA35XfA==
 		}, nil
 	})
 
-	_, err := New(Options{IDPMetadataURL: "https://ipa.example.com/idp/saml2/metadata"})
+	_, err := New(Options{
+		Key:            test.Key,
+		IDPMetadataURL: "https://ipa.example.com/idp/saml2/metadata",
+		HTTPClient:     &http.Client{Transport: transport},
+	})
+	c.Assert(err, IsNil)
+}
+
+func (test *ParseTest) TestFederationMetadata(c *C) {
+	aggregate := []byte(`<EntitiesDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" Name="https://federation.example.org">
+  <EntityDescriptor entityID="https://sp.example.edu/shibboleth">
+    <SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+      <AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://sp.example.edu/Shibboleth.sso/SAML2/POST" index="1"/>
+    </SPSSODescriptor>
+  </EntityDescriptor>
+  <EntityDescriptor entityID="https://idp.example.edu/idp/shibboleth">
+    <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+      <SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.edu/idp/profile/SAML2/Redirect/SSO"/>
+    </IDPSSODescriptor>
+  </EntityDescriptor>
+  <EntitiesDescriptor Name="https://federation.example.org/gov">
+    <EntityDescriptor entityID="https://idp.example.gov/saml2/idp">
+      <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+        <SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.gov/saml2/idp/sso"/>
+      </IDPSSODescriptor>
+    </EntityDescriptor>
+  </EntitiesDescriptor>
+</EntitiesDescriptor>`)
+
+	entities := &saml.EntitiesDescriptor{}
+	c.Assert(xml.Unmarshal(aggregate, entities), IsNil)
+	c.Assert(entities.Name, Equals, "https://federation.example.org")
+	c.Assert(entities.EntitiesDescriptors, HasLen, 1)
+	c.Assert(entities.Entity("https://idp.example.gov/saml2/idp"), NotNil)
+	c.Assert(entities.Entity("https://idp.example.com/"), IsNil)
+	c.Assert(entities.IDPEntities(), HasLen, 2)
+
+	// the IDP is selected by its entityID, even from a nested aggregate
+	m, err := New(Options{
+		Key:            test.Key,
+		IDPMetadataXML: aggregate,
+		IDPEntityID:    "https://idp.example.gov/saml2/idp",
+		Logger:         &recordingLogger{},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(m.IDPEntityID, Equals, "https://idp.example.gov/saml2/idp")
+	c.Assert(m.ServiceProvider.IDPMetadata.EntityID, Equals, "https://idp.example.gov/saml2/idp")
+	c.Assert(m.ServiceProvider.GetSSOBindingLocation(saml.HTTPRedirectBinding), Equals, "https://idp.example.gov/saml2/idp/sso")
+
+	// without an entityID, the first IDP is used
+	entity, err := parseMetadata(aggregate, "")
+	c.Assert(err, IsNil)
+	c.Assert(entity.EntityID, Equals, "https://idp.example.edu/idp/shibboleth")
+
+	_, err = parseMetadata(aggregate, "https://idp.example.com/")
+	c.Assert(err, ErrorMatches, `no entity found with entityID "https://idp.example.com/"`)
+	_, err = parseMetadata(aggregate, "https://sp.example.edu/shibboleth")
+	c.Assert(err, ErrorMatches, `entity "https://sp.example.edu/shibboleth" has no IDPSSODescriptor`)
+
+	// the entityID of a single entity must match
+	_, err = parseMetadata([]byte(refresherTestMetadata), "https://idp.example.com/")
+	c.Assert(err, ErrorMatches, `metadata is for entity ".*", not "https://idp.example.com/"`)
+
+	// of several matching entities, the first is used
+	aggregate = []byte(`<EntitiesDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata">
+  <EntityDescriptor entityID="https://idp.example.edu/idp/shibboleth">
+    <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+      <SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.edu/first"/>
+    </IDPSSODescriptor>
+  </EntityDescriptor>
+  <EntityDescriptor entityID="https://idp.example.edu/idp/shibboleth">
+    <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+      <SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.edu/second"/>
+    </IDPSSODescriptor>
+  </EntityDescriptor>
+</EntitiesDescriptor>`)
+	for _, entityID := range []string{"", "https://idp.example.edu/idp/shibboleth"} {
+		m, err = New(Options{
+			Key:            test.Key,
+			IDPMetadataXML: aggregate,
+			IDPEntityID:    entityID,
+			Logger:         &recordingLogger{},
+		})
+		c.Assert(err, IsNil)
+		c.Assert(m.ServiceProvider.GetSSOBindingLocation(saml.HTTPRedirectBinding), Equals, "https://idp.example.edu/first")
+	}
+}
+
+func (test *ParseTest) TestHTTPClient(c *C) {
+	defaultTransport := http.DefaultTransport
+	defer func() {
+		http.DefaultTransport = defaultTransport
+	}()
+	http.DefaultTransport = mockTransport(func(req *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("request to %s not made with the client", req.URL)
+	})
+	requests := []string{}
+	client := &http.Client{Transport: mockTransport(func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req.URL.String())
+		return &http.Response{
+			Header:     http.Header{},
+			Request:    req,
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(refresherTestMetadata)),
+		}, nil
+	})}
+
+	m, err := New(Options{
+		Key:                        test.Key,
+		IDPMetadataURL:             "https://idp.example.com/metadata",
+		IDPMetadataRefreshInterval: time.Hour,
+		HTTPClient:                 client,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(m.ServiceProvider.HTTPClient, Equals, client)
+	c.Assert(m.ServiceProvider.IDPMetadata.EntityID, Equals, "https://idp.example.com/metadata")
+
+	// refreshes go through the client too
+	c.Assert(m.MetadataRefresher.Refresh(), IsNil)
+	c.Assert(requests, DeepEquals, []string{"https://idp.example.com/metadata", "https://idp.example.com/metadata"})
+}
+
+func (test *ParseTest) TestNewLogsIDPMetadataWarnings(c *C) {
+	logger := &recordingLogger{}
+	_, err := New(Options{
+		Key: test.Key,
+		IDPMetadata: &saml.Metadata{
+			EntityID:         "https://idp.example.com/metadata",
+			IDPSSODescriptor: &saml.IDPSSODescriptor{},
+		},
+		Logger: logger,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(logger.Print, DeepEquals, []string{
+		"IDP metadata: there is no SingleSignOnService",
+		"IDP metadata: there is no SingleLogoutService with the urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect binding, so logouts are not sent to the IDP",
+		"IDP metadata: there is no signing certificate",
+	})
+
+	// there is nothing to check until the metadata is set
+	logger = &recordingLogger{}
+	_, err = New(Options{Key: test.Key, Logger: logger})
 	c.Assert(err, IsNil)
+	c.Assert(logger.Print, IsNil)
 }
@@ -0,0 +1,112 @@
+package samlsp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tambeti/saml"
+)
+
+// SessionStore keeps a record of each session on the server, keyed by an
+// ID that the session token carries, so that sessions can be ended before
+// their tokens expire, e.g. by a back-channel LogoutRequest of the IDP. See
+// Middleware.SessionStore.
+type SessionStore interface {
+	// Put stores the session id of the user with nameID, whose login had
+	// the SessionIndex sessionIndex at the IDP, which may be empty, until
+	// expires.
+	Put(id string, nameID saml.NameID, sessionIndex string, expires time.Time) error
+
+	// Exists returns true if the session id is stored and has not expired.
+	Exists(id string) (bool, error)
+
+	// Delete removes the session id, if it is stored.
+	Delete(id string) error
+
+	// DeleteNameID removes the sessions of the user with nameID, or, if
+	// sessionIndex is not empty, only those whose login had it, and
+	// returns how many were removed. NameIDs are matched as by
+	// SameNameID.
+	DeleteNameID(nameID saml.NameID, sessionIndex string) (int, error)
+}
+
+// SameNameID returns true if a and b have the same Value, and the same
+// Format, NameQualifier and SPNameQualifier where both have one, as IDPs
+// do not always repeat the qualifiers of the NameID of an assertion in a
+// LogoutRequest.
+func SameNameID(a, b saml.NameID) bool {
+	same := func(x, y string) bool {
+		return x == "" || y == "" || x == y
+	}
+	return a.Value == b.Value && same(a.Format, b.Format) &&
+		same(a.NameQualifier, b.NameQualifier) && same(a.SPNameQualifier, b.SPNameQualifier)
+}
+
+// MemorySessionStore is a SessionStore that keeps the sessions in memory.
+// It is only suitable when a single instance of the service handles all
+// the requests of the users and of the IDP.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]memorySession
+}
+
+type memorySession struct {
+	nameID       saml.NameID
+	sessionIndex string
+	expires      time.Time
+}
+
+// NewMemorySessionStore returns an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: map[string]memorySession{}}
+}
+
+// Put implements SessionStore. It also forgets the sessions that have
+// expired.
+func (s *MemorySessionStore) Put(id string, nameID saml.NameID, sessionIndex string, expires time.Time) error {
+	now := saml.TimeNow()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.sessions {
+		if !now.Before(v.expires) {
+			delete(s.sessions, k)
+		}
+	}
+	s.sessions[id] = memorySession{nameID: nameID, sessionIndex: sessionIndex, expires: expires}
+	return nil
+}
+
+// Exists implements SessionStore.
+func (s *MemorySessionStore) Exists(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.sessions[id]
+	return ok && saml.TimeNow().Before(v.expires), nil
+}
+
+// Delete implements SessionStore.
+func (s *MemorySessionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+// DeleteNameID implements SessionStore.
+func (s *MemorySessionStore) DeleteNameID(nameID saml.NameID, sessionIndex string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for k, v := range s.sessions {
+		if !SameNameID(v.nameID, nameID) {
+			continue
+		}
+		if sessionIndex != "" && v.sessionIndex != sessionIndex {
+			continue
+		}
+		delete(s.sessions, k)
+		n++
+	}
+	return n, nil
+}
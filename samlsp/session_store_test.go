@@ -0,0 +1,64 @@
+package samlsp
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/tambeti/saml"
+)
+
+func (test *ParseTest) TestMemorySessionStore(c *C) {
+	timeNow := saml.TimeNow
+	defer func() {
+		saml.TimeNow = timeNow
+	}()
+	now := time.Date(2015, 12, 1, 1, 57, 9, 0, time.UTC)
+	saml.TimeNow = func() time.Time { return now }
+
+	alice := saml.NameID{Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent", Value: "alice"}
+	bob := saml.NameID{Value: "bob"}
+	s := NewMemorySessionStore()
+	c.Assert(s.Put("a1", alice, "idx1", now.Add(time.Hour)), IsNil)
+	c.Assert(s.Put("a2", alice, "idx2", now.Add(time.Hour)), IsNil)
+	c.Assert(s.Put("b1", bob, "", now.Add(time.Minute)), IsNil)
+
+	exists, err := s.Exists("a1")
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, true)
+	exists, _ = s.Exists("nope")
+	c.Assert(exists, Equals, false)
+
+	// only the session with the SessionIndex ends
+	n, err := s.DeleteNameID(saml.NameID{Value: "alice"}, "idx1")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	exists, _ = s.Exists("a1")
+	c.Assert(exists, Equals, false)
+	exists, _ = s.Exists("a2")
+	c.Assert(exists, Equals, true)
+
+	// a different Format is another user
+	n, _ = s.DeleteNameID(saml.NameID{Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:transient", Value: "alice"}, "")
+	c.Assert(n, Equals, 0)
+	n, _ = s.DeleteNameID(alice, "")
+	c.Assert(n, Equals, 1)
+
+	c.Assert(s.Delete("b1"), IsNil)
+	exists, _ = s.Exists("b1")
+	c.Assert(exists, Equals, false)
+
+	// expired sessions do not exist
+	c.Assert(s.Put("b2", bob, "", now.Add(time.Minute)), IsNil)
+	now = now.Add(time.Minute)
+	exists, _ = s.Exists("b2")
+	c.Assert(exists, Equals, false)
+}
+
+func (test *ParseTest) TestSameNameID(c *C) {
+	a := saml.NameID{Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent", NameQualifier: "https://idp.example.com", Value: "alice"}
+	c.Assert(SameNameID(a, a), Equals, true)
+	c.Assert(SameNameID(a, saml.NameID{Value: "alice"}), Equals, true)
+	c.Assert(SameNameID(a, saml.NameID{Value: "bob"}), Equals, false)
+	c.Assert(SameNameID(a, saml.NameID{NameQualifier: "https://other.example.com", Value: "alice"}), Equals, false)
+}
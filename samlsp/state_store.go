@@ -0,0 +1,79 @@
+package samlsp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tambeti/saml"
+)
+
+// ErrStateNotFound is returned by a StateStore for a RelayState that it
+// has no state for, or whose state has expired.
+var ErrStateNotFound = errors.New("no state stored for the RelayState")
+
+// StateStore keeps the state of logins in progress on the server, keyed by
+// their RelayState, instead of in a saml_ cookie per login. See
+// Middleware.StateStore.
+type StateStore interface {
+	// Put stores state under relayState until expires.
+	Put(relayState string, state string, expires time.Time) error
+
+	// Get returns the state stored under relayState, or ErrStateNotFound.
+	Get(relayState string) (string, error)
+
+	// Delete removes the state stored under relayState, if any.
+	Delete(relayState string) error
+}
+
+// MemoryStateStore is a StateStore that keeps the states in memory. It is
+// only suitable when a single instance of the service handles both the
+// requests that start logins and the responses of the IDP.
+type MemoryStateStore struct {
+	mu     sync.Mutex
+	states map[string]memoryState
+}
+
+type memoryState struct {
+	state   string
+	expires time.Time
+}
+
+// NewMemoryStateStore returns an empty MemoryStateStore.
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{states: map[string]memoryState{}}
+}
+
+// Put implements StateStore. It also forgets the states that have expired.
+func (s *MemoryStateStore) Put(relayState string, state string, expires time.Time) error {
+	now := saml.TimeNow()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.states {
+		if !now.Before(v.expires) {
+			delete(s.states, k)
+		}
+	}
+	s.states[relayState] = memoryState{state: state, expires: expires}
+	return nil
+}
+
+// Get implements StateStore.
+func (s *MemoryStateStore) Get(relayState string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.states[relayState]
+	if !ok || !saml.TimeNow().Before(v.expires) {
+		return "", ErrStateNotFound
+	}
+	return v.state, nil
+}
+
+// Delete implements StateStore.
+func (s *MemoryStateStore) Delete(relayState string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.states, relayState)
+	return nil
+}
@@ -0,0 +1,169 @@
+package samlsp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/tambeti/saml"
+)
+
+func (test *ParseTest) TestStateStore(c *C) {
+	idpMetadata, err := parseMetadata([]byte(refresherTestMetadata), "")
+	c.Assert(err, IsNil)
+	m := &Middleware{
+		ServiceProvider: saml.ServiceProvider{
+			Key:         test.Key,
+			MetadataURL: "https://15661444.ngrok.io/saml2/metadata",
+			AcsURL:      "https://15661444.ngrok.io/saml2/acs",
+			IDPMetadata: idpMetadata,
+		},
+		StateStore: NewMemoryStateStore(),
+	}
+
+	startLogin := func() (relayState string, bindingCookie *http.Cookie) {
+		req, _ := http.NewRequest("GET", "https://15661444.ngrok.io/frob", nil)
+		resp := httptest.NewRecorder()
+		m.RequireAccount(http.NotFoundHandler()).ServeHTTP(resp, req)
+		c.Assert(resp.Code, Equals, http.StatusFound)
+		redirectURL, err := url.Parse(resp.Header().Get("Location"))
+		c.Assert(err, IsNil)
+		relayState = redirectURL.Query().Get("RelayState")
+		c.Assert(relayState, Not(Equals), "")
+		cookies := (&http.Response{Header: resp.Header()}).Cookies()
+		c.Assert(cookies, HasLen, 1)
+		return relayState, cookies[0]
+	}
+	acsRequest := func(relayState string, bindingCookie *http.Cookie) *http.Request {
+		req, _ := http.NewRequest("POST", "https://15661444.ngrok.io/saml2/acs",
+			strings.NewReader(url.Values{"RelayState": {relayState}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if bindingCookie != nil {
+			req.AddCookie(bindingCookie)
+		}
+		return req
+	}
+	assertion := &saml.Assertion{AttributeStatement: &saml.AttributeStatement{}}
+
+	// the cookie only binds the stored state to the browser
+	relayState, bindingCookie := startLogin()
+	c.Assert(bindingCookie.Name, Equals, "saml_"+relayState)
+	c.Assert(bindingCookie.HttpOnly, Equals, true)
+	_, err = m.parseStateToken(bindingCookie.Value)
+	c.Assert(err, NotNil)
+
+	c.Assert(m.getPossibleRequestIDs(acsRequest(relayState, bindingCookie)), HasLen, 1)
+	resp := httptest.NewRecorder()
+	m.Authorize(resp, acsRequest(relayState, bindingCookie), assertion)
+	c.Assert(resp.Code, Equals, http.StatusFound)
+	c.Assert(resp.Header().Get("Location"), Equals, "https://15661444.ngrok.io/frob")
+	c.Assert(resp.Header()["Set-Cookie"][0], Matches, "saml_"+relayState+"=; Path=/saml2/acs; Max-Age=0")
+
+	// the state can be used only once
+	c.Assert(m.getPossibleRequestIDs(acsRequest(relayState, bindingCookie)), HasLen, 0)
+	resp = httptest.NewRecorder()
+	m.Authorize(resp, acsRequest(relayState, bindingCookie), assertion)
+	c.Assert(resp.Code, Equals, http.StatusForbidden)
+
+	// and only by the browser that started the login, so that an attacker
+	// cannot have the user complete a login of theirs
+	relayState, bindingCookie = startLogin()
+	_, otherCookie := startLogin()
+	otherCookie.Name = bindingCookie.Name
+	for _, cookie := range []*http.Cookie{nil, otherCookie} {
+		c.Assert(m.getPossibleRequestIDs(acsRequest(relayState, cookie)), HasLen, 0)
+		resp = httptest.NewRecorder()
+		m.Authorize(resp, acsRequest(relayState, cookie), assertion)
+		c.Assert(resp.Code, Equals, http.StatusForbidden)
+	}
+	resp = httptest.NewRecorder()
+	m.Authorize(resp, acsRequest(relayState, bindingCookie), assertion)
+	c.Assert(resp.Code, Equals, http.StatusFound)
+}
+
+func (test *ParseTest) TestStateHeader(c *C) {
+	idpMetadata, err := parseMetadata([]byte(refresherTestMetadata), "")
+	c.Assert(err, IsNil)
+	m := &Middleware{
+		ServiceProvider: saml.ServiceProvider{
+			Key:         test.Key,
+			MetadataURL: "https://15661444.ngrok.io/saml2/metadata",
+			AcsURL:      "https://15661444.ngrok.io/saml2/acs",
+			IDPMetadata: idpMetadata,
+		},
+		StateHeader: "X-Login-State",
+		Logger:      &recordingLogger{},
+	}
+
+	startLogin := func() (relayState, stateCookie, stateHeader string) {
+		req, _ := http.NewRequest("GET", "https://15661444.ngrok.io/frob", nil)
+		resp := httptest.NewRecorder()
+		m.RequireAccount(http.NotFoundHandler()).ServeHTTP(resp, req)
+		c.Assert(resp.Code, Equals, http.StatusFound)
+		redirectURL, err := url.Parse(resp.Header().Get("Location"))
+		c.Assert(err, IsNil)
+		cookies := (&http.Response{Header: resp.Header()}).Cookies()
+		c.Assert(cookies, HasLen, 1)
+		return redirectURL.Query().Get("RelayState"), cookies[0].Value, resp.Header().Get("X-Login-State")
+	}
+	acsRequest := func(relayState, stateHeader string) *http.Request {
+		req, _ := http.NewRequest("POST", "https://15661444.ngrok.io/saml2/acs",
+			strings.NewReader(url.Values{"RelayState": {relayState}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Login-State", stateHeader)
+		return req
+	}
+	assertion := &saml.Assertion{AttributeStatement: &saml.AttributeStatement{}}
+
+	// the header carries the same state as the cookie
+	relayState, stateCookie, stateHeader := startLogin()
+	c.Assert(stateHeader, Equals, stateCookie)
+	c.Assert(m.getPossibleRequestIDs(acsRequest(relayState, stateHeader)), HasLen, 1)
+	resp := httptest.NewRecorder()
+	m.Authorize(resp, acsRequest(relayState, stateHeader), assertion)
+	c.Assert(resp.Code, Equals, http.StatusFound)
+	c.Assert(resp.Header().Get("Location"), Equals, "https://15661444.ngrok.io/frob")
+
+	// but only for the RelayState it was issued for
+	otherRelayState, _, _ := startLogin()
+	resp = httptest.NewRecorder()
+	m.Authorize(resp, acsRequest(otherRelayState, stateHeader), assertion)
+	c.Assert(resp.Code, Equals, http.StatusForbidden)
+	c.Assert(m.Logger.(*recordingLogger).Print, DeepEquals, []string{
+		`invalid state in X-Login-State header for RelayState "` + otherRelayState + `": token was issued for another RelayState`,
+	})
+
+	// the header is ignored unless StateHeader is set
+	m.StateHeader = ""
+	relayState, stateCookie, stateHeader = startLogin()
+	c.Assert(stateHeader, Equals, "")
+	resp = httptest.NewRecorder()
+	m.Authorize(resp, acsRequest(relayState, stateCookie), assertion)
+	c.Assert(resp.Code, Equals, http.StatusForbidden)
+}
+
+func (test *ParseTest) TestMemoryStateStore(c *C) {
+	s := NewMemoryStateStore()
+	_, err := s.Get("a")
+	c.Assert(err, Equals, ErrStateNotFound)
+
+	c.Assert(s.Put("a", "state-a", saml.TimeNow().Add(time.Minute)), IsNil)
+	c.Assert(s.Put("b", "state-b", saml.TimeNow().Add(-time.Minute)), IsNil)
+	state, err := s.Get("a")
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, "state-a")
+	_, err = s.Get("b")
+	c.Assert(err, Equals, ErrStateNotFound)
+
+	// expired states are forgotten
+	c.Assert(s.Put("c", "state-c", saml.TimeNow().Add(time.Minute)), IsNil)
+	c.Assert(s.states, HasLen, 2)
+
+	c.Assert(s.Delete("a"), IsNil)
+	_, err = s.Get("a")
+	c.Assert(err, Equals, ErrStateNotFound)
+}
@@ -0,0 +1,105 @@
+package samlsp
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// DefaultTokenCacheTTL is the default for Middleware.TokenCacheTTL.
+const DefaultTokenCacheTTL = time.Minute
+
+// tokenCache remembers session tokens that have been verified, so that
+// IsAuthorized does not have to verify the RSA signature of the same cookie
+// on every request. It holds at most size tokens, evicting the least
+// recently used one when full. Entries are keyed on the SHA-256 hash of the
+// cookie value, so that the cache does not hold the cookies themselves.
+type tokenCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	lru     *list.List
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+type tokenCacheEntry struct {
+	key     [sha256.Size]byte
+	token   *jwt.Token
+	expires time.Time
+}
+
+func newTokenCache(size int, ttl time.Duration) *tokenCache {
+	return &tokenCache{
+		size:    size,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: map[[sha256.Size]byte]*list.Element{},
+	}
+}
+
+// get returns the token verified for value, if it is cached and neither the
+// entry nor the token has expired.
+func (c *tokenCache) get(value string, now time.Time) (*jwt.Token, bool) {
+	key := sha256.Sum256([]byte(value))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*tokenCacheEntry)
+	if !now.Before(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return entry.token, true
+}
+
+// add caches token, which has been verified, for value. The entry expires
+// after the TTL, or when the token does, whichever is sooner.
+func (c *tokenCache) add(value string, token *jwt.Token, now time.Time) {
+	expires := now.Add(c.ttl)
+	if claims, ok := token.Claims.(jwt.MapClaims); ok {
+		if exp, ok := claims["exp"].(float64); ok {
+			if t := time.Unix(int64(exp), 0); t.Before(expires) {
+				expires = t
+			}
+		}
+	}
+	if !now.Before(expires) {
+		return
+	}
+	key := sha256.Sum256([]byte(value))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value = &tokenCacheEntry{key: key, token: token, expires: expires}
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&tokenCacheEntry{key: key, token: token, expires: expires})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*tokenCacheEntry).key)
+	}
+}
+
+// remove forgets the token cached for value, if any.
+func (c *tokenCache) remove(value string) {
+	key := sha256.Sum256([]byte(value))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+}
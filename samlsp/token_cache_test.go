@@ -0,0 +1,146 @@
+package samlsp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	. "gopkg.in/check.v1"
+
+	"github.com/tambeti/saml"
+)
+
+// sessionCookie returns the session cookie that m issues for a login as
+// the user with the given mail address.
+func (test *ParseTest) sessionCookie(c *C, m *Middleware, mail string) *http.Cookie {
+	assertion := &saml.Assertion{
+		AttributeStatement: &saml.AttributeStatement{
+			Attributes: []saml.Attribute{{
+				FriendlyName: "mail",
+				Values:       []saml.AttributeValue{{Value: mail}},
+			}},
+		},
+	}
+	req, _ := http.NewRequest("POST", "/saml2/acs", nil)
+	resp := httptest.NewRecorder()
+	m.authorize(resp, req, assertion, "/")
+	c.Assert(resp.Code, Equals, http.StatusFound)
+	return (&http.Response{Header: resp.Header()}).Cookies()[0]
+}
+
+func (test *ParseTest) cachingMiddleware() *Middleware {
+	return &Middleware{
+		ServiceProvider: saml.ServiceProvider{
+			Key:    test.Key,
+			AcsURL: "https://15661444.ngrok.io/saml2/acs",
+			IDPMetadata: &saml.Metadata{
+				IDPSSODescriptor: &saml.IDPSSODescriptor{},
+			},
+		},
+		TokenCacheSize: 2,
+	}
+}
+
+func (test *ParseTest) TestTokenCache(c *C) {
+	m := test.cachingMiddleware()
+	alice := test.sessionCookie(c, m, "alice@example.com")
+	bob := test.sessionCookie(c, m, "bob@example.com")
+	carol := test.sessionCookie(c, m, "carol@example.com")
+
+	authorizedMail := func(cookie *http.Cookie) string {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.AddCookie(cookie)
+		r, ok := m.authorizedRequest(req)
+		if !ok {
+			return ""
+		}
+		return RequestAttributes(r).Get("mail")
+	}
+
+	c.Assert(authorizedMail(alice), Equals, "alice@example.com")
+	c.Assert(m.tokenCache.lru.Len(), Equals, 1)
+	c.Assert(authorizedMail(alice), Equals, "alice@example.com")
+	c.Assert(m.tokenCache.lru.Len(), Equals, 1)
+
+	// a changed token is verified afresh, and rejected if it is not valid
+	tampered := *alice
+	tampered.Value = alice.Value + "x"
+	c.Assert(authorizedMail(&tampered), Equals, "")
+	c.Assert(m.tokenCache.lru.Len(), Equals, 1)
+	c.Assert(authorizedMail(bob), Equals, "bob@example.com")
+	c.Assert(m.tokenCache.lru.Len(), Equals, 2)
+
+	// alice was used less recently than bob, so she is evicted
+	c.Assert(authorizedMail(carol), Equals, "carol@example.com")
+	c.Assert(m.tokenCache.lru.Len(), Equals, 2)
+	_, ok := m.tokenCache.get(alice.Value, saml.TimeNow())
+	c.Assert(ok, Equals, false)
+	_, ok = m.tokenCache.get(bob.Value, saml.TimeNow())
+	c.Assert(ok, Equals, true)
+	c.Assert(authorizedMail(alice), Equals, "alice@example.com")
+
+	// logging out forgets the token; alice is cached again, having evicted
+	// carol
+	req, _ := http.NewRequest("GET", "/saml/logout", nil)
+	req.AddCookie(alice)
+	_, ok = m.tokenCache.get(alice.Value, saml.TimeNow())
+	c.Assert(ok, Equals, true)
+	m.Logout(httptest.NewRecorder(), req)
+	_, ok = m.tokenCache.get(alice.Value, saml.TimeNow())
+	c.Assert(ok, Equals, false)
+
+	// the cache is off by default
+	m = test.cachingMiddleware()
+	m.TokenCacheSize = 0
+	c.Assert(authorizedMail(alice), Equals, "alice@example.com")
+	c.Assert(m.tokenCache, IsNil)
+}
+
+func (test *ParseTest) TestTokenCacheExpiry(c *C) {
+	now := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	cache := newTokenCache(10, time.Minute)
+	token := &jwt.Token{Claims: jwt.MapClaims{"exp": float64(now.Add(time.Hour).Unix())}, Valid: true}
+
+	cache.add("a", token, now)
+	t, ok := cache.get("a", now.Add(59*time.Second))
+	c.Assert(ok, Equals, true)
+	c.Assert(t, Equals, token)
+	_, ok = cache.get("a", now.Add(time.Minute))
+	c.Assert(ok, Equals, false)
+	c.Assert(cache.lru.Len(), Equals, 0)
+
+	// entries do not outlive the token
+	token = &jwt.Token{Claims: jwt.MapClaims{"exp": float64(now.Add(30 * time.Second).Unix())}, Valid: true}
+	cache.add("b", token, now)
+	_, ok = cache.get("b", now.Add(29*time.Second))
+	c.Assert(ok, Equals, true)
+	_, ok = cache.get("b", now.Add(30*time.Second))
+	c.Assert(ok, Equals, false)
+
+	token = &jwt.Token{Claims: jwt.MapClaims{"exp": float64(now.Unix())}, Valid: true}
+	cache.add("c", token, now)
+	c.Assert(cache.lru.Len(), Equals, 0)
+}
+
+func (test *ParseTest) benchmarkIsAuthorized(c *C, m *Middleware) {
+	cookie := test.sessionCookie(c, m, "alice@example.com")
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.AddCookie(cookie)
+		if !m.IsAuthorized(req) {
+			c.Fatal("not authorized")
+		}
+	}
+}
+
+func (test *ParseTest) BenchmarkIsAuthorized(c *C) {
+	m := test.cachingMiddleware()
+	m.TokenCacheSize = 0
+	test.benchmarkIsAuthorized(c, m)
+}
+
+func (test *ParseTest) BenchmarkIsAuthorizedCached(c *C) {
+	test.benchmarkIsAuthorized(c, test.cachingMiddleware())
+}
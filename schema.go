@@ -1,6 +1,7 @@
 package saml
 
 import (
+	"bytes"
 	"encoding/xml"
 	"time"
 
@@ -12,16 +13,21 @@ import (
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type AuthnRequest struct {
-	XMLName                     xml.Name          `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
-	AssertionConsumerServiceURL string            `xml:",attr"`
-	Destination                 string            `xml:",attr"`
-	ID                          string            `xml:",attr"`
-	IssueInstant                time.Time         `xml:",attr"`
-	ProtocolBinding             string            `xml:",attr"`
-	Version                     string            `xml:",attr"`
-	Issuer                      Issuer            `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
-	Signature                   *xmlsec.Signature `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
-	NameIDPolicy                NameIDPolicy      `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+	XMLName                       xml.Name               `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	AssertionConsumerServiceIndex *int                   `xml:",attr,omitempty"`
+	AssertionConsumerServiceURL   string                 `xml:",attr,omitempty"`
+	Destination                   string                 `xml:",attr"`
+	ForceAuthn                    bool                   `xml:",attr,omitempty"`
+	ID                            string                 `xml:",attr"`
+	IssueInstant                  time.Time              `xml:",attr"`
+	ProtocolBinding               string                 `xml:",attr"`
+	ProviderName                  string                 `xml:",attr,omitempty"`
+	Version                       string                 `xml:",attr"`
+	Issuer                        Issuer                 `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature                     *xmlsec.Signature      `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+	Extensions                    *Extensions            `xml:"urn:oasis:names:tc:SAML:2.0:protocol Extensions"`
+	NameIDPolicy                  NameIDPolicy           `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+	RequestedAuthnContext         *RequestedAuthnContext `xml:"urn:oasis:names:tc:SAML:2.0:protocol RequestedAuthnContext"`
 }
 
 func (a *AuthnRequest) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
@@ -39,6 +45,80 @@ func (a *AuthnRequest) UnmarshalXML(d *xml.Decoder, start xml.StartElement) erro
 	return nil
 }
 
+// Extensions represents the SAML object of the same name, which carries
+// elements from outside of the SAML schema, e.g. hints for a particular IDP.
+// XML is the raw XML of the elements. Each must declare its namespace
+// itself, so that the declaration is not lost when the elements are moved
+// between documents.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
+type Extensions struct {
+	XML string `xml:",innerxml"`
+}
+
+// LogoutRequest represents the SAML object of the same name, a request from a
+// session participant to end the user's session.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
+type LogoutRequest struct {
+	XMLName      xml.Name          `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutRequest"`
+	Destination  string            `xml:",attr"`
+	ID           string            `xml:",attr"`
+	IssueInstant time.Time         `xml:",attr"`
+	Version      string            `xml:",attr"`
+	Issuer       Issuer            `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature    *xmlsec.Signature `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+	NameID       *NameID           `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+	EncryptedID  *EncryptedID      `xml:"urn:oasis:names:tc:SAML:2.0:assertion EncryptedID"`
+	SessionIndex string            `xml:"urn:oasis:names:tc:SAML:2.0:protocol SessionIndex,omitempty"`
+}
+
+func (r *LogoutRequest) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type Alias LogoutRequest
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		Alias: (*Alias)(r),
+	}
+	if err := d.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	r.IssueInstant = time.Time(aux.IssueInstant)
+	return nil
+}
+
+// LogoutResponse represents the SAML object of the same name, the answer
+// to a LogoutRequest.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
+type LogoutResponse struct {
+	XMLName      xml.Name          `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutResponse"`
+	Destination  string            `xml:",attr,omitempty"`
+	ID           string            `xml:",attr"`
+	InResponseTo string            `xml:",attr"`
+	IssueInstant time.Time         `xml:",attr"`
+	Version      string            `xml:",attr"`
+	Issuer       *Issuer           `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature    *xmlsec.Signature `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+	Status       Status            `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+}
+
+func (r *LogoutResponse) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type Alias LogoutResponse
+	aux := &struct {
+		IssueInstant RelaxedTime `xml:",attr"`
+		*Alias
+	}{
+		Alias: (*Alias)(r),
+	}
+	if err := d.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	r.IssueInstant = time.Time(aux.IssueInstant)
+	return nil
+}
+
 // Issuer represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
@@ -52,9 +132,10 @@ type Issuer struct {
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type NameIDPolicy struct {
-	XMLName     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
-	AllowCreate bool     `xml:",attr"`
-	Format      string   `xml:",chardata"`
+	XMLName         xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+	AllowCreate     bool     `xml:",attr"`
+	SPNameQualifier string   `xml:",attr,omitempty"`
+	Format          string   `xml:",chardata"`
 }
 
 // Response represents the SAML object of the same name.
@@ -68,7 +149,8 @@ type Response struct {
 	IssueInstant       time.Time `xml:",attr"`
 	Version            string    `xml:",attr"`
 	Issuer             *Issuer   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
-	Status             *Status   `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+	Signature          *xmlsec.Signature
+	Status             *Status `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
 	EncryptedAssertion *EncryptedAssertion
 	Assertion          *Assertion `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
 }
@@ -92,22 +174,28 @@ func (r *Response) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type Status struct {
-	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
-	StatusCode StatusCode
+	XMLName       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+	StatusCode    StatusCode
+	StatusMessage string `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusMessage,omitempty"`
 }
 
 // StatusCode represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type StatusCode struct {
-	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
-	Value   string   `xml:",attr"`
+	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
+	Value      string   `xml:",attr"`
+	StatusCode *StatusCode
 }
 
 // StatusSuccess is the value of a StatusCode element when the authentication succeeds.
 // (nominally a constant, except for testing)
 var StatusSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
 
+// StatusResponder is the value of a StatusCode element when a request fails
+// because of us rather than the requester.
+const StatusResponder = "urn:oasis:names:tc:SAML:2.0:status:Responder"
+
 // EncryptedAssertion represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
@@ -116,6 +204,14 @@ type EncryptedAssertion struct {
 	EncryptedData []byte `xml:",innerxml"`
 }
 
+// EncryptedID represents the SAML object of the same name, an encrypted
+// NameID.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
+type EncryptedID struct {
+	EncryptedData []byte `xml:",innerxml"`
+}
+
 // Assertion represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
@@ -130,6 +226,18 @@ type Assertion struct {
 	Conditions         *Conditions
 	AuthnStatement     *AuthnStatement
 	AttributeStatement *AttributeStatement
+
+	// RawXML is the assertion element exactly as it was received from the
+	// IDP (after decryption, if it was encrypted), i.e. the bytes whose
+	// signature was verified. It is set by ParseResponse and is never
+	// marshalled.
+	RawXML []byte `xml:"-"`
+
+	// rawEnd is the input offset of the end of the assertion element and
+	// rawStartTagEnd that of the end of its start tag, recorded while
+	// unmarshalling so that RawXML can be sliced out of the input without
+	// parsing it again.
+	rawStartTagEnd, rawEnd int64
 }
 
 func (a *Assertion) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
@@ -140,19 +248,38 @@ func (a *Assertion) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	}{
 		Alias: (*Alias)(a),
 	}
+	startTagEnd := d.InputOffset()
 	if err := d.DecodeElement(&aux, &start); err != nil {
 		return err
 	}
 	a.IssueInstant = time.Time(aux.IssueInstant)
+	a.rawStartTagEnd, a.rawEnd = startTagEnd, d.InputOffset()
 	return nil
 }
 
+// rawXML returns the assertion element exactly as it appears in buf, which
+// must be the document that a was unmarshalled from. It returns nil if a was
+// not unmarshalled.
+func (a *Assertion) rawXML(buf []byte) []byte {
+	if a.rawEnd == 0 || a.rawEnd > int64(len(buf)) {
+		return nil
+	}
+	// The start tag begins at the last '<' before its end, as '<' cannot
+	// appear in attribute values.
+	start := bytes.LastIndexByte(buf[:a.rawStartTagEnd], '<')
+	if start < 0 {
+		return nil
+	}
+	return buf[start:a.rawEnd]
+}
+
 // Subject represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type Subject struct {
 	XMLName             xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
 	NameID              *NameID
+	EncryptedID         *EncryptedID
 	SubjectConfirmation *SubjectConfirmation
 }
 
@@ -166,6 +293,15 @@ type NameID struct {
 	Value           string `xml:",chardata"`
 }
 
+// IsTransient returns true if the NameID has TransientNameIDFormat. Such an
+// identifier is chosen by the IDP for a single session and differs at each
+// login, so it must not be used as the key of data that outlives the
+// session. To require a stable identifier, set
+// ServiceProvider.RequiredNameIDFormat to PersistentNameIDFormat.
+func (n NameID) IsTransient() bool {
+	return n.Format == TransientNameIDFormat
+}
+
 // SubjectConfirmation represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
@@ -175,19 +311,22 @@ type SubjectConfirmation struct {
 }
 
 // SubjectConfirmationData represents the SAML object of the same name.
+// NotBefore is nil if the IDP did not set it, as it usually does not.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type SubjectConfirmationData struct {
-	Address      string    `xml:",attr"`
-	InResponseTo string    `xml:",attr"`
-	NotOnOrAfter time.Time `xml:",attr"`
-	Recipient    string    `xml:",attr"`
+	Address      string     `xml:",attr"`
+	InResponseTo string     `xml:",attr"`
+	NotBefore    *time.Time `xml:",attr,omitempty"`
+	NotOnOrAfter time.Time  `xml:",attr"`
+	Recipient    string     `xml:",attr"`
 }
 
 func (s *SubjectConfirmationData) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	type Alias SubjectConfirmationData
 	aux := &struct {
-		NotOnOrAfter RelaxedTime `xml:",attr"`
+		NotBefore    *RelaxedTime `xml:",attr"`
+		NotOnOrAfter RelaxedTime  `xml:",attr"`
 		*Alias
 	}{
 		Alias: (*Alias)(s),
@@ -195,6 +334,10 @@ func (s *SubjectConfirmationData) UnmarshalXML(d *xml.Decoder, start xml.StartEl
 	if err := d.DecodeElement(&aux, &start); err != nil {
 		return err
 	}
+	if aux.NotBefore != nil {
+		notBefore := time.Time(*aux.NotBefore)
+		s.NotBefore = &notBefore
+	}
 	s.NotOnOrAfter = time.Time(aux.NotOnOrAfter)
 	return nil
 }
@@ -206,8 +349,15 @@ type Conditions struct {
 	NotBefore           time.Time `xml:",attr"`
 	NotOnOrAfter        time.Time `xml:",attr"`
 	AudienceRestriction *AudienceRestriction
+	OneTimeUse          *OneTimeUse
 }
 
+// OneTimeUse represents the SAML condition of the same name, which asks the
+// service provider not to accept the assertion more than once.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
+type OneTimeUse struct{}
+
 func (c *Conditions) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	type Alias Conditions
 	aux := &struct {
@@ -229,7 +379,42 @@ func (c *Conditions) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type AudienceRestriction struct {
-	Audience *Audience
+	// Audience is the first of Audiences. If Audiences is empty, Audience
+	// is marshalled and checked in its place.
+	//
+	// Deprecated: use Audiences.
+	Audience *Audience `xml:"-"`
+
+	// Audiences are the audiences that the assertion is restricted to,
+	// any one of which may accept it.
+	Audiences []Audience `xml:"Audience"`
+}
+
+func (a *AudienceRestriction) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type Alias AudienceRestriction
+	if err := d.DecodeElement((*Alias)(a), &start); err != nil {
+		return err
+	}
+	a.Audience = nil
+	if len(a.Audiences) > 0 {
+		a.Audience = &a.Audiences[0]
+	}
+	return nil
+}
+
+// MarshalXML writes Audiences or, if it is empty, Audience.
+func (a AudienceRestriction) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type Alias AudienceRestriction
+	a.Audiences = a.audiences()
+	return e.EncodeElement(Alias(a), start)
+}
+
+// audiences returns Audiences or, if it is empty, Audience.
+func (a *AudienceRestriction) audiences() []Audience {
+	if len(a.Audiences) == 0 && a.Audience != nil {
+		return []Audience{*a.Audience}
+	}
+	return a.Audiences
 }
 
 // Audience represents the SAML object of the same name.
@@ -243,16 +428,18 @@ type Audience struct {
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type AuthnStatement struct {
-	AuthnInstant    time.Time `xml:",attr"`
-	SessionIndex    string    `xml:",attr"`
-	SubjectLocality SubjectLocality
-	AuthnContext    AuthnContext
+	AuthnInstant        time.Time  `xml:",attr"`
+	SessionIndex        string     `xml:",attr"`
+	SessionNotOnOrAfter *time.Time `xml:",attr,omitempty"`
+	SubjectLocality     SubjectLocality
+	AuthnContext        AuthnContext
 }
 
 func (a *AuthnStatement) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	type Alias AuthnStatement
 	aux := &struct {
-		AuthnInstant RelaxedTime `xml:",attr"`
+		AuthnInstant        RelaxedTime  `xml:",attr"`
+		SessionNotOnOrAfter *RelaxedTime `xml:",attr"`
 		*Alias
 	}{
 		Alias: (*Alias)(a),
@@ -261,6 +448,10 @@ func (a *AuthnStatement) UnmarshalXML(d *xml.Decoder, start xml.StartElement) er
 		return err
 	}
 	a.AuthnInstant = time.Time(aux.AuthnInstant)
+	if aux.SessionNotOnOrAfter != nil {
+		sessionNotOnOrAfter := time.Time(*aux.SessionNotOnOrAfter)
+		a.SessionNotOnOrAfter = &sessionNotOnOrAfter
+	}
 	return nil
 }
 
@@ -276,6 +467,11 @@ type SubjectLocality struct {
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type AuthnContext struct {
 	AuthnContextClassRef *AuthnContextClassRef
+
+	// AuthenticatingAuthority identifies the IDPs, other than the issuer of
+	// the assertion, that took part in authenticating the user, e.g. the
+	// upstream IDP of a proxying IDP.
+	AuthenticatingAuthority []string
 }
 
 // AuthnContextClassRef represents the SAML object of the same name.
@@ -285,6 +481,17 @@ type AuthnContextClassRef struct {
 	Value string `xml:",chardata"`
 }
 
+// RequestedAuthnContext represents the SAML object of the same name, the
+// authentication context that an AuthnRequest asks the IDP to use.
+// Comparison is one of "exact" (the default), "minimum", "maximum" or
+// "better".
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
+type RequestedAuthnContext struct {
+	Comparison           string                 `xml:",attr,omitempty"`
+	AuthnContextClassRef []AuthnContextClassRef `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContextClassRef"`
+}
+
 // AttributeStatement represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
@@ -302,6 +509,14 @@ type Attribute struct {
 	Values       []AttributeValue `xml:"AttributeValue"`
 }
 
+// The NameFormats of attributes that SAML defines. Attributes named by URI,
+// e.g. by OID, usually have a FriendlyName as well.
+const (
+	AttributeNameFormatUnspecified = "urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified"
+	AttributeNameFormatURI         = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+	AttributeNameFormatBasic       = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+)
+
 // AttributeValue represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
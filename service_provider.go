@@ -3,16 +3,29 @@ package saml
 import (
 	"bytes"
 	"compress/flate"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/tambeti/saml/xmlsec"
 )
@@ -33,22 +46,328 @@ type ServiceProvider struct {
 	// Certificate is the x509 certificate in base64-d DER format.
 	Certificate string
 
+	// CertificateChain are the intermediate certificates that issued
+	// Certificate, in base64-d DER format, starting with the issuer of
+	// Certificate. They are included in the X509Data of our signatures.
+	CertificateChain []string
+
+	// EncryptionKey and EncryptionCertificate, if set, are a key pair used
+	// only for encryption: the metadata advertises EncryptionCertificate,
+	// rather than Certificate, as the certificate that the IDP should
+	// encrypt assertions to, and EncryptionKey is tried first when
+	// decrypting them. Certificate is then only advertised for signing.
+	EncryptionKey         *rsa.PrivateKey
+	EncryptionCertificate string
+
+	// AdditionalKeys are other key pairs that are valid during a key
+	// rollover, e.g. the previous or the upcoming key. Their certificates
+	// are advertised in the metadata and their keys are tried, after Key,
+	// when decrypting assertions. Key is always used for signing.
+	AdditionalKeys []KeyPair
+
+	// KeyName, if set, names Key in the KeyInfo of the signing and
+	// encryption KeyDescriptors of our metadata and of the signatures we
+	// make, for IDPs that look up SP keys by name rather than by
+	// certificate.
+	KeyName string
+
 	// MetadataURL is the full URL to the metadata endpoint on this host,
 	// i.e. https://example.com/saml/metadata
 	MetadataURL string
 
 	// AcsURL is the full URL to the SAML Assertion Customer Service endpoint
-	// on this host, i.e. https://example.com/saml/acs
+	// on this host, i.e. https://example.com/saml/acs. Responses are
+	// checked against it as configured, even behind a proxy.
 	AcsURL string
 
+	// AdditionalAcsURLs are the URLs of further Assertion Consumer Service
+	// endpoints of this service provider, e.g. on other hosts that it is
+	// reachable by. They are advertised in the metadata after AcsURL, and
+	// a response, and the Recipient of its assertion, may be addressed to
+	// any of them, but must be addressed to the one at which ParseResponse
+	// receives it. samlsp.Middleware serves only AcsURL.
+	AdditionalAcsURLs []string
+
+	// SloURL, if set, is the full URL of the single logout endpoint on this
+	// host, i.e. https://example.com/saml/slo, at which the IDP sends
+	// back-channel LogoutRequests with the SOAP binding. It is advertised
+	// in the metadata. See ParseBackChannelLogoutRequest.
+	SloURL string
+
+	// ResponseBinding, if set, is the ProtocolBinding of authentication
+	// requests, which asks the IDP to send the response with it rather
+	// than with whichever binding of our assertion consumer services it
+	// prefers. It must be a binding that they are advertised with in the
+	// metadata, i.e. HTTPPostBinding.
+	ResponseBinding string
+
 	// IDPMetadata is the metadata from the identity provider.
 	IDPMetadata *Metadata
 
-	// State that Authn Requests will be signed
+	// State that Authn Requests will be signed. Requests sent with the
+	// HTTP-Redirect binding, logout requests included, are signed as that
+	// binding requires, see AuthnRequestRedirect.
 	AuthnRequestsSigned bool
 
-	// Request that IdP assertions be signed
+	// WantAssertionsSigned requests that IdP assertions be signed. When set,
+	// ParseResponse rejects responses whose assertion does not carry its own
+	// valid signature, even if the enclosing Response is signed.
+	// NewServiceProvider and samlsp.New set it; a ServiceProvider literal
+	// must set it explicitly.
 	WantAssertionsSigned bool
+
+	// SignatureMethods and DigestMethods restrict the XML signature and
+	// digest algorithm URIs that ParseResponse accepts. If empty, any
+	// algorithm is accepted. Use xmlsec.StrictSignatureMethods and
+	// xmlsec.StrictDigestMethods to reject SHA-1.
+	SignatureMethods []string
+	DigestMethods    []string
+
+	// AllowRSA15KeyTransport causes encrypted assertions whose session key
+	// is encrypted with RSA PKCS#1 v1.5, xmlsec.RSA15, to be decrypted
+	// rather than rejected. Only set it for IDPs that cannot use OAEP, as
+	// the padding is open to attack.
+	AllowRSA15KeyTransport bool
+
+	// CanonicalizationMethod is the XML canonicalization method of the
+	// signatures we make, e.g. xmlsec.C14N for IDPs that expect inclusive
+	// c14n. It is applied to both the SignedInfo and the signed element.
+	// If empty, xmlsec.DefaultSignature is used.
+	CanonicalizationMethod string
+
+	// SignatureMethod is the XML signature method of the signatures we make,
+	// e.g. xmlsec.RSAPSSSHA256 for keys that only make RSASSA-PSS
+	// signatures. The digest method that goes with it is used too. If
+	// empty, that of xmlsec.DefaultSignature is used.
+	SignatureMethod string
+
+	// RetryPolicy controls how requests to the IDP, such as fetching its
+	// metadata, are retried when they fail transiently.
+	RetryPolicy RetryPolicy
+
+	// HTTPClient is the client with which requests to the IDP, such as
+	// fetching its metadata, are made, e.g. to set timeouts or a proxy, or
+	// to intercept them in tests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// AcceptRedirectBinding causes ParseResponse to also accept responses
+	// sent to the ACS with the HTTP-Redirect binding, i.e. DEFLATE
+	// compressed in the SAMLResponse query parameter of a GET. SAML does
+	// not allow this, but some IDPs do it anyway. Such responses are
+	// validated like any other, so their assertions must carry an XML
+	// signature: a signature in the query string is not checked.
+	AcceptRedirectBinding bool
+
+	// RedirectCompressionLevel is the compress/flate level with which
+	// requests sent with the HTTP-Redirect binding are deflated, e.g.
+	// flate.BestCompression for IDPs that limit the length of URLs, or
+	// flate.BestSpeed. If zero, flate.DefaultCompression is used.
+	RedirectCompressionLevel int
+
+	// MaxIssueDelay is the longest allowed time between when a response or
+	// assertion is issued by the IDP and when ParseResponse receives it. If
+	// zero, the package level MaxIssueDelay is used.
+	MaxIssueDelay time.Duration
+
+	// MaxClockSkew is how far the clock of the IDP may be ahead of ours:
+	// ParseResponse accepts a response or assertion whose IssueInstant, or
+	// NotBefore, is up to MaxClockSkew in the future. If zero,
+	// MaxIssueDelay is used.
+	MaxClockSkew time.Duration
+
+	// ReplayCache, if set, makes ParseResponse reject assertions that it has
+	// already accepted. Assertions with a OneTimeUse condition are checked
+	// regardless, against DefaultReplayCache if ReplayCache is nil.
+	ReplayCache ReplayCache
+
+	// SubjectConfirmationMethods are the subject confirmation methods that
+	// ParseResponse accepts. If empty, only BearerConfirmationMethod is
+	// accepted, as the Web Browser SSO profile requires. Holder-of-key
+	// deployments, which check the confirmation themselves, can add
+	// HolderOfKeyConfirmationMethod.
+	SubjectConfirmationMethods []string
+
+	// WantNameID makes ParseResponse reject assertions whose Subject has no
+	// NameID, e.g. for applications that key their users on it.
+	WantNameID bool
+
+	// RequiredNameIDFormat, if set, makes ParseResponse reject assertions
+	// whose NameID is missing or has another format, e.g. a transient
+	// identifier where PersistentNameIDFormat is required. It implies
+	// WantNameID.
+	RequiredNameIDFormat string
+
+	// SPNameQualifier, if set, is sent in the NameIDPolicy of authentication
+	// requests, asking the IDP to scope persistent identifiers to it, and
+	// makes ParseResponse reject assertions whose NameID has another
+	// SPNameQualifier. A NameID without one is given SPNameQualifier, so
+	// that MakeLogoutRequestForNameID sends it back to the IDP.
+	SPNameQualifier string
+
+	// NameIDFormats are the name identifier formats advertised in the
+	// metadata as supported, in order of preference. If empty,
+	// UnspecifiedNameIDFormat is advertised.
+	NameIDFormats []string
+
+	// RequestedAttributes, if not empty, are advertised in an
+	// AttributeConsumingService of the metadata, so that the IDP knows to
+	// release them. ServiceName is the name of the service in it; if empty,
+	// MetadataURL is used.
+	RequestedAttributes []RequestedAttribute
+	ServiceName         string
+
+	// UIInfo, if set, is advertised in the Extensions of the metadata, so
+	// that discovery services and IDPs can show our name and logo to the
+	// user.
+	UIInfo *UIInfo
+
+	// MetadataValidDuration is how long from now the metadata returned by
+	// Metadata is declared valid for, in its validUntil attribute. If zero,
+	// DefaultValidDuration is used.
+	MetadataValidDuration time.Duration
+
+	// MetadataCacheDuration, if non-zero, is set as the cacheDuration of the
+	// metadata, i.e. how long the IDP may cache it before fetching it again.
+	MetadataCacheDuration time.Duration
+
+	// InsecureSkipSignatureValidation disables all checking of XML
+	// signatures in ParseResponse. The conditions in the assertion are
+	// still validated. This is only meant for development against test
+	// IDPs that cannot sign, and a warning is logged every time a response
+	// is accepted this way. Never set this in production: anyone can then
+	// forge an assertion for any user.
+	InsecureSkipSignatureValidation bool
+
+	// StrictXML makes ParseResponse reject responses and assertions whose
+	// XML structure SAML does not allow, e.g. a DTD or two equal IDs.
+	StrictXML bool
+
+	// RequireSignedIssuer makes ParseResponse reject a response whose
+	// Issuer is neither signed nor that of its signed assertion.
+	RequireSignedIssuer bool
+
+	// RejectExpiredMetadata makes ParseResponse reject all responses with a
+	// MetadataExpiredError once the validUntil of IDPMetadata has passed,
+	// e.g. because refreshing it keeps failing, rather than go on trusting
+	// the keys in it. It is off by default so that logins keep working.
+	RejectExpiredMetadata bool
+
+	// MinRSAKeySize and MinECKeySize, if non-zero, are the smallest key
+	// sizes in bits, e.g. 2048 and 256, of the IDP signing certificate that
+	// ParseResponse trusts. Responses are rejected with a WeakKeyError
+	// when the certificate in IDPMetadata has a smaller key, or one of
+	// another type, before any signature is checked.
+	MinRSAKeySize int
+	MinECKeySize  int
+
+	// VerifyIDPCertificateChain makes the signing certificates in
+	// IDPMetadata trust anchors for a certificate in the signature KeyInfo.
+	VerifyIDPCertificateChain bool
+
+	// MaxAttributes, MaxAttributeValues and MaxAttributeBytes limit the
+	// number of attributes in an assertion, the number of values of each
+	// attribute and the total length of all the values, so that an IDP
+	// cannot make us handle, or samlsp put into the session cookie, an
+	// unbounded amount of data. Assertions that exceed a limit are rejected
+	// with an AttributeLimitError. Each limit that is zero takes its value
+	// from DefaultMaxAttributes, DefaultMaxAttributeValues or
+	// DefaultMaxAttributeBytes.
+	MaxAttributes      int
+	MaxAttributeValues int
+	MaxAttributeBytes  int
+
+	// MaxMessageSize limits the size of a response once it is decoded,
+	// i.e. after base64 decoding and, for the HTTP-Redirect binding,
+	// inflation, and so the size of the request body that carries it to
+	// twice that, to allow for its encoding. A larger response is rejected
+	// with a MessageTooLargeError before it is parsed, let alone its
+	// signature checked. If zero, DefaultMaxMessageSize is used.
+	MaxMessageSize int
+
+	// RequiredAttributes are the Names or FriendlyNames of attributes
+	// without which a login is of no use to us, e.g. the user's mail
+	// address. Assertions that lack a non-empty value for any of them are
+	// rejected with a MissingAttributeError.
+	RequiredAttributes []string
+
+	// AcceptedAuthnContexts, if not empty, are the AuthnContextClassRefs
+	// with which a login is accepted, e.g. only multi-factor ones.
+	// Assertions whose AuthnStatement has another, or none, are rejected
+	// with an AuthnContextError. MakeAuthenticationRequest asks the IDP for
+	// one of them, unless it is given WithAuthnContext, e.g. for a step-up
+	// to a context that is stronger still.
+	AcceptedAuthnContexts []string
+
+	// PostTemplate, if not nil, renders the HTML form that sends requests
+	// with the HTTP-POST binding, e.g. to brand the page or to show a
+	// spinner while it submits itself, in MakePostAuthenticationRequest and
+	// wherever samlsp posts a request. See PostFormData for what it is
+	// executed with. By default a plain form is rendered.
+	PostTemplate *template.Template
+}
+
+// EndpointPaths are the paths of the endpoints of a ServiceProvider below
+// the base URL of the service. See NewServiceProvider.
+type EndpointPaths struct {
+	Metadata string
+	Acs      string
+
+	// Slo, if not empty, is the path of the back-channel Single Logout
+	// Service. See ServiceProvider.SloURL.
+	Slo string
+}
+
+// DefaultEndpointPaths are the paths at which samlsp serves the endpoints.
+// samlsp only serves Slo if the Middleware has a SessionStore; without one,
+// clear Slo lest the metadata advertise an endpoint that is not served.
+var DefaultEndpointPaths = EndpointPaths{
+	Metadata: "/saml/metadata",
+	Acs:      "/saml/acs",
+	Slo:      "/saml/slo",
+}
+
+// NewServiceProvider returns a ServiceProvider for the service at baseURL,
+// whose MetadataURL, which is also its EntityID, AcsURL and, if paths.Slo
+// is set, SloURL are baseURL with the paths appended. Deriving them all
+// from one URL keeps the endpoints that the metadata advertises consistent
+// with the EntityID and with each other. WantAssertionsSigned is set. The
+// other fields, e.g. Key and IDPMetadata, are left for the caller to set.
+func NewServiceProvider(baseURL string, paths EndpointPaths) (*ServiceProvider, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse base URL: %s", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("base URL %q is not absolute", baseURL)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("base URL %q has a query or fragment", baseURL)
+	}
+	if !strings.HasPrefix(paths.Metadata, "/") || !strings.HasPrefix(paths.Acs, "/") ||
+		(paths.Slo != "" && !strings.HasPrefix(paths.Slo, "/")) {
+		return nil, fmt.Errorf("endpoint paths %q, %q and %q do not all start with /", paths.Metadata, paths.Acs, paths.Slo)
+	}
+	if paths.Metadata == paths.Acs || paths.Metadata == paths.Slo || paths.Acs == paths.Slo {
+		return nil, fmt.Errorf("endpoint paths %q, %q and %q are not distinct", paths.Metadata, paths.Acs, paths.Slo)
+	}
+
+	base := strings.TrimSuffix(u.String(), "/")
+	sp := &ServiceProvider{
+		MetadataURL:          base + paths.Metadata,
+		AcsURL:               base + paths.Acs,
+		WantAssertionsSigned: true,
+	}
+	if paths.Slo != "" {
+		sp.SloURL = base + paths.Slo
+	}
+	return sp, nil
+}
+
+// KeyPair is an RSA private key and the corresponding x509 certificate in
+// base64-d DER format.
+type KeyPair struct {
+	Key         *rsa.PrivateKey
+	Certificate string
 }
 
 // MaxIssueDelay is the longest allowed time between when a SAML assertion is
@@ -56,60 +375,289 @@ type ServiceProvider struct {
 // this is the maximum allowed clock drift between the SP and the IDP).
 const MaxIssueDelay = time.Second * 90
 
+// DefaultMaxAttributes, DefaultMaxAttributeValues and
+// DefaultMaxAttributeBytes are the limits on the attributes of an assertion
+// used when the corresponding fields of ServiceProvider are zero. They are
+// well beyond what IDPs send in practice.
+const (
+	DefaultMaxAttributes      = 500
+	DefaultMaxAttributeValues = 1000
+	DefaultMaxAttributeBytes  = 1 << 20
+)
+
+// DefaultMaxMessageSize is the limit on the size of a decoded response used
+// when ServiceProvider.MaxMessageSize is zero, and by DecodeMessage.
+const DefaultMaxMessageSize = 4 << 20
+
+// maxMessageSize returns sp.MaxMessageSize, or the default if it is not
+// set.
+func (sp *ServiceProvider) maxMessageSize() int {
+	if sp.MaxMessageSize == 0 {
+		return DefaultMaxMessageSize
+	}
+	return sp.MaxMessageSize
+}
+
+// maxIssueDelay returns sp.MaxIssueDelay, or the default if it is not set.
+func (sp *ServiceProvider) maxIssueDelay() time.Duration {
+	if sp.MaxIssueDelay == 0 {
+		return MaxIssueDelay
+	}
+	return sp.MaxIssueDelay
+}
+
+// maxClockSkew returns sp.MaxClockSkew, or sp.maxIssueDelay() if it is not
+// set.
+func (sp *ServiceProvider) maxClockSkew() time.Duration {
+	if sp.MaxClockSkew == 0 {
+		return sp.maxIssueDelay()
+	}
+	return sp.MaxClockSkew
+}
+
+// UnspecifiedNameIDFormat is the name identifier format that leaves the
+// choice of format to the IDP.
+const UnspecifiedNameIDFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+
+// Name identifier formats that identify the user with an opaque identifier
+// that is, respectively, stable across sessions and only valid for one.
+const (
+	PersistentNameIDFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	TransientNameIDFormat  = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+)
+
+// Subject confirmation methods, see section 3 of
+// http://docs.oasis-open.org/security/saml/v2.0/saml-profiles-2.0-os.pdf
+const (
+	BearerConfirmationMethod        = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	HolderOfKeyConfirmationMethod   = "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key"
+	SenderVouchesConfirmationMethod = "urn:oasis:names:tc:SAML:2.0:cm:sender-vouches"
+)
+
 // DefaultValidDuration is how long we assert that the SP metadata is valid.
 const DefaultValidDuration = time.Hour * 24 * 2
 
 // DefaultCacheDuration is how long we ask the IDP to cache the SP metadata.
 const DefaultCacheDuration = time.Hour * 24 * 1
 
+// acsBinding is the binding with which our assertion consumer services are
+// advertised in the metadata.
+const acsBinding = HTTPPostBinding
+
 // Metadata returns the service provider metadata
 func (sp *ServiceProvider) Metadata() *Metadata {
+	keyDescriptors := []KeyDescriptor{}
+	for i, keyPair := range sp.keyPairs() {
+		signingKeyName, encryptionKeyName := "", ""
+		if i == 0 {
+			signingKeyName, encryptionKeyName = sp.KeyName, sp.KeyName
+		}
+		encryptionCertificate := keyPair.Certificate
+		if i == 0 && sp.EncryptionCertificate != "" {
+			encryptionCertificate = sp.EncryptionCertificate
+			encryptionKeyName = ""
+		}
+		keyDescriptors = append(keyDescriptors,
+			KeyDescriptor{
+				Use: "signing",
+				KeyInfo: KeyInfo{
+					KeyName:     signingKeyName,
+					Certificate: keyPair.Certificate,
+				},
+			},
+			KeyDescriptor{
+				Use: "encryption",
+				KeyInfo: KeyInfo{
+					KeyName:     encryptionKeyName,
+					Certificate: encryptionCertificate,
+				},
+				EncryptionMethods: []EncryptionMethod{
+					{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes128-cbc"},
+					{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes192-cbc"},
+					{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes256-cbc"},
+					{Algorithm: "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"},
+				},
+			})
+	}
+
+	nameIDFormats := sp.NameIDFormats
+	if len(nameIDFormats) == 0 {
+		nameIDFormats = []string{UnspecifiedNameIDFormat}
+	}
+
+	validDuration := DefaultValidDuration
+	if sp.MetadataValidDuration != 0 {
+		validDuration = sp.MetadataValidDuration
+	}
+
+	var attributeConsumingServices []AttributeConsumingService
+	if len(sp.RequestedAttributes) > 0 {
+		serviceName := sp.ServiceName
+		if serviceName == "" {
+			serviceName = sp.MetadataURL
+		}
+		attributeConsumingServices = []AttributeConsumingService{{
+			Index:              1,
+			IsDefault:          true,
+			ServiceName:        []LocalizedName{{Lang: "en", Value: serviceName}},
+			RequestedAttribute: sp.RequestedAttributes,
+		}}
+	}
+
+	assertionConsumerServices := []IndexedEndpoint{}
+	for i, acsURL := range sp.acsURLs() {
+		assertionConsumerServices = append(assertionConsumerServices, IndexedEndpoint{
+			Binding:  acsBinding,
+			Location: acsURL,
+			Index:    i + 1,
+		})
+	}
+
+	var singleLogoutServices []Endpoint
+	if sp.SloURL != "" {
+		singleLogoutServices = []Endpoint{{Binding: SOAPBinding, Location: sp.SloURL}}
+	}
+
+	var extensions *MetadataExtensions
+	if sp.UIInfo != nil {
+		extensions = &MetadataExtensions{UIInfo: sp.UIInfo}
+	}
+
 	return &Metadata{
-		EntityID:   sp.MetadataURL,
-		ValidUntil: TimeNow().Add(DefaultValidDuration),
+		EntityID:      sp.MetadataURL,
+		ValidUntil:    TimeNow().Add(validDuration),
+		CacheDuration: sp.MetadataCacheDuration,
 		SPSSODescriptor: &SPSSODescriptor{
 			AuthnRequestsSigned:        sp.AuthnRequestsSigned,
 			WantAssertionsSigned:       sp.WantAssertionsSigned,
 			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
-			KeyDescriptor: []KeyDescriptor{
-				{
-					Use: "signing",
-					KeyInfo: KeyInfo{
-						Certificate: sp.Certificate,
-					},
-				},
-				{
-					Use: "encryption",
-					KeyInfo: KeyInfo{
-						Certificate: sp.Certificate,
-					},
-					EncryptionMethods: []EncryptionMethod{
-						{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes128-cbc"},
-						{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes192-cbc"},
-						{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes256-cbc"},
-						{Algorithm: "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"},
-					},
-				},
-			},
-			AssertionConsumerService: []IndexedEndpoint{{
-				Binding:  HTTPPostBinding,
-				Location: sp.AcsURL,
-				Index:    1,
-			}},
+			Extensions:                 extensions,
+			KeyDescriptor:              keyDescriptors,
+			SingleLogoutService:        singleLogoutServices,
+			NameIDFormat:               nameIDFormats,
+			AssertionConsumerService:   assertionConsumerServices,
+			AttributeConsumingService:  attributeConsumingServices,
 		},
 	}
 }
 
+// MarshalMetadata returns the service provider metadata as XML, for
+// serving or publishing it other than through samlsp.Middleware.
+func (sp *ServiceProvider) MarshalMetadata() ([]byte, error) {
+	if err := sp.checkMetadataSettings(); err != nil {
+		return nil, err
+	}
+	return xml.MarshalIndent(sp.Metadata(), "", "  ")
+}
+
+// MarshalMetadataJSON is like MarshalMetadata, but returns the metadata as
+// JSON, e.g. for tooling that diffs it. The JSON is not SAML and IDPs do
+// not understand it; Metadata can be read back from it with
+// encoding/json.
+func (sp *ServiceProvider) MarshalMetadataJSON() ([]byte, error) {
+	if err := sp.checkMetadataSettings(); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(sp.Metadata(), "", "  ")
+}
+
+// checkMetadataSettings returns an error if the metadata cannot be made
+// from the settings of sp.
+func (sp *ServiceProvider) checkMetadataSettings() error {
+	if sp.MetadataURL == "" {
+		return fmt.Errorf("cannot marshal metadata: MetadataURL is not set")
+	}
+	if sp.AcsURL == "" {
+		return fmt.Errorf("cannot marshal metadata: AcsURL is not set")
+	}
+	if sp.MetadataValidDuration < 0 || sp.MetadataCacheDuration < 0 {
+		return fmt.Errorf("cannot marshal metadata: negative MetadataValidDuration or MetadataCacheDuration")
+	}
+	return nil
+}
+
+// SetTLSCertificate sets Key, Certificate and CertificateChain from cert,
+// e.g. as loaded by tls.LoadX509KeyPair, whose first certificate is the
+// leaf. Only RSA keys are supported.
+func (sp *ServiceProvider) SetTLSCertificate(cert tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return fmt.Errorf("TLS certificate has no certificates")
+	}
+	key, ok := cert.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("unsupported private key type %T, only RSA keys are supported", cert.PrivateKey)
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("cannot parse certificate: %s", err)
+		}
+	}
+	if pub, ok := leaf.PublicKey.(*rsa.PublicKey); !ok || pub.N.Cmp(key.N) != 0 || pub.E != key.E {
+		return fmt.Errorf("certificate does not match the key")
+	}
+
+	sp.Key = key
+	sp.Certificate = base64.StdEncoding.EncodeToString(cert.Certificate[0])
+	sp.CertificateChain = nil
+	for _, intermediate := range cert.Certificate[1:] {
+		sp.CertificateChain = append(sp.CertificateChain, base64.StdEncoding.EncodeToString(intermediate))
+	}
+	return nil
+}
+
+// keyPairs returns the primary key pair followed by sp.AdditionalKeys.
+func (sp *ServiceProvider) keyPairs() []KeyPair {
+	return append([]KeyPair{{Key: sp.Key, Certificate: sp.Certificate}}, sp.AdditionalKeys...)
+}
+
+// Keys returns the primary key followed by the keys in sp.AdditionalKeys.
+func (sp *ServiceProvider) Keys() []*rsa.PrivateKey {
+	keys := []*rsa.PrivateKey{}
+	for _, keyPair := range sp.keyPairs() {
+		keys = append(keys, keyPair.Key)
+	}
+	return keys
+}
+
+// decrypt decrypts cipher with the first of our keys that works. If the
+// EncryptedKey of cipher names the certificate of one of our keys as its
+// recipient, only that key is tried, otherwise all of them are, starting
+// with EncryptionKey.
+func (sp *ServiceProvider) decrypt(ctx context.Context, cipher string) (string, error) {
+	var plaintext string
+	err := fmt.Errorf("no key to decrypt with")
+	for _, key := range sp.decryptionKeys(cipher) {
+		plaintext, err = xmlsec.DecryptWithOptions(ctx, cipher, key, xmlsec.DecryptOptions{
+			AllowRSA15: sp.AllowRSA15KeyTransport,
+		})
+		if err == nil {
+			return plaintext, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+	}
+	return "", err
+}
+
 // MakeRedirectAuthenticationRequest creates a SAML authentication request using
 // the HTTP-Redirect binding. It returns a URL that we will redirect the user to
-// in order to start the auth process.
-func (sp *ServiceProvider) MakeRedirectAuthenticationRequest(relayState string) (*url.URL, error) {
-	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(HTTPRedirectBinding))
+// in order to start the auth process. opts customize the request as for
+// MakeAuthenticationRequest.
+func (sp *ServiceProvider) MakeRedirectAuthenticationRequest(relayState string, opts ...AuthnRequestOption) (*url.URL, error) {
+	ssoURL := sp.GetSSOBindingLocation(HTTPRedirectBinding)
+	if ssoURL == "" {
+		return nil, fmt.Errorf("IDP metadata does not contain a SingleSignOnService with the %s binding", HTTPRedirectBinding)
+	}
+	req, err := sp.MakeAuthenticationRequest(ssoURL, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	redirect, err := req.Redirect(relayState)
+	redirect, err := sp.AuthnRequestRedirect(req, relayState)
 	if err != nil {
 		return nil, err
 	}
@@ -117,22 +665,81 @@ func (sp *ServiceProvider) MakeRedirectAuthenticationRequest(relayState string)
 	return redirect, nil
 }
 
+// AuthnRequestRedirect returns a URL that carries req with the
+// HTTP-Redirect binding, deflated with RedirectCompressionLevel. If
+// AuthnRequestsSigned is set, the request is signed as the binding
+// requires, see AuthnRequest.RedirectSignedWith, with SignatureMethod, or
+// xmlsec.RSASHA256 if it is empty, rather than with an XML signature.
+func (sp *ServiceProvider) AuthnRequestRedirect(req *AuthnRequest, relayState string) (*url.URL, error) {
+	unsigned := *req
+	unsigned.Signature = nil
+	return sp.redirect(req.Destination, &unsigned, relayState)
+}
+
+// LogoutRequestRedirect is like AuthnRequestRedirect, but for a logout
+// request.
+func (sp *ServiceProvider) LogoutRequestRedirect(req *LogoutRequest, relayState string) (*url.URL, error) {
+	unsigned := *req
+	unsigned.Signature = nil
+	return sp.redirect(req.Destination, &unsigned, relayState)
+}
+
+// redirect returns a URL to destination that carries req with the
+// HTTP-Redirect binding, signed if AuthnRequestsSigned is set.
+func (sp *ServiceProvider) redirect(destination string, req interface{}, relayState string) (*url.URL, error) {
+	if !sp.AuthnRequestsSigned {
+		return redirectRequest(destination, req, relayState, sp.RedirectCompressionLevel)
+	}
+	signatureMethod := sp.SignatureMethod
+	if signatureMethod == "" {
+		// xmlsec.DefaultSignature is RSA-SHA1, which we don't sign
+		// redirects with
+		signatureMethod = xmlsec.RSASHA256
+	}
+	return signedRedirectRequest(destination, req, relayState, sp.Key, signatureMethod, sp.RedirectCompressionLevel)
+}
+
 // Redirect returns a URL suitable for using the redirect binding with the request
 func (req *AuthnRequest) Redirect(relayState string) (*url.URL, error) {
+	return redirectRequest(req.Destination, req, relayState, flate.DefaultCompression)
+}
 
-	w := &bytes.Buffer{}
-	w1 := base64.NewEncoder(base64.StdEncoding, w)
-	w2, _ := flate.NewWriter(w1, 9)
-	if err := xml.NewEncoder(w2).Encode(req); err != nil {
+// RedirectWithCompression is like Redirect, but deflates the request with
+// the compress/flate level, or flate.DefaultCompression if level is zero.
+func (req *AuthnRequest) RedirectWithCompression(relayState string, level int) (*url.URL, error) {
+	return redirectRequest(req.Destination, req, relayState, level)
+}
+
+// RedirectSigned is like Redirect, but signs the request with key as the
+// redirect binding requires: rather than an XML signature, which is dropped
+// from the request, the SigAlg and Signature parameters carry an RSA-SHA256
+// signature of the URL encoded SAMLRequest, RelayState and SigAlg
+// parameters, in that order.
+func (req *AuthnRequest) RedirectSigned(relayState string, key *rsa.PrivateKey) (*url.URL, error) {
+	return req.RedirectSignedWith(relayState, key, xmlsec.RSASHA256)
+}
+
+// RedirectSignedWith is like RedirectSigned, but signs with signatureMethod,
+// one of xmlsec.RSASHA256, xmlsec.RSASHA512, xmlsec.RSAPSSSHA256 and
+// xmlsec.RSAPSSSHA512.
+func (req *AuthnRequest) RedirectSignedWith(relayState string, key *rsa.PrivateKey, signatureMethod string) (*url.URL, error) {
+	unsigned := *req
+	unsigned.Signature = nil
+	return signedRedirectRequest(req.Destination, &unsigned, relayState, key, signatureMethod, flate.DefaultCompression)
+}
+
+// redirectRequest returns a URL to destination that carries req, deflated
+// with level, as the SAMLRequest parameter of the redirect binding.
+func redirectRequest(destination string, req interface{}, relayState string, level int) (*url.URL, error) {
+	samlRequest, err := deflateRequest(req, level)
+	if err != nil {
 		return nil, err
 	}
-	w2.Close()
-	w1.Close()
 
-	rv, _ := url.Parse(req.Destination)
+	rv, _ := url.Parse(destination)
 
 	query := rv.Query()
-	query.Set("SAMLRequest", string(w.Bytes()))
+	query.Set("SAMLRequest", samlRequest)
 	if relayState != "" {
 		query.Set("RelayState", relayState)
 	}
@@ -141,8 +748,91 @@ func (req *AuthnRequest) Redirect(relayState string) (*url.URL, error) {
 	return rv, nil
 }
 
+// signedRedirectRequest is like redirectRequest, but adds the SigAlg and
+// Signature parameters, signing with key using signatureMethod. The
+// signature covers the SAML parameters exactly as they appear in the URL,
+// so unlike redirectRequest it writes them in the order of the binding
+// specification, after any query of destination.
+func signedRedirectRequest(destination string, req interface{}, relayState string, key *rsa.PrivateKey, signatureMethod string, level int) (*url.URL, error) {
+	if key == nil {
+		return nil, fmt.Errorf("no key to sign the request with")
+	}
+	hash, pss := crypto.Hash(0), false
+	switch signatureMethod {
+	case xmlsec.RSASHA256:
+		hash = crypto.SHA256
+	case xmlsec.RSASHA512:
+		hash = crypto.SHA512
+	case xmlsec.RSAPSSSHA256:
+		hash, pss = crypto.SHA256, true
+	case xmlsec.RSAPSSSHA512:
+		hash, pss = crypto.SHA512, true
+	default:
+		return nil, fmt.Errorf("unsupported signature method %q", signatureMethod)
+	}
+	samlRequest, err := deflateRequest(req, level)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := "SAMLRequest=" + url.QueryEscape(samlRequest)
+	if relayState != "" {
+		signed += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	signed += "&SigAlg=" + url.QueryEscape(signatureMethod)
+	var digest []byte
+	if hash == crypto.SHA512 {
+		sum := sha512.Sum512([]byte(signed))
+		digest = sum[:]
+	} else {
+		sum := sha256.Sum256([]byte(signed))
+		digest = sum[:]
+	}
+	var signature []byte
+	if pss {
+		signature, err = rsa.SignPSS(RandReader, key, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	} else {
+		signature, err = rsa.SignPKCS1v15(RandReader, key, hash, digest)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rv, err := url.Parse(destination)
+	if err != nil {
+		return nil, err
+	}
+	if rv.RawQuery != "" {
+		rv.RawQuery += "&"
+	}
+	rv.RawQuery += signed + "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+	return rv, nil
+}
+
+// deflateRequest returns req deflated with level, or
+// flate.DefaultCompression if level is zero, and base64 encoded, as the
+// redirect binding carries it.
+func deflateRequest(req interface{}, level int) (string, error) {
+	if level == flate.NoCompression {
+		level = flate.DefaultCompression
+	}
+	w := &bytes.Buffer{}
+	w1 := base64.NewEncoder(base64.StdEncoding, w)
+	w2, err := flate.NewWriter(w1, level)
+	if err != nil {
+		return "", err
+	}
+	if err := xml.NewEncoder(w2).Encode(req); err != nil {
+		return "", err
+	}
+	w2.Close()
+	w1.Close()
+	return w.String(), nil
+}
+
 // GetSSOBindingLocation returns URL for the IDP's Single Sign On Service binding
-// of the specified type (HTTPRedirectBinding or HTTPPostBinding)
+// of the specified type (HTTPRedirectBinding or HTTPPostBinding), or an empty
+// string if the IDP does not advertise one.
 func (sp *ServiceProvider) GetSSOBindingLocation(binding string) string {
 	for _, singleSignOnService := range sp.IDPMetadata.IDPSSODescriptor.SingleSignOnService {
 		if singleSignOnService.Binding == binding {
@@ -152,6 +842,18 @@ func (sp *ServiceProvider) GetSSOBindingLocation(binding string) string {
 	return ""
 }
 
+// GetSLOBindingLocation returns URL for the IDP's Single Logout Service binding
+// of the specified type (HTTPRedirectBinding or HTTPPostBinding), or an empty
+// string if the IDP does not advertise one.
+func (sp *ServiceProvider) GetSLOBindingLocation(binding string) string {
+	for _, singleLogoutService := range sp.IDPMetadata.IDPSSODescriptor.SingleLogoutService {
+		if singleLogoutService.Binding == binding {
+			return singleLogoutService.Location
+		}
+	}
+	return ""
+}
+
 // getIDPSigningCert returns the certificate which we can use to verify things
 // signed by the IDP in PEM format, or nil if no such certificate is found.
 func (sp *ServiceProvider) getIDPSigningCert() []byte {
@@ -175,6 +877,91 @@ func (sp *ServiceProvider) getIDPSigningCert() []byte {
 		}
 	}
 
+	return certificatePEM(cert)
+}
+
+// getIDPSigningCertFor returns the certificate which we can use to verify
+// signature in PEM format. A signature that names its key with a KeyName
+// rather than carrying the certificate is verified with the signing
+// certificate of that name in the IDP metadata; otherwise, or if the
+// metadata names no such certificate, getIDPSigningCert is used.
+func (sp *ServiceProvider) getIDPSigningCertFor(signature *xmlsec.Signature) []byte {
+	if signature != nil && signature.KeyName != "" {
+		for _, keyDescriptor := range sp.IDPMetadata.IDPSSODescriptor.KeyDescriptor {
+			if keyDescriptor.Use != "signing" && keyDescriptor.Use != "" {
+				continue
+			}
+			if keyDescriptor.KeyInfo.KeyName == signature.KeyName && keyDescriptor.KeyInfo.Certificate != "" {
+				return certificatePEM(keyDescriptor.KeyInfo.Certificate)
+			}
+		}
+	}
+	return sp.getIDPSigningCert()
+}
+
+// idpSigningCertFor is getIDPSigningCertFor, except that with
+// VerifyIDPCertificateChain it returns the certificate in the KeyInfo of
+// signature, if any, once it has checked that it chains to a signing
+// certificate in IDPMetadata. Either way it returns a WeakKeyError if the
+// key of the certificate is too small, see checkSigningKey.
+func (sp *ServiceProvider) idpSigningCertFor(signature *xmlsec.Signature) ([]byte, error) {
+	if !sp.VerifyIDPCertificateChain || signature == nil || signature.X509Certificate == nil ||
+		len(signature.X509Certificate.X509Certificates) == 0 {
+		certPEM := sp.getIDPSigningCertFor(signature)
+		if block, _ := pem.Decode(certPEM); block != nil {
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				if err := sp.checkSigningKey(cert); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return certPEM, nil
+	}
+
+	certs := make([]*x509.Certificate, len(signature.X509Certificate.X509Certificates))
+	for i, data := range signature.X509Certificate.X509Certificates {
+		block, _ := pem.Decode(certificatePEM(data))
+		if block == nil {
+			return nil, fmt.Errorf("signature has an empty certificate")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse certificate of signature: %s", err)
+		}
+		certs[i] = cert
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   TimeNow(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, keyDescriptor := range sp.IDPMetadata.IDPSSODescriptor.KeyDescriptor {
+		if keyDescriptor.Use != "signing" && keyDescriptor.Use != "" {
+			continue
+		}
+		if block, _ := pem.Decode(certificatePEM(keyDescriptor.KeyInfo.Certificate)); block != nil {
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				opts.Roots.AddCert(cert)
+			}
+		}
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return nil, fmt.Errorf("certificate of signature is not trusted: %s", err)
+	}
+	if err := sp.checkSigningKey(certs[0]); err != nil {
+		return nil, err
+	}
+	return certificatePEM(signature.X509Certificate.X509Certificates[0]), nil
+}
+
+// certificatePEM returns cert, a base64-d DER certificate from metadata, in
+// PEM format, or nil if cert is empty.
+func certificatePEM(cert string) []byte {
 	if cert == "" {
 		return nil
 	}
@@ -188,43 +975,218 @@ func (sp *ServiceProvider) getIDPSigningCert() []byte {
 	return certBytes
 }
 
-// MakeAuthenticationRequest produces a new AuthnRequest object for idpURL.
-func (sp *ServiceProvider) MakeAuthenticationRequest(idpURL string) (*AuthnRequest, error) {
-	rnd, err := randomBytes(20)
-	if err != nil {
-		return nil, err
-	}
+// AuthnRequestOption customizes an AuthnRequest made by
+// MakeAuthenticationRequest before it is signed.
+type AuthnRequestOption func(req *AuthnRequest)
 
-	req := AuthnRequest{
-		AssertionConsumerServiceURL: sp.AcsURL,
-		Destination:                 idpURL,
-		ID:                          fmt.Sprintf("id-%x", rnd),
-		IssueInstant:                TimeNow(),
-		Version:                     "2.0",
-		Issuer: Issuer{
-			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
-			Value:  sp.MetadataURL,
-		},
-		NameIDPolicy: NameIDPolicy{
-			AllowCreate: true,
-			// TODO(ross): figure out exactly policy we need
-			// urn:mace:shibboleth:1.0:nameIdentifier
-			// urn:oasis:names:tc:SAML:2.0:nameid-format:transient
-			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:transient",
-		},
+// WithForceAuthn asks the IDP to authenticate the user again, even if they
+// already have a session with it.
+func WithForceAuthn() AuthnRequestOption {
+	return func(req *AuthnRequest) {
+		req.ForceAuthn = true
 	}
+}
 
-	if !sp.AuthnRequestsSigned {
-		return &req, nil
+// WithAuthnContext asks the IDP to authenticate the user with one of the
+// authentication context classes classRefs, e.g. to require multi-factor
+// authentication. comparison is one of "exact", "minimum", "maximum" or
+// "better", or empty for "exact".
+func WithAuthnContext(comparison string, classRefs ...string) AuthnRequestOption {
+	return func(req *AuthnRequest) {
+		req.RequestedAuthnContext = &RequestedAuthnContext{Comparison: comparison}
+		for _, classRef := range classRefs {
+			req.RequestedAuthnContext.AuthnContextClassRef = append(
+				req.RequestedAuthnContext.AuthnContextClassRef,
+				AuthnContextClassRef{Value: classRef})
+		}
 	}
+}
 
-	signatureTemplate := xmlsec.DefaultSignature(sp.Certificate)
-	req.Signature = &signatureTemplate
-	req.Signature.SignedInfo.Reference.URI = "#" + req.ID
-
-	reqXml, err := xml.Marshal(&req)
-	if err != nil {
-		return nil, err
+// WithAssertionConsumerServiceIndex asks the IDP to send the response to the
+// assertion consumer service with the given index in our metadata, for a
+// service provider that advertises several. It replaces the
+// AssertionConsumerServiceURL and ProtocolBinding of the request, which
+// SAML does not allow along with an index.
+func WithAssertionConsumerServiceIndex(index int) AuthnRequestOption {
+	return func(req *AuthnRequest) {
+		req.AssertionConsumerServiceIndex = &index
+		req.AssertionConsumerServiceURL = ""
+		req.ProtocolBinding = ""
+	}
+}
+
+// WithAssertionConsumerServiceURL asks the IDP to send the response to
+// location, one of the assertion consumer services in our metadata, with
+// binding, e.g. HTTPPostBinding, or with the binding of that service if
+// binding is empty. It replaces an AssertionConsumerServiceIndex.
+func WithAssertionConsumerServiceURL(location string, binding string) AuthnRequestOption {
+	return func(req *AuthnRequest) {
+		req.AssertionConsumerServiceIndex = nil
+		req.AssertionConsumerServiceURL = location
+		req.ProtocolBinding = binding
+	}
+}
+
+// WithAllowCreate sets whether the IDP may create a new identifier for the
+// user to satisfy the NameIDPolicy of the request. It is allowed by default.
+func WithAllowCreate(allow bool) AuthnRequestOption {
+	return func(req *AuthnRequest) {
+		req.NameIDPolicy.AllowCreate = allow
+	}
+}
+
+// WithID sets the ID of the request, e.g. to embed a trace ID by which
+// the login can be found in our logs, instead of a random one. id must be
+// an XML NCName, i.e. start with a letter or underscore and contain no
+// colons or spaces, and should be unique, as the response is matched to
+// the request by it.
+func WithID(id string) AuthnRequestOption {
+	return func(req *AuthnRequest) {
+		req.ID = id
+	}
+}
+
+// WithProviderName sets the human readable name of the service provider
+// that the IDP may show to the user.
+func WithProviderName(name string) AuthnRequestOption {
+	return func(req *AuthnRequest) {
+		req.ProviderName = name
+	}
+}
+
+// WithExtensions adds elements, given as raw XML, to the Extensions of the
+// request, e.g. a login hint for an IDP that understands one. Each element
+// must be in a namespace other than SAML's that it declares itself, e.g.
+// <ext:LoginHint xmlns:ext="urn:example:ext">alice</ext:LoginHint>.
+func WithExtensions(elements ...string) AuthnRequestOption {
+	return func(req *AuthnRequest) {
+		if req.Extensions == nil {
+			req.Extensions = &Extensions{}
+		}
+		req.Extensions.XML += strings.Join(elements, "")
+	}
+}
+
+// checkExtensions returns an error unless rawXML consists of elements that
+// each declare their own, non-SAML, namespace.
+func checkExtensions(rawXML string) error {
+	d := xml.NewDecoder(strings.NewReader(rawXML))
+	depth := 0
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot parse extensions: %s", err)
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth > 1 {
+				continue
+			}
+			declared := false
+			for _, attr := range token.Attr {
+				if (attr.Name.Space == "xmlns" || attr.Name.Space == "" && attr.Name.Local == "xmlns") && attr.Value == token.Name.Space {
+					declared = true
+				}
+			}
+			if !declared {
+				return fmt.Errorf("extension %s does not declare its namespace", token.Name.Local)
+			}
+			if token.Name.Space == protocolNamespace || token.Name.Space == assertionNamespace {
+				return fmt.Errorf("extension %s is in the SAML namespace %s", token.Name.Local, token.Name.Space)
+			}
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 && len(bytes.TrimSpace(token)) > 0 {
+				return fmt.Errorf("extensions contain text outside of an element")
+			}
+		}
+	}
+	return nil
+}
+
+// isNCName returns true if s is an XML non-colonized name, as the IDs of
+// SAML messages must be.
+func isNCName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_' || unicode.IsLetter(r):
+		case i > 0 && (r == '-' || r == '.' || unicode.IsDigit(r) || unicode.Is(unicode.M, r)):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// MakeAuthenticationRequest produces a new AuthnRequest object for idpURL,
+// customized by opts.
+func (sp *ServiceProvider) MakeAuthenticationRequest(idpURL string, opts ...AuthnRequestOption) (*AuthnRequest, error) {
+	if sp.ResponseBinding != "" && sp.ResponseBinding != acsBinding {
+		return nil, fmt.Errorf("ResponseBinding %s is not the binding of our assertion consumer services", sp.ResponseBinding)
+	}
+	rnd, err := randomBytes(20)
+	if err != nil {
+		return nil, err
+	}
+
+	req := AuthnRequest{
+		AssertionConsumerServiceURL: sp.AcsURL,
+		Destination:                 idpURL,
+		ID:                          fmt.Sprintf("id-%x", rnd),
+		IssueInstant:                TimeNow(),
+		ProtocolBinding:             sp.ResponseBinding,
+		Version:                     "2.0",
+		Issuer: Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  sp.MetadataURL,
+		},
+		NameIDPolicy: NameIDPolicy{
+			AllowCreate:     true,
+			SPNameQualifier: sp.SPNameQualifier,
+			// TODO(ross): figure out exactly policy we need
+			// urn:mace:shibboleth:1.0:nameIdentifier
+			// urn:oasis:names:tc:SAML:2.0:nameid-format:transient
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:transient",
+		},
+	}
+	if len(sp.AcceptedAuthnContexts) > 0 {
+		WithAuthnContext("", sp.AcceptedAuthnContexts...)(&req)
+	}
+	for _, opt := range opts {
+		opt(&req)
+	}
+	if !isNCName(req.ID) {
+		return nil, fmt.Errorf("request ID %q is not a valid XML ID", req.ID)
+	}
+	if req.Extensions != nil {
+		if err := checkExtensions(req.Extensions.XML); err != nil {
+			return nil, err
+		}
+	}
+
+	if !sp.AuthnRequestsSigned {
+		return &req, nil
+	}
+
+	signatureTemplate, err := makeSignature(sp.CanonicalizationMethod, sp.SignatureMethod, sp.Certificate, sp.CertificateChain)
+	if err != nil {
+		return nil, err
+	}
+	req.Signature = &signatureTemplate
+	req.Signature.SignedInfo.Reference.URI = "#" + req.ID
+	req.Signature.KeyName = sp.KeyName
+
+	reqXml, err := xml.Marshal(&req)
+	if err != nil {
+		return nil, err
 	}
 
 	signedXml, err := xmlsec.SignRequest(string(reqXml), sp.Key)
@@ -242,14 +1204,19 @@ func (sp *ServiceProvider) MakeAuthenticationRequest(idpURL string) (*AuthnReque
 
 // MakePostAuthenticationRequest creates a SAML authentication request using
 // the HTTP-POST binding. It returns HTML text representing an HTML form that
-// can be sent presented to a browser to initiate the login process.
-func (sp *ServiceProvider) MakePostAuthenticationRequest(relayState string) ([]byte, error) {
-	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(HTTPPostBinding))
+// can be sent presented to a browser to initiate the login process. opts
+// customize the request as for MakeAuthenticationRequest.
+func (sp *ServiceProvider) MakePostAuthenticationRequest(relayState string, opts ...AuthnRequestOption) ([]byte, error) {
+	ssoURL := sp.GetSSOBindingLocation(HTTPPostBinding)
+	if ssoURL == "" {
+		return nil, fmt.Errorf("IDP metadata does not contain a SingleSignOnService with the %s binding", HTTPPostBinding)
+	}
+	req, err := sp.MakeAuthenticationRequest(ssoURL, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	post, err := req.Post(relayState)
+	post, err := req.PostWith(relayState, sp.PostTemplate)
 	if err != nil {
 		return nil, err
 	}
@@ -259,27 +1226,93 @@ func (sp *ServiceProvider) MakePostAuthenticationRequest(relayState string) ([]b
 
 // Post returns an HTML form suitable for using the HTTP-POST binding with the request
 func (req *AuthnRequest) Post(relayState string) ([]byte, error) {
+	return postRequest(nil, req.Destination, req, relayState, "")
+}
+
+// PostWith is like Post, but renders the form with tmpl, unless it is nil.
+// See ServiceProvider.PostTemplate.
+func (req *AuthnRequest) PostWith(relayState string, tmpl *template.Template) ([]byte, error) {
+	return postRequest(tmpl, req.Destination, req, relayState, "")
+}
+
+// WritePost writes the form returned by Post to w, in a page whose
+// Content-Security-Policy only allows the script that submits the form. See
+// writePostRequest.
+func (req *AuthnRequest) WritePost(w http.ResponseWriter, relayState string) error {
+	return writePostRequest(w, nil, req.Destination, req, relayState)
+}
+
+// WritePostWith is like WritePost, but renders the form with tmpl, unless
+// it is nil.
+func (req *AuthnRequest) WritePostWith(w http.ResponseWriter, relayState string, tmpl *template.Template) error {
+	return writePostRequest(w, tmpl, req.Destination, req, relayState)
+}
+
+// PostFormData is what the template of the HTML form of the HTTP-POST
+// binding is executed with, see ServiceProvider.PostTemplate and
+// IdentityProvider.PostTemplate. The form must post SAMLRequest or
+// SAMLResponse, whichever is not empty, and RelayState as hidden fields of
+// those names to URL. It should submit itself with a script, and offer a
+// submit button for browsers that do not run it. If Nonce is not empty, the
+// Content-Security-Policy of the page only allows scripts whose nonce
+// attribute is Nonce.
+type PostFormData struct {
+	URL          string
+	SAMLRequest  string
+	SAMLResponse string
+	RelayState   string
+	Nonce        string
+}
+
+// defaultRequestPostTemplate renders the form of a request when no
+// PostTemplate is given.
+var defaultRequestPostTemplate = template.Must(template.New("saml-post-form").Parse(`` +
+	`<form method="post" action="{{.URL}}" id="SAMLRequestForm">` +
+	`<input type="hidden" name="SAMLRequest" value="{{.SAMLRequest}}" />` +
+	`<input type="hidden" name="RelayState" value="{{.RelayState}}" />` +
+	`<input type="submit" value="Submit" />` +
+	`</form>` +
+	`<script{{if .Nonce}} nonce="{{.Nonce}}"{{end}}>document.getElementById('SAMLRequestForm').submit();</script>`))
+
+// writePostRequest writes the HTML form that posts req to destination to w,
+// rendered with tmpl, or the default form if it is nil, with a
+// Content-Security-Policy header that allows only the inline script
+// submitting the form, by a nonce that is new for every response. Browsers
+// that do not run the script show the form's submit button instead.
+func writePostRequest(w http.ResponseWriter, tmpl *template.Template, destination string, req interface{}, relayState string) error {
+	rnd, err := randomBytes(16)
+	if err != nil {
+		return err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(rnd)
+	post, err := postRequest(tmpl, destination, req, relayState, nonce)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Security-Policy", fmt.Sprintf("script-src 'nonce-%s'", nonce))
+	w.Header().Set("Content-Type", "text/html")
+	_, err = w.Write(post)
+	return err
+}
+
+// postRequest returns an HTML form, rendered with tmpl or the default form
+// if it is nil, that posts req to destination as the SAMLRequest parameter
+// of the HTTP-POST binding. If nonce is not empty, it is set on the script
+// that submits the form.
+func postRequest(tmpl *template.Template, destination string, req interface{}, relayState string, nonce string) ([]byte, error) {
 	reqBuf, err := xml.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
-	encodedReqBuf := base64.StdEncoding.EncodeToString(reqBuf)
-
-	tmpl := template.Must(template.New("saml-post-form").Parse(`` +
-		`<form method="post" action="{{.URL}}" id="SAMLRequestForm">` +
-		`<input type="hidden" name="SAMLRequest" value="{{.SAMLRequest}}" />` +
-		`<input type="hidden" name="RelayState" value="{{.RelayState}}" />` +
-		`<input type="submit" value="Submit" />` +
-		`</form>` +
-		`<script>document.getElementById('SAMLRequestForm').submit();</script>`))
-	data := struct {
-		URL         string
-		SAMLRequest string
-		RelayState  string
-	}{
-		URL:         req.Destination,
-		SAMLRequest: encodedReqBuf,
+
+	if tmpl == nil {
+		tmpl = defaultRequestPostTemplate
+	}
+	data := PostFormData{
+		URL:         destination,
+		SAMLRequest: base64.StdEncoding.EncodeToString(reqBuf),
 		RelayState:  relayState,
+		Nonce:       nonce,
 	}
 
 	rv := bytes.Buffer{}
@@ -290,6 +1323,119 @@ func (req *AuthnRequest) Post(relayState string) ([]byte, error) {
 	return rv.Bytes(), nil
 }
 
+// MakeLogoutRequest produces a new LogoutRequest object for idpURL that
+// ends the session of the user identified by nameID, a transient NameID.
+func (sp *ServiceProvider) MakeLogoutRequest(idpURL, nameID string) (*LogoutRequest, error) {
+	return sp.MakeLogoutRequestForNameID(idpURL, NameID{Value: nameID})
+}
+
+// MakeLogoutRequestForNameID is like MakeLogoutRequest, but takes the NameID
+// as it was in the subject of the assertion, as some IDPs reject logout
+// requests whose NameID lacks its NameQualifier and SPNameQualifier. If the
+// Format of nameID is empty, the transient format is used.
+func (sp *ServiceProvider) MakeLogoutRequestForNameID(idpURL string, nameID NameID) (*LogoutRequest, error) {
+	rnd, err := randomBytes(20)
+	if err != nil {
+		return nil, err
+	}
+	if nameID.Format == "" {
+		nameID.Format = TransientNameIDFormat
+	}
+
+	return &LogoutRequest{
+		Destination:  idpURL,
+		ID:           fmt.Sprintf("id-%x", rnd),
+		IssueInstant: TimeNow(),
+		Version:      "2.0",
+		Issuer: Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  sp.MetadataURL,
+		},
+		NameID: &nameID,
+	}, nil
+}
+
+// EncryptNameID replaces the NameID of req with an EncryptedID, encrypted to
+// cert, a PEM encoded certificate of the IDP, with method, e.g.
+// xmlsec.AES256GCM.
+func (req *LogoutRequest) EncryptNameID(cert string, method string) error {
+	if req.NameID == nil {
+		return fmt.Errorf("logout request has no NameID")
+	}
+	buf := bytes.Buffer{}
+	enc := xml.NewEncoder(&buf)
+	start := xml.StartElement{Name: xml.Name{Space: assertionNamespace, Local: "NameID"}}
+	if err := enc.EncodeElement(req.NameID, start); err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	encrypted, err := xmlsec.EncryptWithMethod(buf.String(), cert, method)
+	if err != nil {
+		return fmt.Errorf("cannot encrypt NameID: %s", err)
+	}
+	// xmlsec1 writes a document, whose XML declaration must not end up in
+	// the middle of ours.
+	if strings.HasPrefix(encrypted, "<?xml") {
+		if end := strings.Index(encrypted, "?>"); end >= 0 {
+			encrypted = strings.TrimSpace(encrypted[end+2:])
+		}
+	}
+	req.NameID = nil
+	req.EncryptedID = &EncryptedID{EncryptedData: []byte(encrypted)}
+	return nil
+}
+
+// Redirect returns a URL suitable for using the redirect binding with the request
+func (req *LogoutRequest) Redirect(relayState string) (*url.URL, error) {
+	return redirectRequest(req.Destination, req, relayState, flate.DefaultCompression)
+}
+
+// RedirectWithCompression is like Redirect, but deflates the request with
+// the compress/flate level, or flate.DefaultCompression if level is zero.
+func (req *LogoutRequest) RedirectWithCompression(relayState string, level int) (*url.URL, error) {
+	return redirectRequest(req.Destination, req, relayState, level)
+}
+
+// RedirectSigned is like Redirect, but signs the request with key as the
+// redirect binding requires. See AuthnRequest.RedirectSigned.
+func (req *LogoutRequest) RedirectSigned(relayState string, key *rsa.PrivateKey) (*url.URL, error) {
+	return req.RedirectSignedWith(relayState, key, xmlsec.RSASHA256)
+}
+
+// RedirectSignedWith is like RedirectSigned, but signs with signatureMethod.
+// See AuthnRequest.RedirectSignedWith.
+func (req *LogoutRequest) RedirectSignedWith(relayState string, key *rsa.PrivateKey, signatureMethod string) (*url.URL, error) {
+	unsigned := *req
+	unsigned.Signature = nil
+	return signedRedirectRequest(req.Destination, &unsigned, relayState, key, signatureMethod, flate.DefaultCompression)
+}
+
+// Post returns an HTML form suitable for using the HTTP-POST binding with the request
+func (req *LogoutRequest) Post(relayState string) ([]byte, error) {
+	return postRequest(nil, req.Destination, req, relayState, "")
+}
+
+// PostWith is like Post, but renders the form with tmpl, unless it is nil.
+// See ServiceProvider.PostTemplate.
+func (req *LogoutRequest) PostWith(relayState string, tmpl *template.Template) ([]byte, error) {
+	return postRequest(tmpl, req.Destination, req, relayState, "")
+}
+
+// WritePost writes the form returned by Post to w, in a page whose
+// Content-Security-Policy only allows the script that submits the form. See
+// writePostRequest.
+func (req *LogoutRequest) WritePost(w http.ResponseWriter, relayState string) error {
+	return writePostRequest(w, nil, req.Destination, req, relayState)
+}
+
+// WritePostWith is like WritePost, but renders the form with tmpl, unless
+// it is nil.
+func (req *LogoutRequest) WritePostWith(w http.ResponseWriter, relayState string, tmpl *template.Template) error {
+	return writePostRequest(w, tmpl, req.Destination, req, relayState)
+}
+
 // AssertionAttributes is a list of AssertionAttribute
 type AssertionAttributes []AssertionAttribute
 
@@ -329,6 +1475,383 @@ func (ivr *InvalidResponseError) Error() string {
 	return fmt.Sprintf("Authentication failed")
 }
 
+// DestinationMismatchError is the PrivateErr of the InvalidResponseError
+// returned by ParseResponse when the Destination of the response is not
+// our AcsURL, e.g. because a response issued to another service provider
+// is being replayed to us.
+type DestinationMismatchError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *DestinationMismatchError) Error() string {
+	return fmt.Sprintf("`Destination` does not match AcsURL (expected %q)", e.Expected)
+}
+
+// IssuerMismatchError is the PrivateErr of the InvalidResponseError
+// returned by ParseResponse when the Issuer of the response, or of the
+// assertion if InAssertion is set, is missing or not the EntityID of the IDP
+// metadata. This guards against a response that is validly signed by a key we trust,
+// but on behalf of another entity.
+type IssuerMismatchError struct {
+	Expected    string
+	Actual      string
+	InAssertion bool
+}
+
+func (e *IssuerMismatchError) Error() string {
+	what := "Issuer"
+	if e.InAssertion {
+		what = "Assertion Issuer"
+	}
+	return fmt.Sprintf("%s %q does not match the IDP metadata (expected %q)", what, e.Actual, e.Expected)
+}
+
+// ErrAssertionNotYetValid and ErrAssertionExpired are the PrivateErr of the
+// InvalidResponseError returned by ParseResponse when the time is before the
+// NotBefore or after the NotOnOrAfter of the Conditions of the assertion.
+// Unlike other failures, ErrAssertionNotYetValid usually means that the
+// clock of the IDP or ours is off, and a later login may succeed.
+var (
+	ErrAssertionNotYetValid = errors.New("Conditions is not yet valid")
+	ErrAssertionExpired     = errors.New("Conditions is expired")
+)
+
+// ErrMultipleAssertions is the PrivateErr of the InvalidResponseError
+// returned by ParseResponse for a response with more than one Assertion or
+// EncryptedAssertion. Such responses are always rejected, whether or not
+// StrictXML is set or signatures are validated: only the first assertion
+// would be looked at, and a forged assertion next to a signed one is the
+// basis of signature wrapping attacks.
+var ErrMultipleAssertions = errors.New("response contains more than one assertion")
+
+// StatusNotSuccessError is the PrivateErr of the InvalidResponseError
+// returned by ParseResponse when the IDP did not authenticate the user. Code
+// is the top-level status code, e.g. "urn:oasis:names:tc:SAML:2.0:status:Responder",
+// SubCode the optional second-level one, e.g.
+// "urn:oasis:names:tc:SAML:2.0:status:RequestDenied", and Message the
+// optional StatusMessage.
+type StatusNotSuccessError struct {
+	Code    string
+	SubCode string
+	Message string
+}
+
+// MetadataExpiredError is the PrivateErr of the InvalidResponseError
+// returned by ParseResponse when RejectExpiredMetadata is set and the IDP
+// metadata expired at ValidUntil.
+type MetadataExpiredError struct {
+	ValidUntil time.Time
+}
+
+func (e *MetadataExpiredError) Error() string {
+	return fmt.Sprintf("IDP metadata expired on %s", e.ValidUntil)
+}
+
+// checkMetadataExpiry returns a MetadataExpiredError if RejectExpiredMetadata
+// is set and the IDP metadata has expired at now.
+func (sp *ServiceProvider) checkMetadataExpiry(now time.Time) error {
+	if !sp.RejectExpiredMetadata || sp.IDPMetadata.ValidUntil.IsZero() || now.Before(sp.IDPMetadata.ValidUntil) {
+		return nil
+	}
+	return &MetadataExpiredError{ValidUntil: sp.IDPMetadata.ValidUntil}
+}
+
+// WeakKeyError is the PrivateErr of the InvalidResponseError returned by
+// ParseResponse when the IDP signing certificate has a key of Size bits,
+// fewer than the MinSize required by ServiceProvider.MinRSAKeySize or
+// MinECKeySize. Algorithm is "RSA" or "EC", or the Go type of the key if
+// it is neither.
+type WeakKeyError struct {
+	Algorithm string
+	Size      int
+	MinSize   int
+}
+
+func (e *WeakKeyError) Error() string {
+	if e.MinSize == 0 {
+		return fmt.Sprintf("IDP signing certificate has an unsupported %s key", e.Algorithm)
+	}
+	return fmt.Sprintf("IDP signing certificate has a %d bit %s key, at least %d bits are required", e.Size, e.Algorithm, e.MinSize)
+}
+
+// CheckIDPSigningKey returns a WeakKeyError if the key of any IDP signing
+// certificate is smaller than MinRSAKeySize or MinECKeySize allow, as a
+// signature may name any of them with its KeyName. It returns nil if
+// neither is set, or if IDPMetadata has no usable signing certificate,
+// which signature validation then reports.
+func (sp *ServiceProvider) CheckIDPSigningKey() error {
+	if sp.MinRSAKeySize == 0 && sp.MinECKeySize == 0 {
+		return nil
+	}
+	for _, keyDescriptor := range sp.IDPMetadata.IDPSSODescriptor.KeyDescriptor {
+		if keyDescriptor.Use != "signing" && keyDescriptor.Use != "" {
+			continue
+		}
+		block, _ := pem.Decode(certificatePEM(keyDescriptor.KeyInfo.Certificate))
+		if block == nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if err := sp.checkSigningKey(cert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSigningKey returns a WeakKeyError if the key of cert, which the IDP
+// signs with, is smaller than MinRSAKeySize or MinECKeySize allow.
+func (sp *ServiceProvider) checkSigningKey(cert *x509.Certificate) error {
+	if sp.MinRSAKeySize == 0 && sp.MinECKeySize == 0 {
+		return nil
+	}
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if size := key.N.BitLen(); size < sp.MinRSAKeySize {
+			return &WeakKeyError{Algorithm: "RSA", Size: size, MinSize: sp.MinRSAKeySize}
+		}
+	case *ecdsa.PublicKey:
+		if size := key.Curve.Params().BitSize; size < sp.MinECKeySize {
+			return &WeakKeyError{Algorithm: "EC", Size: size, MinSize: sp.MinECKeySize}
+		}
+	default:
+		return &WeakKeyError{Algorithm: fmt.Sprintf("%T", key)}
+	}
+	return nil
+}
+
+// MessageTooLargeError is the PrivateErr of the InvalidResponseError
+// returned by ParseResponse when the decoded response is larger than Max
+// bytes, see ServiceProvider.MaxMessageSize. ResponseValues, and so
+// ParseResponse, return it as is when the request body is.
+type MessageTooLargeError struct {
+	Max int
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("message is larger than %d bytes", e.Max)
+}
+
+// IssueInstantError is the PrivateErr of the InvalidResponseError returned
+// by ParseResponse when the IssueInstant of the Response, as opposed to
+// that of its assertion, is more than MaxIssueDelay before Now or more than
+// MaxClockSkew after it.
+// A stale Response around a fresh assertion suggests that it is replayed.
+type IssueInstantError struct {
+	IssueInstant  time.Time
+	Now           time.Time
+	MaxIssueDelay time.Duration
+}
+
+func (e *IssueInstantError) Error() string {
+	if e.IssueInstant.After(e.Now) {
+		return fmt.Sprintf("IssueInstant %s is in the future", e.IssueInstant)
+	}
+	return fmt.Sprintf("IssueInstant expired at %s", e.IssueInstant.Add(e.MaxIssueDelay))
+}
+
+// checkResponseIssueInstant returns an IssueInstantError unless
+// issueInstant, that of a Response, is at most MaxIssueDelay before now and
+// at most MaxClockSkew after it.
+func (sp *ServiceProvider) checkResponseIssueInstant(issueInstant time.Time, now time.Time) error {
+	maxIssueDelay := sp.maxIssueDelay()
+	if issueInstant.Add(maxIssueDelay).Before(now) || issueInstant.After(now.Add(sp.maxClockSkew())) {
+		return &IssueInstantError{IssueInstant: issueInstant, Now: now, MaxIssueDelay: maxIssueDelay}
+	}
+	return nil
+}
+
+// checkAssertionIssueInstant is like checkResponseIssueInstant, but for the
+// IssueInstant of an assertion.
+func (sp *ServiceProvider) checkAssertionIssueInstant(issueInstant time.Time, now time.Time) error {
+	if issueInstant.Add(sp.maxIssueDelay()).Before(now) {
+		return fmt.Errorf("expired on %s", issueInstant.Add(sp.maxIssueDelay()))
+	}
+	if issueInstant.After(now.Add(sp.maxClockSkew())) {
+		return fmt.Errorf("issued in the future, at %s", issueInstant)
+	}
+	return nil
+}
+
+// AttributeLimitError is the PrivateErr of the InvalidResponseError
+// returned by ParseResponse when the attributes of the assertion exceed one
+// of the limits set by ServiceProvider.MaxAttributes, MaxAttributeValues
+// or MaxAttributeBytes. What is what was counted, e.g. "attributes",
+// "values of attribute mail" or "bytes of attribute values".
+type AttributeLimitError struct {
+	What  string
+	Count int
+	Max   int
+}
+
+func (e *AttributeLimitError) Error() string {
+	return fmt.Sprintf("assertion has %d %s, more than the %d allowed", e.Count, e.What, e.Max)
+}
+
+// checkAttributeLimits returns an AttributeLimitError if the attributes of
+// assertion exceed the limits of sp.
+func (sp *ServiceProvider) checkAttributeLimits(assertion *Assertion) error {
+	if assertion.AttributeStatement == nil {
+		return nil
+	}
+	maxAttributes, maxValues, maxBytes := sp.MaxAttributes, sp.MaxAttributeValues, sp.MaxAttributeBytes
+	if maxAttributes == 0 {
+		maxAttributes = DefaultMaxAttributes
+	}
+	if maxValues == 0 {
+		maxValues = DefaultMaxAttributeValues
+	}
+	if maxBytes == 0 {
+		maxBytes = DefaultMaxAttributeBytes
+	}
+
+	attributes := assertion.AttributeStatement.Attributes
+	if len(attributes) > maxAttributes {
+		return &AttributeLimitError{What: "attributes", Count: len(attributes), Max: maxAttributes}
+	}
+	size := 0
+	for _, attribute := range attributes {
+		if len(attribute.Values) > maxValues {
+			return &AttributeLimitError{What: "values of attribute " + attribute.Name, Count: len(attribute.Values), Max: maxValues}
+		}
+		for _, value := range attribute.Values {
+			size += len(value.Value)
+		}
+	}
+	if size > maxBytes {
+		return &AttributeLimitError{What: "bytes of attribute values", Count: size, Max: maxBytes}
+	}
+	return nil
+}
+
+// MissingAttributeError is the PrivateErr of the InvalidResponseError
+// returned by ParseResponse when the assertion lacks a value for some of
+// ServiceProvider.RequiredAttributes. Names are those attributes.
+type MissingAttributeError struct {
+	Names []string
+}
+
+func (e *MissingAttributeError) Error() string {
+	return fmt.Sprintf("assertion has no value for the required attributes %s", strings.Join(e.Names, ", "))
+}
+
+// checkRequiredAttributes returns a MissingAttributeError if assertion
+// lacks a value for any of the RequiredAttributes of sp.
+func (sp *ServiceProvider) checkRequiredAttributes(assertion *Assertion) error {
+	var missing []string
+	for _, name := range sp.RequiredAttributes {
+		if !hasAttributeValue(assertion, name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingAttributeError{Names: missing}
+	}
+	return nil
+}
+
+// hasAttributeValue returns true if assertion has a non-empty value for an
+// attribute whose Name or FriendlyName is name.
+func hasAttributeValue(assertion *Assertion, name string) bool {
+	if assertion.AttributeStatement == nil {
+		return false
+	}
+	for _, attribute := range assertion.AttributeStatement.Attributes {
+		if attribute.Name != name && attribute.FriendlyName != name {
+			continue
+		}
+		for _, value := range attribute.Values {
+			if value.Value != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AuthnContextError is the PrivateErr of the InvalidResponseError returned
+// by ParseResponse when the user authenticated with a context that is not
+// among ServiceProvider.AcceptedAuthnContexts. Actual is empty if the
+// assertion has no AuthnContextClassRef.
+type AuthnContextError struct {
+	Accepted []string
+	Actual   string
+}
+
+func (e *AuthnContextError) Error() string {
+	if e.Actual == "" {
+		return fmt.Sprintf("assertion has no authentication context (expected one of %v)", e.Accepted)
+	}
+	return fmt.Sprintf("assertion has authentication context %q (expected one of %v)", e.Actual, e.Accepted)
+}
+
+// checkAuthnContext returns an AuthnContextError if the AcceptedAuthnContexts
+// of sp are set and the AuthnContextClassRef of assertion is not among them.
+func (sp *ServiceProvider) checkAuthnContext(assertion *Assertion) error {
+	if len(sp.AcceptedAuthnContexts) == 0 {
+		return nil
+	}
+	classRef := ""
+	if s := assertion.AuthnStatement; s != nil && s.AuthnContext.AuthnContextClassRef != nil {
+		classRef = s.AuthnContext.AuthnContextClassRef.Value
+	}
+	for _, accepted := range sp.AcceptedAuthnContexts {
+		if classRef != "" && classRef == accepted {
+			return nil
+		}
+	}
+	return &AuthnContextError{Accepted: sp.AcceptedAuthnContexts, Actual: classRef}
+}
+
+// SubjectConfirmationMethodError is the PrivateErr of the
+// InvalidResponseError returned by ParseResponse when the assertion is
+// confirmed with a method that is not among
+// ServiceProvider.SubjectConfirmationMethods, e.g. holder-of-key.
+type SubjectConfirmationMethodError struct {
+	Expected []string
+	Actual   string
+}
+
+func (e *SubjectConfirmationMethodError) Error() string {
+	return fmt.Sprintf("SubjectConfirmation Method %q is not one of %v", e.Actual, e.Expected)
+}
+
+// NameIDError is the PrivateErr of the InvalidResponseError returned by
+// ParseResponse when the assertion has no NameID although
+// ServiceProvider.WantNameID is set, or its format is not
+// ServiceProvider.RequiredNameIDFormat, or its SPNameQualifier is not
+// ServiceProvider.SPNameQualifier. Actual is nil if there is no NameID.
+type NameIDError struct {
+	ExpectedFormat          string
+	ExpectedSPNameQualifier string
+	Actual                  *NameID
+}
+
+func (e *NameIDError) Error() string {
+	if e.Actual == nil {
+		return "Subject has no NameID"
+	}
+	if e.ExpectedSPNameQualifier != "" {
+		return fmt.Sprintf("NameID SPNameQualifier %q is not %q", e.Actual.SPNameQualifier, e.ExpectedSPNameQualifier)
+	}
+	return fmt.Sprintf("NameID Format %q is not %q", e.Actual.Format, e.ExpectedFormat)
+}
+
+func (e *StatusNotSuccessError) Error() string {
+	msg := fmt.Sprintf("Status code was not %s", StatusSuccess)
+	if e.SubCode != "" {
+		msg += fmt.Sprintf(" (%s)", e.SubCode)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
 // ParseResponse extracts the SAML IDP response received in req, validates
 // it, and returns the verified attributes of the request.
 //
@@ -340,32 +1863,150 @@ func (ivr *InvalidResponseError) Error() string {
 // properties are useful in describing which part of the parsing process
 // failed. However, to discourage inadvertent disclosure the diagnostic
 // information, the Error() method returns a static string.
+//
+// The request body is not consumed; see PostFormValues.
 func (sp *ServiceProvider) ParseResponse(req *http.Request, possibleRequestIDs []string) (*Assertion, error) {
-	now := TimeNow()
+	return sp.ParseResponseContext(context.Background(), req, possibleRequestIDs)
+}
 
-	if err := req.ParseForm(); err != nil {
+// ParseResponseContext is like ParseResponse, but stops decrypting and
+// verifying the response if ctx is cancelled or its deadline passes, which
+// bounds the work that a large or crafted response can cause. It then
+// returns an InvalidResponseError whose PrivateErr is, or reports,
+// ctx.Err(). Pass the context of req to stop when the client goes away.
+func (sp *ServiceProvider) ParseResponseContext(ctx context.Context, req *http.Request, possibleRequestIDs []string) (*Assertion, error) {
+	resp, err := sp.parseResponseFull(ctx, req, possibleRequestIDs)
+	if err != nil {
 		return nil, err
 	}
+	return resp.Assertion, nil
+}
+
+// ParseResponseFull is like ParseResponse, but returns the whole Response,
+// e.g. for auditing its ID and IssueInstant. Its Assertion is the one that
+// ParseResponse would return, decrypted if the IDP encrypted it, and its
+// EncryptedAssertion is nil.
+//
+// Signature is only set if the IDP signed the Response element itself and
+// that signature was verified, whether the assertion is encrypted or not;
+// with InsecureSkipSignatureValidation it is always nil. Otherwise only the
+// Destination, InResponseTo, IssueInstant, Issuer and Status of the
+// Response have been validated, and the rest must not be trusted.
+func (sp *ServiceProvider) ParseResponseFull(req *http.Request, possibleRequestIDs []string) (*Response, error) {
+	return sp.parseResponseFull(context.Background(), req, possibleRequestIDs)
+}
+
+func (sp *ServiceProvider) parseResponseFull(ctx context.Context, req *http.Request, possibleRequestIDs []string) (*Response, error) {
+	values, binding, err := sp.ResponseValues(req)
+	if err != nil {
+		return nil, err
+	}
+	return sp.parseEncodedResponse(ctx, binding, values.Get("SAMLResponse"), sp.receivingAcsURLs(req), possibleRequestIDs)
+}
+
+// ResponseValues returns the parameters, i.e. SAMLResponse and RelayState,
+// of the response received in req, and the binding it was received with.
+// That is the HTTP-POST binding, unless AcceptRedirectBinding is set and
+// req is a GET with a SAMLResponse in the query string.
+//
+// A request body larger than MaxMessageSize allows is not read beyond the
+// limit, and a MessageTooLargeError is returned.
+func (sp *ServiceProvider) ResponseValues(req *http.Request) (url.Values, string, error) {
+	if sp.AcceptRedirectBinding && req.Method == "GET" {
+		if query := req.URL.Query(); query.Get("SAMLResponse") != "" {
+			return query, HTTPRedirectBinding, nil
+		}
+	}
+	limitBody(req, sp.maxMessageSize())
+	form, err := PostFormValues(req)
+	return form, HTTPPostBinding, err
+}
+
+// ParseUnsolicitedResponse extracts the SAML IDP response received in req
+// for an IDP-initiated login, i.e. one that does not answer an AuthnRequest
+// of ours. Neither the response nor the SubjectConfirmationData of its
+// assertion may have an InResponseTo; otherwise the response is validated
+// exactly like a solicited one. A RelayState is optional and, as it was not
+// issued by us, must not be trusted by the caller.
+//
+// Accepting unsolicited responses makes it easier to replay a response that
+// was stolen, so only call this if IDP-initiated login is required.
+func (sp *ServiceProvider) ParseUnsolicitedResponse(req *http.Request) (*Assertion, error) {
+	return sp.ParseUnsolicitedResponseContext(context.Background(), req)
+}
+
+// ParseUnsolicitedResponseContext is like ParseUnsolicitedResponse, but
+// gives up once ctx is done, like ParseResponseContext.
+func (sp *ServiceProvider) ParseUnsolicitedResponseContext(ctx context.Context, req *http.Request) (*Assertion, error) {
+	return sp.ParseResponseContext(ctx, req, []string{""})
+}
+
+// ParseEncodedResponse is like ParseResponse, but accepts the base64 encoded
+// SAMLResponse form value directly. It is useful for callers that have
+// already parsed the request themselves.
+func (sp *ServiceProvider) ParseEncodedResponse(encodedResponse string, possibleRequestIDs []string) (*Assertion, error) {
+	resp, err := sp.parseEncodedResponse(context.Background(), HTTPPostBinding, encodedResponse, sp.acsURLs(), possibleRequestIDs)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Assertion, nil
+}
+
+// decodeResponse decodes the SAMLResponse encodedResponse, received with
+// binding. It fails if the response cannot be decoded, e.g. because it is
+// larger than MaxMessageSize allows; its structure is left to
+// checkStructure.
+func (sp *ServiceProvider) decodeResponse(binding string, encodedResponse string) ([]byte, error) {
+	return decodeMessage(binding, encodedResponse, sp.maxMessageSize())
+}
+
+// checkStructure checks the structure of the decoded response buf with
+// checkResponseStructure, strictly if StrictXML is set.
+func (sp *ServiceProvider) checkStructure(buf []byte) error {
+	return checkResponseStructure(buf, sp.StrictXML)
+}
+
+// parseEncodedResponse parses and validates a response received with
+// binding at one of acsURLs, and returns it as ParseResponseFull does. It
+// gives up once ctx is done.
+func (sp *ServiceProvider) parseEncodedResponse(ctx context.Context, binding string, encodedResponse string, acsURLs []string, possibleRequestIDs []string) (*Response, error) {
+	now := TimeNow()
+
 	retErr := &InvalidResponseError{
 		Now:      now,
-		Response: req.PostForm.Get("SAMLResponse"),
+		Response: encodedResponse,
+	}
+	if err := ctx.Err(); err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
 	}
 
-	rawResponseBuf, err := base64.StdEncoding.DecodeString(req.PostForm.Get("SAMLResponse"))
+	rawResponseBuf, err := sp.decodeResponse(binding, encodedResponse)
 	if err != nil {
-		retErr.PrivateErr = fmt.Errorf("cannot parse base64: %s", err)
+		retErr.PrivateErr = err
 		return nil, retErr
 	}
 	retErr.Response = string(rawResponseBuf)
 
+	if err := sp.checkMetadataExpiry(now); err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+
+	if err := sp.checkStructure(rawResponseBuf); err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+
 	// do some validation first before we decrypt
 	resp := Response{}
 	if err := xml.Unmarshal(rawResponseBuf, &resp); err != nil {
 		retErr.PrivateErr = fmt.Errorf("cannot unmarshal response: %s", err)
 		return nil, retErr
 	}
-	if resp.Destination != sp.AcsURL {
-		retErr.PrivateErr = fmt.Errorf("`Destination` does not match AcsURL (expected %q)", sp.AcsURL)
+	// Destination is optional, but if present it must be us.
+	if resp.Destination != "" && !containsString(acsURLs, resp.Destination) {
+		retErr.PrivateErr = &DestinationMismatchError{Expected: acsURLs[0], Actual: resp.Destination}
 		return nil, retErr
 	}
 
@@ -380,64 +2021,412 @@ func (sp *ServiceProvider) ParseResponse(req *http.Request, possibleRequestIDs [
 		return nil, retErr
 	}
 
-	if resp.IssueInstant.Add(MaxIssueDelay).Before(now) {
-		retErr.PrivateErr = fmt.Errorf("IssueInstant expired at %s", resp.IssueInstant.Add(MaxIssueDelay))
+	if err := sp.checkResponseIssueInstant(resp.IssueInstant, now); err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+	if resp.Issuer == nil {
+		retErr.PrivateErr = &IssuerMismatchError{Expected: sp.IDPMetadata.EntityID}
 		return nil, retErr
 	}
 	if resp.Issuer.Value != sp.IDPMetadata.EntityID {
-		retErr.PrivateErr = fmt.Errorf("Issuer does not match the IDP metadata (expected %q)", sp.IDPMetadata.EntityID)
+		retErr.PrivateErr = &IssuerMismatchError{Expected: sp.IDPMetadata.EntityID, Actual: resp.Issuer.Value}
+		return nil, retErr
+	}
+	if resp.Status == nil {
+		retErr.PrivateErr = fmt.Errorf("response has no Status")
 		return nil, retErr
 	}
-	if resp.Status.StatusCode.Value != StatusSuccess {
-		retErr.PrivateErr = fmt.Errorf("Status code was not %s", StatusSuccess)
+	if err := checkStatus(resp.Status); err != nil {
+		retErr.PrivateErr = err
 		return nil, retErr
 	}
 
+	if sp.InsecureSkipSignatureValidation {
+		log.Printf("WARNING: InsecureSkipSignatureValidation is set, not checking the signature of response %s from %s", resp.ID, resp.Issuer.Value)
+	}
+
 	var assertion *Assertion
+	responseSigned := false
 	if resp.EncryptedAssertion == nil {
-		if err := xmlsec.VerifyResponseSignature(string(rawResponseBuf), string(sp.getIDPSigningCert())); err != nil {
-			retErr.PrivateErr = fmt.Errorf("failed to verify signature on response: %s", err)
+		if resp.Assertion == nil {
+			retErr.PrivateErr = fmt.Errorf("response does not contain an assertion")
+			return nil, retErr
+		}
+		if err := sp.validateResponseSignatures(ctx, &resp, rawResponseBuf); err != nil {
+			retErr.PrivateErr = err
 			return nil, retErr
 		}
 		assertion = resp.Assertion
+		assertion.RawXML = assertion.rawXML(rawResponseBuf)
+		responseSigned = resp.Signature != nil && !sp.InsecureSkipSignatureValidation
 	}
 
 	// decrypt the response
 	if resp.EncryptedAssertion != nil {
-		plaintextAssertion, err := xmlsec.Decrypt(string(resp.EncryptedAssertion.EncryptedData), sp.Key)
+		if err := sp.validateEncryptedResponseSignature(ctx, &resp, rawResponseBuf); err != nil {
+			retErr.PrivateErr = err
+			return nil, retErr
+		}
+		responseSigned = resp.Signature != nil && !sp.InsecureSkipSignatureValidation
+
+		plaintextAssertion, err := sp.decrypt(ctx, string(resp.EncryptedAssertion.EncryptedData))
 		if err != nil {
 			retErr.PrivateErr = fmt.Errorf("failed to decrypt response: %s", err)
 			return nil, retErr
 		}
 		retErr.Response = string(plaintextAssertion)
 
-		if err := xmlsec.VerifyAssertionSignature(plaintextAssertion, string(sp.getIDPSigningCert())); err != nil {
-			retErr.PrivateErr = fmt.Errorf("failed to verify signature on response: %s", err)
+		if err := checkAssertionStructure([]byte(plaintextAssertion), sp.StrictXML); err != nil {
+			retErr.PrivateErr = err
 			return nil, retErr
 		}
 
 		assertion = &Assertion{}
 		xml.Unmarshal([]byte(plaintextAssertion), assertion)
+		assertion.RawXML = []byte(plaintextAssertion)
+
+		if err := sp.validateDecryptedAssertionSignature(ctx, assertion); err != nil {
+			retErr.PrivateErr = err
+			return nil, retErr
+		}
 	}
 
-	if err := sp.validateAssertion(assertion, possibleRequestIDs, now); err != nil {
-		retErr.PrivateErr = fmt.Errorf("assertion invalid: %s", err)
+	if sp.RequireSignedIssuer && !responseSigned {
+		if err := checkSignedIssuer(resp.Issuer, assertion.Issuer); err != nil {
+			retErr.PrivateErr = err
+			return nil, retErr
+		}
+	}
+
+	if err := sp.decryptNameID(ctx, assertion); err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+
+	if err := sp.validateAssertion(assertion, acsURLs, possibleRequestIDs, now); err != nil {
+		switch err.(type) {
+		case *IssuerMismatchError, *SubjectConfirmationMethodError, *NameIDError, *AttributeLimitError, *MissingAttributeError, *AuthnContextError:
+			retErr.PrivateErr = err
+		default:
+			if err == ErrAssertionNotYetValid || err == ErrAssertionExpired {
+				retErr.PrivateErr = err
+			} else {
+				retErr.PrivateErr = fmt.Errorf("assertion invalid: %s", err)
+			}
+		}
 		return nil, retErr
 	}
 
-	return assertion, nil
+	if err := sp.checkReplay(assertion); err != nil {
+		retErr.PrivateErr = err
+		return nil, retErr
+	}
+
+	resp.Assertion = assertion
+	resp.EncryptedAssertion = nil
+	if !responseSigned {
+		// the signature was not verified, so it must not vouch for resp
+		resp.Signature = nil
+	}
+	return &resp, nil
+}
+
+// checkReplay records assertion, which has been validated, in the replay
+// cache, if it is to be checked against one, and returns
+// ErrAssertionReplayed if it has been recorded before.
+func (sp *ServiceProvider) checkReplay(assertion *Assertion) error {
+	cache := sp.ReplayCache
+	if cache == nil {
+		if assertion.Conditions == nil || assertion.Conditions.OneTimeUse == nil {
+			return nil
+		}
+		cache = DefaultReplayCache
+	}
+
+	// the assertion only needs to be remembered as long as it would
+	// otherwise be accepted
+	expires := assertion.IssueInstant.Add(sp.maxIssueDelay())
+	if assertion.Conditions != nil && !assertion.Conditions.NotOnOrAfter.IsZero() && assertion.Conditions.NotOnOrAfter.Before(expires) {
+		expires = assertion.Conditions.NotOnOrAfter
+	}
+	if subject := assertion.Subject; subject != nil && subject.SubjectConfirmation != nil {
+		if notOnOrAfter := subject.SubjectConfirmation.SubjectConfirmationData.NotOnOrAfter; !notOnOrAfter.IsZero() && notOnOrAfter.Before(expires) {
+			expires = notOnOrAfter
+		}
+	}
+	return cache.Add(assertion.ID, expires)
+}
+
+// decryptNameID replaces the EncryptedID in the Subject of assertion, if
+// any, with the NameID that it encrypts.
+func (sp *ServiceProvider) decryptNameID(ctx context.Context, assertion *Assertion) error {
+	if assertion.Subject == nil || assertion.Subject.EncryptedID == nil {
+		return nil
+	}
+	plaintext, err := sp.decrypt(ctx, string(assertion.Subject.EncryptedID.EncryptedData))
+	if err != nil {
+		return fmt.Errorf("cannot decrypt EncryptedID: %s", err)
+	}
+	nameID := &NameID{}
+	if err := xml.Unmarshal([]byte(plaintext), nameID); err != nil {
+		return fmt.Errorf("cannot decrypt EncryptedID: cannot unmarshal NameID: %s", err)
+	}
+	assertion.Subject.NameID = nameID
+	assertion.Subject.EncryptedID = nil
+	return nil
+}
+
+// checkStatus returns a StatusNotSuccessError unless status reports that
+// the IDP authenticated the user.
+func checkStatus(status *Status) error {
+	if status.StatusCode.Value == StatusSuccess {
+		return nil
+	}
+	statusErr := &StatusNotSuccessError{
+		Code:    status.StatusCode.Value,
+		Message: status.StatusMessage,
+	}
+	if status.StatusCode.StatusCode != nil {
+		statusErr.SubCode = status.StatusCode.StatusCode.Value
+	}
+	return statusErr
+}
+
+// validateDecryptedAssertionSignature checks the signature of assertion,
+// which was decrypted from an EncryptedAssertion into assertion.RawXML. As
+// the response signature, if any, does not cover the plaintext, the
+// assertion must be signed itself.
+func (sp *ServiceProvider) validateDecryptedAssertionSignature(ctx context.Context, assertion *Assertion) error {
+	if sp.InsecureSkipSignatureValidation {
+		return nil
+	}
+	if err := sp.CheckIDPSigningKey(); err != nil {
+		return err
+	}
+	if assertion.Signature == nil {
+		return fmt.Errorf("assertion is not signed")
+	}
+	if err := checkSignatureReferences(assertion.RawXML,
+		signedElement{Name: assertionName, ID: assertion.ID, Signature: assertion.Signature},
+	); err != nil {
+		return err
+	}
+	if err := sp.checkSignatureAlgorithms(assertion.Signature); err != nil {
+		return fmt.Errorf("assertion signature: %s", err)
+	}
+	cert, err := sp.idpSigningCertFor(assertion.Signature)
+	if err != nil {
+		return err
+	}
+	if err := xmlsec.VerifyAssertionSignatureContext(ctx, string(assertion.RawXML), string(cert)); err != nil {
+		return fmt.Errorf("failed to verify signature on response: %s", err)
+	}
+	return nil
+}
+
+// validateEncryptedResponseSignature checks the signature on resp, which
+// contains an encrypted assertion and was parsed from raw, if it has one.
+// The assertion's own signature is checked once it is decrypted.
+func (sp *ServiceProvider) validateEncryptedResponseSignature(ctx context.Context, resp *Response, raw []byte) error {
+	if sp.InsecureSkipSignatureValidation || resp.Signature == nil {
+		return nil
+	}
+	if err := sp.CheckIDPSigningKey(); err != nil {
+		return err
+	}
+	if err := checkSignatureReferences(raw,
+		signedElement{Name: responseName, ID: resp.ID, Signature: resp.Signature},
+	); err != nil {
+		return err
+	}
+	if err := sp.checkSignatureAlgorithms(resp.Signature); err != nil {
+		return fmt.Errorf("response signature: %s", err)
+	}
+	cert, err := sp.idpSigningCertFor(resp.Signature)
+	if err != nil {
+		return err
+	}
+	if err := xmlsec.VerifyElementSignatureContext(ctx, string(raw), string(cert), resp.ID); err != nil {
+		return fmt.Errorf("failed to verify signature on response: %s", err)
+	}
+	return nil
+}
+
+// validateResponseSignatures checks the signatures on resp, which contains a
+// plaintext assertion and was parsed from raw. The signatures are first
+// attributed to the Response and the Assertion with resolveSignatures.
+func (sp *ServiceProvider) validateResponseSignatures(ctx context.Context, resp *Response, raw []byte) error {
+	if err := resolveSignatures(resp, raw); err != nil {
+		return err
+	}
+	if sp.InsecureSkipSignatureValidation {
+		return nil
+	}
+	if err := sp.CheckIDPSigningKey(); err != nil {
+		return err
+	}
+	if resp.Signature == nil && resp.Assertion.Signature == nil {
+		return fmt.Errorf("neither the response nor the assertion is signed")
+	}
+	if err := checkSignatureReferences(raw,
+		signedElement{Name: responseName, ID: resp.ID, Signature: resp.Signature},
+		signedElement{Name: assertionName, ID: resp.Assertion.ID, Signature: resp.Assertion.Signature},
+	); err != nil {
+		return err
+	}
+	if resp.Signature != nil {
+		if err := sp.checkSignatureAlgorithms(resp.Signature); err != nil {
+			return fmt.Errorf("response signature: %s", err)
+		}
+		cert, err := sp.idpSigningCertFor(resp.Signature)
+		if err != nil {
+			return err
+		}
+		if err := xmlsec.VerifyElementSignatureContext(ctx, string(raw), string(cert), resp.ID); err != nil {
+			return fmt.Errorf("failed to verify signature on response: %s", err)
+		}
+	}
+	if resp.Assertion.Signature != nil {
+		if err := sp.checkSignatureAlgorithms(resp.Assertion.Signature); err != nil {
+			return fmt.Errorf("assertion signature: %s", err)
+		}
+		cert, err := sp.idpSigningCertFor(resp.Assertion.Signature)
+		if err != nil {
+			return err
+		}
+		if err := xmlsec.VerifyElementSignatureContext(ctx, string(raw), string(cert), resp.Assertion.ID); err != nil {
+			return fmt.Errorf("failed to verify signature on assertion: %s", err)
+		}
+	} else if sp.WantAssertionsSigned {
+		return fmt.Errorf("assertion is not signed")
+	}
+	return nil
+}
+
+// checkSignedIssuer returns an error unless issuer, the Issuer of a Response
+// that no verified signature covers, is the same as assertionIssuer, the
+// Issuer of its signed assertion. See RequireSignedIssuer.
+func checkSignedIssuer(issuer, assertionIssuer *Issuer) error {
+	if issuer == nil {
+		return nil
+	}
+	if assertionIssuer == nil || issuer.Value != assertionIssuer.Value || issuer.Format != assertionIssuer.Format {
+		return fmt.Errorf("the Issuer of the Response is not signed and differs from the Issuer of the assertion")
+	}
+	return nil
+}
+
+func (sp *ServiceProvider) subjectConfirmationMethods() []string {
+	if len(sp.SubjectConfirmationMethods) == 0 {
+		return []string{BearerConfirmationMethod}
+	}
+	return sp.SubjectConfirmationMethods
+}
+
+func (sp *ServiceProvider) subjectConfirmationMethodAllowed(method string) bool {
+	for _, allowed := range sp.subjectConfirmationMethods() {
+		if method == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// validateNameID checks nameID, the NameID of an assertion, against
+// WantNameID, RequiredNameIDFormat and SPNameQualifier, filling in a
+// missing SPNameQualifier.
+func (sp *ServiceProvider) validateNameID(nameID *NameID) error {
+	if nameID == nil || nameID.Value == "" {
+		if sp.WantNameID || sp.RequiredNameIDFormat != "" {
+			return &NameIDError{ExpectedFormat: sp.RequiredNameIDFormat}
+		}
+		return nil
+	}
+	if sp.RequiredNameIDFormat != "" && nameID.Format != sp.RequiredNameIDFormat {
+		return &NameIDError{ExpectedFormat: sp.RequiredNameIDFormat, Actual: nameID}
+	}
+	if sp.SPNameQualifier != "" {
+		if nameID.SPNameQualifier == "" {
+			nameID.SPNameQualifier = sp.SPNameQualifier
+		} else if nameID.SPNameQualifier != sp.SPNameQualifier {
+			return &NameIDError{ExpectedSPNameQualifier: sp.SPNameQualifier, Actual: nameID}
+		}
+	}
+	return nil
+}
+
+// makeSignature returns the template of a signature that uses
+// canonicalizationMethod and signatureMethod, or those of
+// xmlsec.DefaultSignature where they are empty.
+func makeSignature(canonicalizationMethod string, signatureMethod string, certificate string, intermediates []string) (xmlsec.Signature, error) {
+	signature := xmlsec.DefaultSignature(certificate, intermediates...)
+	if canonicalizationMethod != "" {
+		var err error
+		signature, err = xmlsec.NewSignature(canonicalizationMethod, certificate, intermediates...)
+		if err != nil {
+			return xmlsec.Signature{}, err
+		}
+	}
+	if signatureMethod != "" {
+		digestMethod, err := xmlsec.SignatureDigestMethod(signatureMethod)
+		if err != nil {
+			return xmlsec.Signature{}, err
+		}
+		signature.SignedInfo.SignatureMethod.Algorithm = signatureMethod
+		signature.SignedInfo.Reference.DigestMethod.Algorithm = digestMethod
+	}
+	return signature, nil
+}
+
+// checkSignatureAlgorithms returns an error if signature uses an algorithm
+// that is not allowed by sp.SignatureMethods or sp.DigestMethods, or a
+// transform that xmlsec.CheckTransforms does not allow.
+func (sp *ServiceProvider) checkSignatureAlgorithms(signature *xmlsec.Signature) error {
+	if err := xmlsec.CheckTransforms(signature); err != nil {
+		return err
+	}
+	return xmlsec.CheckAlgorithms(signature, sp.SignatureMethods, sp.DigestMethods)
 }
 
 // validateAssertion checks that the conditions specified in assertion match
-// the requirements to accept. If validation fails, it returns an error describing
-// the failure. (The digital signature on the assertion is not checked -- this
-// should be done before calling this function).
-func (sp *ServiceProvider) validateAssertion(assertion *Assertion, possibleRequestIDs []string, now time.Time) error {
-	if assertion.IssueInstant.Add(MaxIssueDelay).Before(now) {
-		return fmt.Errorf("expired on %s", assertion.IssueInstant.Add(MaxIssueDelay))
+// the requirements to accept, for a response received at one of acsURLs.
+// If validation fails, it returns an error describing the failure. (The
+// digital signature on the assertion is not checked -- this should be done
+// before calling this function).
+func (sp *ServiceProvider) validateAssertion(assertion *Assertion, acsURLs []string, possibleRequestIDs []string, now time.Time) error {
+	if err := sp.checkAssertionIssueInstant(assertion.IssueInstant, now); err != nil {
+		return err
+	}
+	if assertion.Issuer == nil {
+		return &IssuerMismatchError{Expected: sp.IDPMetadata.EntityID, InAssertion: true}
 	}
 	if assertion.Issuer.Value != sp.IDPMetadata.EntityID {
-		return fmt.Errorf("issuer is not %q", sp.IDPMetadata.EntityID)
+		return &IssuerMismatchError{Expected: sp.IDPMetadata.EntityID, Actual: assertion.Issuer.Value, InAssertion: true}
+	}
+	// The subject and conditions are checked whatever statements the
+	// assertion makes: an authentication-only assertion, without an
+	// AttributeStatement, is just as much a bearer token.
+	if assertion.Subject == nil || assertion.Subject.SubjectConfirmation == nil {
+		return fmt.Errorf("assertion has no SubjectConfirmation")
+	}
+	if assertion.Conditions == nil {
+		return fmt.Errorf("assertion has no Conditions")
+	}
+	if method := assertion.Subject.SubjectConfirmation.Method; !sp.subjectConfirmationMethodAllowed(method) {
+		return &SubjectConfirmationMethodError{Expected: sp.subjectConfirmationMethods(), Actual: method}
+	}
+	if err := sp.validateNameID(assertion.Subject.NameID); err != nil {
+		return err
+	}
+	if err := sp.checkAttributeLimits(assertion); err != nil {
+		return err
+	}
+	if err := sp.checkRequiredAttributes(assertion); err != nil {
+		return err
+	}
+	if err := sp.checkAuthnContext(assertion); err != nil {
+		return err
 	}
 	requestIDvalid := false
 	for _, possibleRequestID := range possibleRequestIDs {
@@ -449,20 +2438,110 @@ func (sp *ServiceProvider) validateAssertion(assertion *Assertion, possibleReque
 	if !requestIDvalid {
 		return fmt.Errorf("SubjectConfirmation one of the possible request IDs (%v)", possibleRequestIDs)
 	}
-	if assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient != sp.AcsURL {
-		return fmt.Errorf("SubjectConfirmation Recipient is not %s", sp.AcsURL)
+	if err := sp.validateSubjectConfirmationData(assertion.Subject.SubjectConfirmation.SubjectConfirmationData, acsURLs, now); err != nil {
+		return err
 	}
-	if assertion.Subject.SubjectConfirmation.SubjectConfirmationData.NotOnOrAfter.Before(now) {
+	if err := sp.validateConditionsTime(assertion.Conditions, now); err != nil {
+		return err
+	}
+	return sp.validateAudience(assertion.Conditions)
+}
+
+// acsURLs returns AcsURL followed by AdditionalAcsURLs.
+func (sp *ServiceProvider) acsURLs() []string {
+	return append([]string{sp.AcsURL}, sp.AdditionalAcsURLs...)
+}
+
+// receivingAcsURLs returns the ACS URLs that a response received in req
+// may be addressed to: the one at which req arrived, found by its path and,
+// if several ACS URLs have that path, by its host. If req matches none of
+// them, e.g. because a proxy rewrote its path, a response may be addressed
+// to any of them. Either way the result is a subset of the configured ACS
+// URLs; the scheme and port at which req arrived, which a proxy changes,
+// are never compared.
+func (sp *ServiceProvider) receivingAcsURLs(req *http.Request) []string {
+	matches := []string{}
+	for _, acsURL := range sp.acsURLs() {
+		u, err := url.Parse(acsURL)
+		if err == nil && req.URL != nil && u.Path == req.URL.Path {
+			matches = append(matches, acsURL)
+		}
+	}
+	if len(matches) > 1 {
+		host := req.Host
+		if host == "" && req.URL != nil {
+			host = req.URL.Host
+		}
+		for _, acsURL := range matches {
+			if u, _ := url.Parse(acsURL); strings.EqualFold(u.Host, host) {
+				return []string{acsURL}
+			}
+		}
+		return matches
+	}
+	if len(matches) == 0 {
+		return sp.acsURLs()
+	}
+	return matches
+}
+
+// containsString returns true if s is one of list.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSubjectConfirmationData checks that data is addressed to one of
+// acsURLs and that now is within its validity period, which must have an
+// end. The start may be up to sp.maxClockSkew() in the future.
+func (sp *ServiceProvider) validateSubjectConfirmationData(data SubjectConfirmationData, acsURLs []string, now time.Time) error {
+	if !containsString(acsURLs, data.Recipient) {
+		return fmt.Errorf("SubjectConfirmation Recipient is not %s", strings.Join(acsURLs, " or "))
+	}
+	if data.NotOnOrAfter.IsZero() {
+		return fmt.Errorf("SubjectConfirmationData has no NotOnOrAfter")
+	}
+	if data.NotBefore != nil && data.NotBefore.After(now.Add(sp.maxClockSkew())) {
+		return fmt.Errorf("SubjectConfirmationData is not yet valid")
+	}
+	if data.NotOnOrAfter.Before(now) {
 		return fmt.Errorf("SubjectConfirmationData is expired")
 	}
-	if assertion.Conditions.NotBefore.After(now) {
-		return fmt.Errorf("Conditions is not yet valid")
+	return nil
+}
+
+// validateConditionsTime checks that now is within the validity period of
+// conditions, returning ErrAssertionNotYetValid or ErrAssertionExpired if
+// it is not. As for SubjectConfirmationData, an absent NotBefore sets no
+// lower bound, but NotOnOrAfter is required, so that no assertion is valid
+// forever. As for IssueInstant, NotBefore may be up to sp.maxClockSkew() in
+// the future.
+func (sp *ServiceProvider) validateConditionsTime(conditions *Conditions, now time.Time) error {
+	if conditions.NotOnOrAfter.IsZero() {
+		return fmt.Errorf("Conditions has no NotOnOrAfter")
 	}
-	if assertion.Conditions.NotOnOrAfter.Before(now) {
-		return fmt.Errorf("Conditions is expired")
+	if conditions.NotBefore.After(now.Add(sp.maxClockSkew())) {
+		return ErrAssertionNotYetValid
 	}
-	if assertion.Conditions.AudienceRestriction.Audience.Value != sp.MetadataURL {
-		return fmt.Errorf("Conditions AudienceRestriction is not %q", sp.MetadataURL)
+	if conditions.NotOnOrAfter.Before(now) {
+		return ErrAssertionExpired
 	}
 	return nil
 }
+
+// validateAudience checks that conditions restrict the assertion to an
+// audience that includes us. Other audiences may be listed besides us.
+func (sp *ServiceProvider) validateAudience(conditions *Conditions) error {
+	if conditions.AudienceRestriction != nil {
+		for _, audience := range conditions.AudienceRestriction.audiences() {
+			if audience.Value == sp.MetadataURL {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Conditions AudienceRestriction is not %q", sp.MetadataURL)
+}
@@ -0,0 +1,373 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/tambeti/saml/xmlsec"
+)
+
+const (
+	protocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	assertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	dsigNamespace      = "http://www.w3.org/2000/09/xmldsig#"
+)
+
+const soapEnvelopeNamespace = "http://schemas.xmlsoap.org/soap/envelope/"
+
+var (
+	responseName           = xml.Name{Space: protocolNamespace, Local: "Response"}
+	logoutRequestName      = xml.Name{Space: protocolNamespace, Local: "LogoutRequest"}
+	soapEnvelopeName       = xml.Name{Space: soapEnvelopeNamespace, Local: "Envelope"}
+	soapBodyName           = xml.Name{Space: soapEnvelopeNamespace, Local: "Body"}
+	assertionName          = xml.Name{Space: assertionNamespace, Local: "Assertion"}
+	encryptedAssertionName = xml.Name{Space: assertionNamespace, Local: "EncryptedAssertion"}
+	signatureName          = xml.Name{Space: dsigNamespace, Local: "Signature"}
+	issuerName             = xml.Name{Space: assertionNamespace, Local: "Issuer"}
+)
+
+// responseChildren are the elements that may appear directly within a
+// Response, with the number of times each may appear.
+var responseChildren = map[xml.Name]int{
+	{Space: assertionNamespace, Local: "Issuer"}:    1,
+	{Space: dsigNamespace, Local: "Signature"}:      1,
+	{Space: protocolNamespace, Local: "Extensions"}: 1,
+	{Space: protocolNamespace, Local: "Status"}:     1,
+	assertionName:          1,
+	encryptedAssertionName: 1,
+}
+
+// assertionChildren are the elements that may appear directly within an
+// Assertion, with the number of times each may appear. Although SAML allows
+// several statements of each kind, we only look at one of them.
+var assertionChildren = map[xml.Name]int{
+	{Space: assertionNamespace, Local: "Issuer"}:             1,
+	{Space: dsigNamespace, Local: "Signature"}:               1,
+	{Space: assertionNamespace, Local: "Subject"}:            1,
+	{Space: assertionNamespace, Local: "Conditions"}:         1,
+	{Space: assertionNamespace, Local: "Advice"}:             1,
+	{Space: assertionNamespace, Local: "AuthnStatement"}:     1,
+	{Space: assertionNamespace, Local: "AttributeStatement"}: 1,
+}
+
+// textElements are the elements of an assertion whose text ParseResponse
+// reads. encoding/xml joins the text on either side of a comment, as does
+// the canonicalization that a signature covers, so "admin<!---->@evil.com"
+// reads as the "admin@evil.com" that was signed. But code that reads the
+// text of the XML in other ways may stop at the comment and see just
+// "admin", so checkStructure rejects comments within these elements.
+var textElements = map[xml.Name]bool{
+	issuerName: true,
+	{Space: assertionNamespace, Local: "NameID"}:                  true,
+	{Space: assertionNamespace, Local: "AttributeValue"}:          true,
+	{Space: assertionNamespace, Local: "Audience"}:                true,
+	{Space: assertionNamespace, Local: "AuthnContextClassRef"}:    true,
+	{Space: assertionNamespace, Local: "AuthenticatingAuthority"}: true,
+}
+
+// checkResponseStructure returns an error if the Response in buf has more
+// than one assertion directly within it, or more than one Issuer directly
+// within it or its Assertion: encoding/xml reads only the last of them, so
+// a signature wrapping attack could add one that other parsers read, next
+// to the one the IDP signed.
+//
+// If strict, as with StrictXML, it also returns an error unless buf holds
+// exactly one Response element, with a Status and the children SAML
+// allows, no DTD, no duplicate IDs, no Response or Assertion elements
+// anywhere else, and no comments within textElements. These are the
+// properties that signature wrapping attacks rely on violating, e.g. by
+// moving the signed assertion into Extensions and putting a forged one in
+// its place.
+func checkResponseStructure(buf []byte, strict bool) error {
+	counts, err := checkStructure(buf, responseName, responseChildren, strict)
+	if err != nil {
+		return err
+	}
+	if strict && counts[xml.Name{Space: protocolNamespace, Local: "Status"}] == 0 {
+		return fmt.Errorf("malformed Response: no Status")
+	}
+	if counts[assertionName]+counts[encryptedAssertionName] > 1 {
+		return ErrMultipleAssertions
+	}
+	return nil
+}
+
+// checkAssertionStructure is like checkResponseStructure, but for the
+// Assertion of an EncryptedAssertion once it has been decrypted.
+func checkAssertionStructure(buf []byte, strict bool) error {
+	_, err := checkStructure(buf, assertionName, assertionChildren, strict)
+	return err
+}
+
+// checkStructure walks the tokens of buf, whose root element is root, once.
+// It returns how often each element appears directly within the root, and
+// an error if the root, or an Assertion directly within it, has more than
+// one Issuer. If strict, it also checks that buf holds exactly one root
+// element, whose children are all in children and appear at most as often
+// as allowed, along with the rest of what checkResponseStructure describes.
+func checkStructure(buf []byte, root xml.Name, children map[xml.Name]int, strict bool) (map[xml.Name]int, error) {
+	malformed := func(format string, args ...interface{}) error {
+		return fmt.Errorf("malformed %s: %s", root.Local, fmt.Sprintf(format, args...))
+	}
+
+	counts := map[xml.Name]int{}
+	ids := map[string]bool{}
+	depth, assertionIssuers := 0, 0
+	var path []xml.Name
+	seenRoot := false
+	d := xml.NewDecoder(bytes.NewReader(buf))
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !strict {
+				return nil, fmt.Errorf("cannot unmarshal %s: %s", strings.ToLower(root.Local), err)
+			}
+			return nil, malformed("%s", err)
+		}
+
+		switch t := token.(type) {
+		case xml.Directive:
+			if strict {
+				return nil, malformed("DTDs are not allowed")
+			}
+		case xml.Comment:
+			if strict && depth > 0 && textElements[path[depth-1]] {
+				return nil, malformed("comment within %s", path[depth-1].Local)
+			}
+		case xml.CharData:
+			if strict && depth == 0 && len(bytes.TrimSpace(t)) > 0 {
+				return nil, malformed("text outside of the %s element", root.Local)
+			}
+		case xml.StartElement:
+			if depth == 1 {
+				counts[t.Name]++
+				if t.Name == assertionName {
+					assertionIssuers = 0
+				}
+			}
+			if strict {
+				switch {
+				case depth == 0 && seenRoot:
+					return nil, malformed("more than one top-level element")
+				case depth == 0 && t.Name != root:
+					return nil, malformed("unexpected top-level element {%s}%s", t.Name.Space, t.Name.Local)
+				case depth == 0:
+					seenRoot = true
+				case depth == 1:
+					max, ok := children[t.Name]
+					if !ok {
+						return nil, malformed("unexpected element {%s}%s", t.Name.Space, t.Name.Local)
+					}
+					if counts[t.Name] > max {
+						return nil, malformed("more than %d %s", max, t.Name.Local)
+					}
+				}
+
+				// Assertions may only appear directly within the Response.
+				nested := t.Name == responseName && depth > 0
+				if t.Name == assertionName || t.Name == encryptedAssertionName {
+					nested = depth > 1 || (depth == 1 && root != responseName)
+				}
+				if nested {
+					return nil, malformed("%s is nested too deeply", t.Name.Local)
+				}
+
+				for _, attr := range t.Attr {
+					if attr.Name.Space == "" && attr.Name.Local == "ID" {
+						if ids[attr.Value] {
+							return nil, malformed("duplicate ID %q", attr.Value)
+						}
+						ids[attr.Value] = true
+					}
+				}
+			}
+
+			if t.Name == issuerName {
+				switch {
+				case depth == 1 && counts[t.Name] > 1:
+					return nil, fmt.Errorf("expected at most one Issuer in the %s", path[0].Local)
+				case depth == 2 && path[1] == assertionName:
+					assertionIssuers++
+					if assertionIssuers > 1 {
+						return nil, fmt.Errorf("expected at most one Issuer in the %s", path[1].Local)
+					}
+				}
+			}
+			depth++
+			path = append(path, t.Name)
+		case xml.EndElement:
+			depth--
+			path = path[:depth]
+		}
+	}
+	if strict && !seenRoot {
+		return nil, malformed("no %s element", root.Local)
+	}
+	return counts, nil
+}
+
+// checkLogoutRequestEnvelope returns an error unless buf holds a SOAP
+// envelope with exactly one LogoutRequest, directly within its Body, with at
+// most one Signature directly within it, and no DTD or duplicate IDs, so
+// that the LogoutRequest and signature that are verified are the ones that
+// are read.
+func checkLogoutRequestEnvelope(buf []byte) error {
+	malformed := func(format string, args ...interface{}) error {
+		return fmt.Errorf("malformed SOAP envelope: %s", fmt.Sprintf(format, args...))
+	}
+
+	var path []xml.Name
+	ids := map[string]bool{}
+	roots, logoutRequests, signatures := 0, 0, 0
+	d := xml.NewDecoder(bytes.NewReader(buf))
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return malformed("%s", err)
+		}
+
+		switch t := token.(type) {
+		case xml.Directive:
+			return malformed("DTDs are not allowed")
+		case xml.StartElement:
+			if len(path) == 0 {
+				roots++
+				if roots > 1 {
+					return malformed("more than one top-level element")
+				}
+				if t.Name != soapEnvelopeName {
+					return malformed("unexpected top-level element {%s}%s", t.Name.Space, t.Name.Local)
+				}
+			}
+			if t.Name == logoutRequestName {
+				logoutRequests++
+				if len(path) != 2 || path[1] != soapBodyName {
+					return malformed("LogoutRequest is not directly within the Body")
+				}
+			}
+			if t.Name == signatureName && len(path) == 3 && path[2] == logoutRequestName {
+				signatures++
+				if signatures > 1 {
+					return malformed("more than one Signature within the LogoutRequest")
+				}
+			}
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "" && attr.Name.Local == "ID" {
+					if ids[attr.Value] {
+						return malformed("duplicate ID %q", attr.Value)
+					}
+					ids[attr.Value] = true
+				}
+			}
+			path = append(path, t.Name)
+		case xml.EndElement:
+			path = path[:len(path)-1]
+		}
+	}
+	if logoutRequests != 1 {
+		return malformed("expected one LogoutRequest, found %d", logoutRequests)
+	}
+	return nil
+}
+
+// signedElement is an element that ParseResponse reads, and the signature
+// it carries, if any.
+type signedElement struct {
+	Name      xml.Name
+	ID        string
+	Signature *xmlsec.Signature
+}
+
+// resolveSignatures sets the Signature of resp and of its plaintext
+// Assertion from the signatures that are children of the Response element
+// in raw, by the element that each references rather than by where it is.
+// Most IDPs envelope the signature of each element within it, but some put
+// a detached signature of the Assertion next to it, which encoding/xml
+// takes for the signature of the Response. A detached signature is only
+// attributed to the Assertion if the Assertion has no signature of its own.
+func resolveSignatures(resp *Response, raw []byte) error {
+	children := struct {
+		Signatures []xmlsec.Signature `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+	}{}
+	if err := xml.Unmarshal(raw, &children); err != nil {
+		return err
+	}
+
+	resp.Signature = nil
+	for i := range children.Signatures {
+		signature := &children.Signatures[i]
+		uri := signature.SignedInfo.Reference.URI
+		switch {
+		case resp.Assertion != nil && resp.Assertion.Signature == nil && uri == "#"+resp.Assertion.ID:
+			resp.Assertion.Signature = signature
+		case resp.Signature == nil:
+			resp.Signature = signature
+		default:
+			return fmt.Errorf("expected at most one signature on the Response, found %d", len(children.Signatures))
+		}
+	}
+	return nil
+}
+
+// checkSignatureReferences guards against XML signature wrapping. xmlsec1
+// verifies the first signature it finds and the element that signature
+// references by ID, which need not be the element that encoding/xml hands
+// us. So before we trust its verdict we check that each of elements occurs
+// exactly once in buf, that each signature references the ID of its own
+// element, that this ID is unique in buf, and that buf contains no
+// signatures other than those of elements.
+func checkSignatureReferences(buf []byte, elements ...signedElement) error {
+	names := map[xml.Name]int{}
+	ids := map[string]int{}
+	d := xml.NewDecoder(bytes.NewReader(buf))
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if t, ok := token.(xml.StartElement); ok {
+			names[t.Name]++
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "" && attr.Name.Local == "ID" {
+					ids[attr.Value]++
+				}
+			}
+		}
+	}
+
+	signatures := 0
+	for _, e := range elements {
+		if names[e.Name] != 1 {
+			return fmt.Errorf("expected exactly one %s element, found %d", e.Name.Local, names[e.Name])
+		}
+		if e.Signature == nil {
+			continue
+		}
+		signatures++
+		if e.ID == "" {
+			return fmt.Errorf("signed %s has no ID", e.Name.Local)
+		}
+		if ids[e.ID] != 1 {
+			return fmt.Errorf("ID %q of the %s is not unique", e.ID, e.Name.Local)
+		}
+		if uri := e.Signature.SignedInfo.Reference.URI; uri != "#"+e.ID {
+			return fmt.Errorf("signature on the %s references %q, not %q", e.Name.Local, uri, "#"+e.ID)
+		}
+	}
+	if names[signatureName] != signatures {
+		return fmt.Errorf("expected %d signatures, found %d", signatures, names[signatureName])
+	}
+	return nil
+}
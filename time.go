@@ -1,6 +1,12 @@
 package saml
 
-import "time"
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type RelaxedTime time.Time
 
@@ -29,3 +35,78 @@ func (m *RelaxedTime) UnmarshalText(text []byte) error {
 
 	return err1
 }
+
+// Duration is a time.Duration that is represented in XML as an xs:duration,
+// e.g. "PT1H30M". When parsing, a year is taken to be 365 days and a month
+// 30 days.
+type Duration time.Duration
+
+var durationRegexp = regexp.MustCompile(`^(-?)P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+func (d Duration) MarshalText() ([]byte, error) {
+	v := time.Duration(d)
+	if v == 0 {
+		return []byte("PT0S"), nil
+	}
+	rv := "P"
+	if v < 0 {
+		rv = "-P"
+		v = -v
+	}
+	if days := v / (24 * time.Hour); days > 0 {
+		rv += fmt.Sprintf("%dD", days)
+		v -= days * 24 * time.Hour
+	}
+	if v == 0 {
+		return []byte(rv), nil
+	}
+	rv += "T"
+	if hours := v / time.Hour; hours > 0 {
+		rv += fmt.Sprintf("%dH", hours)
+		v -= hours * time.Hour
+	}
+	if minutes := v / time.Minute; minutes > 0 {
+		rv += fmt.Sprintf("%dM", minutes)
+		v -= minutes * time.Minute
+	}
+	if v > 0 {
+		rv += strconv.FormatFloat(v.Seconds(), 'f', -1, 64) + "S"
+	}
+	return []byte(rv), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*d = 0
+		return nil
+	}
+	m := durationRegexp.FindStringSubmatch(string(text))
+	if m == nil || string(text) == "P" || string(text) == "-P" || strings.HasSuffix(string(text), "T") {
+		return fmt.Errorf("invalid duration %q", text)
+	}
+
+	var v time.Duration
+	units := []time.Duration{365 * 24 * time.Hour, 30 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute}
+	for i, unit := range units {
+		if m[i+2] == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(m[i+2], 10, 64)
+		if err != nil {
+			return err
+		}
+		v += time.Duration(n) * unit
+	}
+	if m[7] != "" {
+		s, err := strconv.ParseFloat(m[7], 64)
+		if err != nil {
+			return err
+		}
+		v += time.Duration(s * float64(time.Second))
+	}
+	if m[1] == "-" {
+		v = -v
+	}
+	*d = Duration(v)
+	return nil
+}
@@ -1,7 +1,16 @@
 package saml
 
 import (
+	"bytes"
+	"compress/flate"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -14,6 +23,196 @@ var TimeNow = func() time.Time { return time.Now().UTC() }
 // rand.Reader, but it can be replaced for testing.
 var RandReader = rand.Reader
 
+// PostFormValues returns the url-encoded form values in the body of r
+// without consuming it. If r.PostForm has already been populated (for
+// example by r.ParseForm) it is returned as is. Otherwise the body is read,
+// parsed and then replaced with an equivalent reader so that other handlers
+// (or an upstream middleware that buffered the body) can read it again.
+func PostFormValues(r *http.Request) (url.Values, error) {
+	if r.PostForm != nil {
+		return r.PostForm, nil
+	}
+	if r.Body == nil {
+		return url.Values{}, nil
+	}
+	buf, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	return url.ParseQuery(string(buf))
+}
+
+// DecodeMessage decodes a SAML protocol message, i.e. the value of a
+// SAMLRequest or SAMLResponse parameter, that was received with binding.
+// With HTTPPostBinding the message is only base64 encoded, and with
+// HTTPRedirectBinding it is DEFLATE compressed before being base64 encoded.
+// The decoding is chosen by the binding alone, never by looking at the
+// message, so a message sent with one binding is not mistakenly decoded as
+// if it were sent with the other. A UTF-8 byte order mark and whitespace
+// before the XML are removed, see trimXMLPrefix. A message that decodes to
+// more than DefaultMaxMessageSize bytes is rejected with a
+// MessageTooLargeError.
+func DecodeMessage(binding, encoded string) ([]byte, error) {
+	return decodeMessage(binding, encoded, DefaultMaxMessageSize)
+}
+
+// decodeMessage is like DecodeMessage, but rejects messages that decode to
+// more than max bytes, before decoding more of them than that.
+func decodeMessage(binding, encoded string, max int) ([]byte, error) {
+	switch binding {
+	case HTTPPostBinding, HTTPRedirectBinding:
+	default:
+		return nil, fmt.Errorf("cannot decode message: unsupported binding %q", binding)
+	}
+
+	if binding == HTTPPostBinding && base64.StdEncoding.DecodedLen(len(encoded)) > max+2 {
+		// DecodedLen does not count padding, which may add 2 bytes
+		return nil, &MessageTooLargeError{Max: max}
+	}
+	buf, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse base64: %s", err)
+	}
+	if binding == HTTPPostBinding {
+		if len(buf) > max {
+			return nil, &MessageTooLargeError{Max: max}
+		}
+		return trimXMLPrefix(buf), nil
+	}
+	buf, err = ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(buf)), int64(max)+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot inflate: %s", err)
+	}
+	if len(buf) > max {
+		return nil, &MessageTooLargeError{Max: max}
+	}
+	return trimXMLPrefix(buf), nil
+}
+
+// limitBody makes reading the body of r fail with a MessageTooLargeError
+// for max once more than twice max bytes have been read, allowing for the
+// encoding of a message of max bytes, unless its form has already been
+// parsed.
+func limitBody(r *http.Request, max int) {
+	if r.PostForm != nil || r.Body == nil {
+		return
+	}
+	if _, ok := r.Body.(*limitedBody); ok {
+		return
+	}
+	r.Body = &limitedBody{ReadCloser: r.Body, max: max, remaining: 2*int64(max) + 1}
+}
+
+// limitedBody is a request body that limitBody limits.
+type limitedBody struct {
+	io.ReadCloser
+	max       int
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, &MessageTooLargeError{Max: b.max}
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining <= 0 {
+		return n, &MessageTooLargeError{Max: b.max}
+	}
+	return n, err
+}
+
+// utf8BOM is the byte order mark that some IDPs put before the XML of a
+// message, although UTF-8 needs none.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// trimXMLPrefix returns buf without the UTF-8 byte order marks and
+// whitespace that precede its XML. They are not part of any element, so
+// no signature covers them, but libxml2, and so xmlsec1, rejects an XML
+// declaration that does not come first, and StrictXML would take a byte
+// order mark for text outside of the root element. Once they are gone,
+// encoding/xml and xmlsec1 read the same bytes in the same way.
+func trimXMLPrefix(buf []byte) []byte {
+	for {
+		trimmed := bytes.TrimPrefix(bytes.TrimLeft(buf, " \t\r\n"), utf8BOM)
+		if len(trimmed) == len(buf) {
+			return buf
+		}
+		buf = trimmed
+	}
+}
+
+// IndentMessage decodes a SAML protocol message like DecodeMessage and
+// returns its XML indented for reading, e.g. by a command line tool for
+// debugging responses. Namespace prefixes are kept as they are. Whitespace
+// between elements is changed, so the result is not what was signed and
+// must not be parsed in place of the message.
+func IndentMessage(binding, encoded string) ([]byte, error) {
+	buf, err := DecodeMessage(binding, encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(buf))
+	rv := bytes.Buffer{}
+	e := xml.NewEncoder(&rv)
+	e.Indent("", "  ")
+	depth := 0
+	for {
+		token, err := d.RawToken()
+		if err == io.EOF && depth != 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse message: %s", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			start := xml.StartElement{Name: prefixedName(t.Name)}
+			for _, attr := range t.Attr {
+				start.Attr = append(start.Attr, xml.Attr{Name: prefixedName(attr.Name), Value: attr.Value})
+			}
+			token = start
+			depth++
+		case xml.EndElement:
+			token = xml.EndElement{Name: prefixedName(t.Name)}
+			depth--
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) == 0 {
+				continue
+			}
+		case xml.ProcInst:
+			if t.Target == "xml" {
+				continue
+			}
+		}
+		if err := e.EncodeToken(token); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.Flush(); err != nil {
+		return nil, err
+	}
+	return rv.Bytes(), nil
+}
+
+// prefixedName returns name, as returned by xml.Decoder.RawToken, with its
+// prefix in Local, so that xml.Encoder writes it unchanged.
+func prefixedName(name xml.Name) xml.Name {
+	if name.Space == "" {
+		return name
+	}
+	return xml.Name{Local: name.Space + ":" + name.Local}
+}
+
 func randomBytes(n int) ([]byte, error) {
 	rv := make([]byte, n)
 	if _, err := RandReader.Read(rv); err != nil {
@@ -0,0 +1,113 @@
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// CertificateExpiryWarning is how long before a certificate in the IDP
+// metadata expires ValidateIDPMetadata starts warning about it.
+const CertificateExpiryWarning = 30 * 24 * time.Hour
+
+// Warning is a problem with IDP metadata found by ValidateIDPMetadata. Logins
+// may still work, but often the problem otherwise only shows when they fail.
+type Warning struct {
+	Message string
+}
+
+func (w Warning) String() string {
+	return w.Message
+}
+
+// ValidateIDPMetadata checks md, the metadata of an IDP, for common problems
+// such as a missing single sign-on endpoint or signing certificate and
+// certificates that have expired or expire within CertificateExpiryWarning,
+// so that they can be reported when the metadata is configured rather than
+// at login. It returns nil if it finds none.
+func ValidateIDPMetadata(md *Metadata) []Warning {
+	var warnings []Warning
+	warn := func(format string, args ...interface{}) {
+		warnings = append(warnings, Warning{Message: fmt.Sprintf(format, args...)})
+	}
+	if md == nil {
+		warn("there is no metadata")
+		return warnings
+	}
+
+	now := TimeNow()
+	if md.EntityID == "" {
+		warn("entityID is not set")
+	}
+	if !md.ValidUntil.IsZero() && md.ValidUntil.Before(now) {
+		warn("metadata expired on %s", md.ValidUntil)
+	}
+	idp := md.IDPSSODescriptor
+	if idp == nil {
+		warn("there is no IDPSSODescriptor")
+		return warnings
+	}
+
+	bindings := map[string]bool{}
+	for _, endpoint := range idp.SingleSignOnService {
+		bindings[endpoint.Binding] = true
+		if u, err := url.Parse(endpoint.Location); err != nil || u.Scheme == "" || u.Host == "" {
+			warn("SingleSignOnService location %q is not an absolute URL", endpoint.Location)
+		}
+	}
+	if len(idp.SingleSignOnService) == 0 {
+		warn("there is no SingleSignOnService")
+	} else if !bindings[HTTPRedirectBinding] {
+		warn("there is no SingleSignOnService with the %s binding", HTTPRedirectBinding)
+	}
+	sloBindings := map[string]bool{}
+	for _, endpoint := range idp.SingleLogoutService {
+		sloBindings[endpoint.Binding] = true
+	}
+	if !sloBindings[HTTPRedirectBinding] {
+		warn("there is no SingleLogoutService with the %s binding, so logouts are not sent to the IDP", HTTPRedirectBinding)
+	}
+
+	hasSigningCert := false
+	for _, keyDescriptor := range idp.KeyDescriptor {
+		if keyDescriptor.KeyInfo.Certificate == "" {
+			continue
+		}
+		if keyDescriptor.Use == "signing" || keyDescriptor.Use == "" {
+			hasSigningCert = true
+		}
+		certBytes, err := base64.StdEncoding.DecodeString(regexp.MustCompile(`\s+`).ReplaceAllString(keyDescriptor.KeyInfo.Certificate, ""))
+		if err != nil {
+			warn("cannot decode %s certificate: %s", keyUse(keyDescriptor), err)
+			continue
+		}
+		cert, err := x509.ParseCertificate(certBytes)
+		if err != nil {
+			warn("cannot parse %s certificate: %s", keyUse(keyDescriptor), err)
+			continue
+		}
+		switch {
+		case now.After(cert.NotAfter):
+			warn("%s certificate %q expired on %s", keyUse(keyDescriptor), cert.Subject.CommonName, cert.NotAfter)
+		case now.Add(CertificateExpiryWarning).After(cert.NotAfter):
+			warn("%s certificate %q expires on %s", keyUse(keyDescriptor), cert.Subject.CommonName, cert.NotAfter)
+		case now.Before(cert.NotBefore):
+			warn("%s certificate %q is not valid until %s", keyUse(keyDescriptor), cert.Subject.CommonName, cert.NotBefore)
+		}
+	}
+	if !hasSigningCert {
+		warn("there is no signing certificate")
+	}
+	return warnings
+}
+
+// keyUse describes the use of keyDescriptor for warnings.
+func keyUse(keyDescriptor KeyDescriptor) string {
+	if keyDescriptor.Use == "" {
+		return "signing and encryption"
+	}
+	return keyDescriptor.Use
+}
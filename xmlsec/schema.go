@@ -6,7 +6,16 @@ import (
 
 // Method is part of Signature.
 type Method struct {
-	Algorithm string `xml:",attr"`
+	Algorithm           string               `xml:",attr"`
+	InclusiveNamespaces *InclusiveNamespaces `xml:"http://www.w3.org/2001/10/xml-exc-c14n# InclusiveNamespaces,omitempty"`
+}
+
+// InclusiveNamespaces is the parameter of the exclusive canonicalization
+// methods. PrefixList is a space separated list of namespace prefixes that
+// are treated as in inclusive canonicalization, i.e. whose declarations are
+// kept even where they are only used in content, as in xsi:type="xs:string".
+type InclusiveNamespaces struct {
+	PrefixList string `xml:",attr"`
 }
 
 // Signature is a model for the Signature object specified by XMLDSIG. This is
@@ -45,7 +54,9 @@ type Reference struct {
 	DigestValue         string   `xml:"DigestValue"`
 }
 
-// SignatureX509Data represents the <X509Data> element of <Signature>
+// SignatureX509Data represents the <X509Data> element of <Signature>. The
+// first certificate is the signing certificate, any others are intermediate
+// certificates of its chain.
 type SignatureX509Data struct {
-	X509Certificate string `xml:"X509Certificate,omitempty"`
+	X509Certificates []string `xml:"X509Certificate,omitempty"`
 }
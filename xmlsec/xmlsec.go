@@ -4,9 +4,12 @@
 package xmlsec
 
 import (
+	"context"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/xml"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -19,8 +22,164 @@ const (
 	xmlAssertionID = "urn:oasis:names:tc:SAML:2.0:assertion:Assertion"
 	xmlResponseID  = "urn:oasis:names:tc:SAML:2.0:protocol:Response"
 	xmlRequestID   = "urn:oasis:names:tc:SAML:2.0:protocol:AuthnRequest"
+
+	xmlLogoutRequestID  = "urn:oasis:names:tc:SAML:2.0:protocol:LogoutRequest"
+	xmlLogoutResponseID = "urn:oasis:names:tc:SAML:2.0:protocol:LogoutResponse"
+
+	assertionSignatureXPath = "//*[local-name()='Assertion' and namespace-uri()='urn:oasis:names:tc:SAML:2.0:assertion']" +
+		"/*[local-name()='Signature' and namespace-uri()='http://www.w3.org/2000/09/xmldsig#']"
+
+	// referencingSignatureXPath selects the signatures whose Reference has
+	// the URI that is substituted for %s.
+	referencingSignatureXPath = "//*[local-name()='Signature' and namespace-uri()='http://www.w3.org/2000/09/xmldsig#']" +
+		"[*[local-name()='SignedInfo']/*[local-name()='Reference' and @URI='%s']]"
+
+	// logoutRequestSignatureXPath selects the signature directly within
+	// the LogoutRequest whose ID is substituted for both %s, if it
+	// references that LogoutRequest.
+	logoutRequestSignatureXPath = "//*[local-name()='LogoutRequest' and namespace-uri()='urn:oasis:names:tc:SAML:2.0:protocol' and @ID='%s']" +
+		"/*[local-name()='Signature' and namespace-uri()='http://www.w3.org/2000/09/xmldsig#']" +
+		"[*[local-name()='SignedInfo']/*[local-name()='Reference' and @URI='#%s']]"
+)
+
+// XML signature algorithm identifiers
+const (
+	RSASHA1   = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+	RSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	RSASHA512 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+
+	// RSASSA-PSS, with MGF1 using the same digest, as RFC 6931 defines
+	// them. They need xmlsec1 1.3.0 or later.
+	RSAPSSSHA256 = "http://www.w3.org/2007/05/xmldsig-more#sha256-rsa-MGF1"
+	RSAPSSSHA512 = "http://www.w3.org/2007/05/xmldsig-more#sha512-rsa-MGF1"
+
+	SHA1   = "http://www.w3.org/2000/09/xmldsig#sha1"
+	SHA256 = "http://www.w3.org/2001/04/xmlenc#sha256"
+	SHA512 = "http://www.w3.org/2001/04/xmlenc#sha512"
+)
+
+// XML data encryption algorithm identifiers. The GCM methods need xmlsec1
+// 1.2.27 or later, built with OpenSSL 1.1.
+const (
+	AES128CBC    = "http://www.w3.org/2001/04/xmlenc#aes128-cbc"
+	AES192CBC    = "http://www.w3.org/2001/04/xmlenc#aes192-cbc"
+	AES256CBC    = "http://www.w3.org/2001/04/xmlenc#aes256-cbc"
+	TripleDESCBC = "http://www.w3.org/2001/04/xmlenc#tripledes-cbc"
+	AES128GCM    = "http://www.w3.org/2009/xmlenc11#aes128-gcm"
+	AES256GCM    = "http://www.w3.org/2009/xmlenc11#aes256-gcm"
+)
+
+// XML key transport algorithm identifiers, with the mask generation
+// functions of RSAOAEP. RSAOAEPMGF1P always uses MGF1 with SHA-1, whatever
+// its digest method. RSAOAEP needs xmlsec1 1.2.26 or later. RSA15, RSA
+// PKCS#1 v1.5, is open to padding oracle attacks, so it is only ever
+// decrypted, and only with DecryptOptions.AllowRSA15.
+const (
+	RSAOAEPMGF1P = "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"
+	RSAOAEP      = "http://www.w3.org/2009/xmlenc11#rsa-oaep"
+	RSA15        = "http://www.w3.org/2001/04/xmlenc#rsa-1_5"
+
+	MGF1SHA1   = "http://www.w3.org/2009/xmlenc11#mgf1sha1"
+	MGF1SHA256 = "http://www.w3.org/2009/xmlenc11#mgf1sha256"
+	MGF1SHA512 = "http://www.w3.org/2009/xmlenc11#mgf1sha512"
+)
+
+// KeyTransport describes how the session key of an EncryptedData is
+// encrypted to the recipient, as the EncryptionMethod of its EncryptedKey
+// does. An empty DigestMethod means SHA1, and an empty MGF means MGF1SHA1.
+type KeyTransport struct {
+	Algorithm    string
+	DigestMethod string
+	MGF          string
+}
+
+// DefaultKeyTransport is the key transport that Encrypt and
+// EncryptWithMethod use, and that all SAML implementations support.
+var DefaultKeyTransport = KeyTransport{Algorithm: RSAOAEPMGF1P, DigestMethod: SHA1}
+
+// CheckKeyTransport returns an error unless the algorithm, digest method
+// and mask generation function of keyTransport are supported, and go
+// together. The parameters are passed to xmlsec1 in the EncryptedKey, so
+// they must be right for the decryption to succeed.
+func CheckKeyTransport(keyTransport KeyTransport) error {
+	switch keyTransport.DigestMethod {
+	case "", SHA1, SHA256, SHA512:
+	default:
+		return fmt.Errorf("unsupported key transport digest method %q", keyTransport.DigestMethod)
+	}
+	switch keyTransport.Algorithm {
+	case RSAOAEPMGF1P:
+		if keyTransport.MGF != "" {
+			return fmt.Errorf("key transport %s does not take a mask generation function", RSAOAEPMGF1P)
+		}
+	case RSAOAEP:
+		switch keyTransport.MGF {
+		case "", MGF1SHA1, MGF1SHA256, MGF1SHA512:
+		default:
+			return fmt.Errorf("unsupported key transport mask generation function %q", keyTransport.MGF)
+		}
+	default:
+		return fmt.Errorf("unsupported key transport %q", keyTransport.Algorithm)
+	}
+	return nil
+}
+
+// sessionKeys maps the data encryption methods that Encrypt and Decrypt
+// support to the xmlsec1 session key they use. xmlsec1 takes the cipher
+// mode, and with it the IV, padding and authentication tag handling, from
+// the EncryptionMethod.
+var sessionKeys = map[string]string{
+	AES128CBC:    "aes-128",
+	AES192CBC:    "aes-192",
+	AES256CBC:    "aes-256",
+	TripleDESCBC: "des-192",
+	AES128GCM:    "aes-128",
+	AES256GCM:    "aes-256",
+}
+
+// XML canonicalization and transform algorithm identifiers. The
+// canonicalization itself is done by xmlsec1, which honours the
+// InclusiveNamespaces of the exclusive methods.
+const (
+	C14N                = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"
+	C14NWithComments    = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315#WithComments"
+	ExcC14N             = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	ExcC14NWithComments = "http://www.w3.org/2001/10/xml-exc-c14n#WithComments"
+	EnvelopedSignature  = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
 )
 
+// CheckCanonicalizationMethod returns an error unless method is one of the
+// canonicalization methods that NewSignature supports.
+func CheckCanonicalizationMethod(method string) error {
+	switch method {
+	case C14N, C14NWithComments, ExcC14N, ExcC14NWithComments:
+		return nil
+	}
+	return fmt.Errorf("unsupported canonicalization method %q", method)
+}
+
+// StrictSignatureMethods is a signature method allow-list that excludes SHA-1.
+// Besides the PKCS#1 v1.5 methods it has the RSASSA-PSS ones, which are at
+// least as strong, so that IDPs that sign with those are not turned away.
+var StrictSignatureMethods = []string{RSASHA256, RSASHA512, RSAPSSSHA256, RSAPSSSHA512}
+
+// SignatureDigestMethod returns the digest method that goes with the
+// signature method, or an error if it is not one that we sign with.
+func SignatureDigestMethod(method string) (string, error) {
+	switch method {
+	case RSASHA1:
+		return SHA1, nil
+	case RSASHA256, RSAPSSSHA256:
+		return SHA256, nil
+	case RSASHA512, RSAPSSSHA512:
+		return SHA512, nil
+	}
+	return "", fmt.Errorf("unsupported signature method %q", method)
+}
+
+// StrictDigestMethods is a digest method allow-list that excludes SHA-1.
+var StrictDigestMethods = []string{SHA256, SHA512}
+
 // SignRequest sign a SAML 2.0 AuthnRequest
 func SignRequest(xml string, privateKey *rsa.PrivateKey) (string, error) {
 	return sign(xml, privateKey, xmlRequestID)
@@ -31,6 +190,21 @@ func SignResponse(xml string, privateKey *rsa.PrivateKey) (string, error) {
 	return sign(xml, privateKey, xmlResponseID)
 }
 
+// SignLogoutRequest sign a SAML 2.0 LogoutRequest
+func SignLogoutRequest(xml string, privateKey *rsa.PrivateKey) (string, error) {
+	return sign(xml, privateKey, xmlLogoutRequestID)
+}
+
+// SignLogoutResponse sign a SAML 2.0 LogoutResponse
+func SignLogoutResponse(xml string, privateKey *rsa.PrivateKey) (string, error) {
+	return sign(xml, privateKey, xmlLogoutResponseID)
+}
+
+// SignAssertion sign a SAML 2.0 Assertion
+func SignAssertion(xml string, privateKey *rsa.PrivateKey) (string, error) {
+	return sign(xml, privateKey, xmlAssertionID)
+}
+
 // SignRaw sign plain xml
 func SignRaw(xml string, privateKey string) (string, error) {
 	// FIXME: This method should also take an *rsa.PrivateKey
@@ -62,8 +236,14 @@ func sign(xml string, privateKey *rsa.PrivateKey, id string) (string, error) {
 	defer deleteTempFile(samlXmlsecOutput.Name())
 	samlXmlsecOutput.Close()
 
+	// xmlsec1 fills the KeyName of the template with the name of the key,
+	// so name the key after the KeyName that the template asks for.
+	privateKeyOption := "--privkey-der"
+	if keyName := templateKeyName(xml); keyName != "" {
+		privateKeyOption += ":" + keyName
+	}
 	args := []string{
-		"--sign", "--privkey-der", privateKeyFile.Name(), "--output", samlXmlsecOutput.Name(),
+		"--sign", privateKeyOption, privateKeyFile.Name(), "--output", samlXmlsecOutput.Name(),
 	}
 	if len(id) != 0 {
 		args = append(args, "--id-attr:ID", id)
@@ -82,22 +262,170 @@ func sign(xml string, privateKey *rsa.PrivateKey, id string) (string, error) {
 	return samlSignedRequestXML, nil
 }
 
+// templateKeyName returns the KeyName of the signature template of the root
+// element of doc, if any.
+func templateKeyName(doc string) string {
+	template := struct {
+		Signature *Signature `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+	}{}
+	if err := xml.Unmarshal([]byte(doc), &template); err != nil || template.Signature == nil {
+		return ""
+	}
+	return template.Signature.KeyName
+}
+
+// SignaturePosition is where InsertSignature places a signature template
+// among the children of the root element.
+type SignaturePosition int
+
+const (
+	// SignatureAfterIssuer places the signature after the Issuer of the
+	// element, or first if it has none, which is where the SAML schema
+	// requires it in requests, responses and assertions.
+	SignatureAfterIssuer SignaturePosition = iota
+
+	// SignatureFirst places the signature before all other children.
+	SignatureFirst
+
+	// SignatureLast places the signature after all other children.
+	SignatureLast
+)
+
+// InsertSignature returns doc with template, e.g. from DefaultSignature,
+// inserted among the children of its root element at position, ready to
+// be signed with SignResponse and the like. It is for signing XML that was
+// not marshalled with the template already in place. The root element must
+// not have a signature already.
+func InsertSignature(doc string, template Signature, position SignaturePosition) (string, error) {
+	buf, err := xml.Marshal(template)
+	if err != nil {
+		return "", err
+	}
+
+	d := xml.NewDecoder(strings.NewReader(doc))
+	depth := 0
+	children := 0
+	afterIssuer := false
+	offset := int64(-1)
+	for {
+		before := d.InputOffset()
+		token, err := d.Token()
+		if err != nil {
+			return "", fmt.Errorf("cannot parse document: %s", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 1 {
+				if strings.HasSuffix(doc[:d.InputOffset()], "/>") {
+					return "", fmt.Errorf("cannot insert signature into the empty element %s", t.Name.Local)
+				}
+				if position != SignatureLast {
+					offset = d.InputOffset()
+				}
+			}
+			if depth == 2 {
+				if t.Name.Space == "http://www.w3.org/2000/09/xmldsig#" && t.Name.Local == "Signature" {
+					return "", errors.New("element is already signed")
+				}
+				children++
+				afterIssuer = position == SignatureAfterIssuer && children == 1 &&
+					t.Name.Space == "urn:oasis:names:tc:SAML:2.0:assertion" && t.Name.Local == "Issuer"
+			}
+		case xml.EndElement:
+			depth--
+			if depth == 1 && afterIssuer {
+				offset = d.InputOffset()
+				afterIssuer = false
+			}
+			if depth == 0 {
+				if position == SignatureLast {
+					offset = before
+				}
+				return doc[:offset] + string(buf) + doc[offset:], nil
+			}
+		}
+	}
+}
+
 // VerifyResponseSignature verify signature of a SAML 2.0 Response document
 func VerifyResponseSignature(xml string, publicCert string) error {
-	return verify(xml, publicCert, xmlResponseID)
+	return VerifyResponseSignatureContext(context.Background(), xml, publicCert)
+}
+
+// VerifyResponseSignatureContext is like VerifyResponseSignature, but gives
+// up and returns ctx.Err() if ctx is done before the signature is verified.
+func VerifyResponseSignatureContext(ctx context.Context, xml string, publicCert string) error {
+	return verify(ctx, xml, publicCert, xmlResponseID)
 }
 
 // VerifyResponseSignature verify signature of a SAML 2.0 Assertion document
 func VerifyAssertionSignature(xml string, publicCert string) error {
-	return verify(xml, publicCert, xmlAssertionID)
+	return VerifyAssertionSignatureContext(context.Background(), xml, publicCert)
+}
+
+// VerifyAssertionSignatureContext is like VerifyAssertionSignature, but
+// gives up and returns ctx.Err() if ctx is done before the signature is
+// verified.
+func VerifyAssertionSignatureContext(ctx context.Context, xml string, publicCert string) error {
+	return verify(ctx, xml, publicCert, xmlAssertionID)
+}
+
+// VerifyResponseAssertionSignature verify the signature of the SAML 2.0 Assertion
+// contained in a Response document, ignoring any signature on the Response itself
+func VerifyResponseAssertionSignature(xml string, publicCert string) error {
+	return VerifyResponseAssertionSignatureContext(context.Background(), xml, publicCert)
+}
+
+// VerifyResponseAssertionSignatureContext is like
+// VerifyResponseAssertionSignature, but gives up and returns ctx.Err() if
+// ctx is done before the signature is verified.
+func VerifyResponseAssertionSignatureContext(ctx context.Context, xml string, publicCert string) error {
+	return verify(ctx, xml, publicCert, xmlAssertionID, "--node-xpath", assertionSignatureXPath)
+}
+
+// VerifyElementSignature verifies the signature in the SAML 2.0 Response or
+// Assertion document xml that references the Response or Assertion with ID
+// id, wherever in the document that signature is: enveloped in the element
+// it signs, as usual, or detached from it, e.g. a preceding sibling.
+func VerifyElementSignature(xml string, publicCert string, id string) error {
+	return VerifyElementSignatureContext(context.Background(), xml, publicCert, id)
+}
+
+// VerifyElementSignatureContext is like VerifyElementSignature, but gives
+// up and returns ctx.Err() if ctx is done before the signature is verified.
+func VerifyElementSignatureContext(ctx context.Context, xml string, publicCert string, id string) error {
+	// IDs are NCNames, so one with a quote is bogus and would break out of
+	// the XPath string.
+	if id == "" || strings.ContainsAny(id, `'"`) {
+		return fmt.Errorf("invalid ID %q", id)
+	}
+	return verify(ctx, xml, publicCert, xmlAssertionID, "--id-attr:ID", xmlResponseID,
+		"--node-xpath", fmt.Sprintf(referencingSignatureXPath, "#"+id))
 }
 
 // VerifyRequestSignature verify signature of a SAML 2.0 AuthnRequest document
 func VerifyRequestSignature(xml string, publicCert string) error {
-	return verify(xml, publicCert, xmlRequestID)
+	return verify(context.Background(), xml, publicCert, xmlRequestID)
+}
+
+// VerifyLogoutRequestSignatureContext verifies the signature of the SAML
+// 2.0 LogoutRequest with ID id in the document xml, e.g. the SOAP envelope
+// of a back-channel logout. Only a signature directly within the
+// LogoutRequest counts, not one elsewhere that references it. It gives up
+// and returns ctx.Err() if ctx is done before the signature is verified.
+func VerifyLogoutRequestSignatureContext(ctx context.Context, xml string, publicCert string, id string) error {
+	if id == "" || strings.ContainsAny(id, `'"`) {
+		return fmt.Errorf("invalid ID %q", id)
+	}
+	return verify(ctx, xml, publicCert, xmlLogoutRequestID,
+		"--node-xpath", fmt.Sprintf(logoutRequestSignatureXPath, id, id))
 }
 
-func verify(xml string, publicCert string, id string) error {
+func verify(ctx context.Context, xml string, publicCert string, id string, extraArgs ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	publicCertFile, err := writeToTemp(publicCert)
 	if err != nil {
@@ -111,46 +439,156 @@ func verify(xml string, publicCert string, id string) error {
 	}
 	defer deleteTempFile(samlXmlsecInput.Name())
 
-	output, err := exec.Command("xmlsec1", "--verify", "--pubkey-cert-pem", publicCertFile.Name(), "--id-attr:ID", id, samlXmlsecInput.Name()).CombinedOutput()
+	// A signature that identifies its key with a KeyName only verifies with
+	// a key of that name, so the key is also loaded under each KeyName in
+	// xml, besides unnamed for the signatures that have none. The caller
+	// has already chosen publicCert as the trusted key.
+	args := []string{"--verify", "--pubkey-cert-pem", publicCertFile.Name()}
+	for _, name := range keyNames(xml) {
+		args = append(args, "--pubkey-cert-pem:"+name, publicCertFile.Name())
+	}
+	args = append(args, "--id-attr:ID", id)
+	args = append(args, extraArgs...)
+	args = append(args, samlXmlsecInput.Name())
+	output, err := exec.CommandContext(ctx, "xmlsec1", args...).CombinedOutput()
+	if ctx.Err() != nil {
+		// xmlsec1 was killed
+		return ctx.Err()
+	}
 	if err != nil {
 		return errors.New(err.Error() + " : " + string(output))
 	}
 	return nil
 }
 
+// keyNames returns the distinct KeyNames in the signatures of doc.
+func keyNames(doc string) []string {
+	var names []string
+	seen := map[string]bool{}
+	decoder := xml.NewDecoder(strings.NewReader(doc))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return names
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Space != "http://www.w3.org/2000/09/xmldsig#" || start.Name.Local != "KeyName" {
+			continue
+		}
+		var name string
+		if err := decoder.DecodeElement(&name, &start); err != nil {
+			return names
+		}
+		name = strings.TrimSpace(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+}
+
+// CheckAlgorithms returns an error if signature uses a signature method that
+// is not in signatureMethods or a digest method that is not in digestMethods.
+// An empty list allows any algorithm.
+func CheckAlgorithms(signature *Signature, signatureMethods, digestMethods []string) error {
+	if !algorithmAllowed(signature.SignedInfo.SignatureMethod.Algorithm, signatureMethods) {
+		return fmt.Errorf("signature method %q is not allowed", signature.SignedInfo.SignatureMethod.Algorithm)
+	}
+	if !algorithmAllowed(signature.SignedInfo.Reference.DigestMethod.Algorithm, digestMethods) {
+		return fmt.Errorf("digest method %q is not allowed", signature.SignedInfo.Reference.DigestMethod.Algorithm)
+	}
+	return nil
+}
+
+// CheckTransforms returns an error unless the transforms of the Reference
+// of signature are all the enveloped signature transform or a
+// canonicalization method, and the SignedInfo is canonicalized with one of
+// the canonicalization methods. Other transforms, such as XPath and XSLT,
+// let a signature cover something other than the signed element, and
+// XSLT lets the document run code in xmlsec1.
+func CheckTransforms(signature *Signature) error {
+	if err := CheckCanonicalizationMethod(signature.SignedInfo.CanonicalizationMethod.Algorithm); err != nil {
+		return err
+	}
+	for _, transform := range signature.SignedInfo.Reference.ReferenceTransforms {
+		if transform.Algorithm == EnvelopedSignature {
+			continue
+		}
+		if CheckCanonicalizationMethod(transform.Algorithm) != nil {
+			return fmt.Errorf("transform %q is not allowed", transform.Algorithm)
+		}
+	}
+	return nil
+}
+
+func algorithmAllowed(algorithm string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
 // DefaultSignature returns a Signature struct that uses the default c14n and SHA1 settings.
-// certificate is an x509 certificate in base64-d DER format.
-func DefaultSignature(certificate string) Signature {
+// certificate is an x509 certificate in base64-d DER format. intermediates,
+// in the same format, are included after it in the X509Data so that relying
+// parties can build a path to their trust anchor.
+//
+// The SignedInfo is canonicalized with exclusive c14n. The Reference has
+// no canonicalization transform, so, as XMLDSIG prescribes, the signed
+// element is digested with inclusive c14n. Use NewSignature to have both
+// use the same method.
+func DefaultSignature(certificate string, intermediates ...string) Signature {
 	return Signature{
 		Id: "Signature1",
 		SignedInfo: SignedInfo{
 			CanonicalizationMethod: Method{
-				Algorithm: "http://www.w3.org/2001/10/xml-exc-c14n#",
+				Algorithm: ExcC14N,
 			},
 			SignatureMethod: Method{
-				Algorithm: "http://www.w3.org/2000/09/xmldsig#rsa-sha1",
+				Algorithm: RSASHA1,
 			},
 			Reference: Reference{
 				ReferenceTransforms: []Method{
-					Method{Algorithm: "http://www.w3.org/2000/09/xmldsig#enveloped-signature"},
+					Method{Algorithm: EnvelopedSignature},
 				},
 				DigestMethod: Method{
-					Algorithm: "http://www.w3.org/2000/09/xmldsig#sha1",
+					Algorithm: SHA1,
 				},
 			},
 		},
 		X509Certificate: &SignatureX509Data{
-			X509Certificate: certificate,
+			X509Certificates: append([]string{certificate}, intermediates...),
 		},
 	}
 }
 
+// NewSignature is like DefaultSignature, but canonicalizes both the
+// SignedInfo and the signed element with canonicalizationMethod, which must
+// be one of C14N, C14NWithComments, ExcC14N and ExcC14NWithComments. The
+// method is added to the Reference transforms after the enveloped
+// signature transform, which is what makes xmlsec1 apply it to the digest
+// as well as declare it.
+func NewSignature(canonicalizationMethod string, certificate string, intermediates ...string) (Signature, error) {
+	if err := CheckCanonicalizationMethod(canonicalizationMethod); err != nil {
+		return Signature{}, err
+	}
+	signature := DefaultSignature(certificate, intermediates...)
+	signature.SignedInfo.CanonicalizationMethod.Algorithm = canonicalizationMethod
+	signature.SignedInfo.Reference.ReferenceTransforms = append(signature.SignedInfo.Reference.ReferenceTransforms,
+		Method{Algorithm: canonicalizationMethod})
+	return signature, nil
+}
+
 const encTempl = `<EncryptedData Type="http://www.w3.org/2001/04/xmlenc#Element" xmlns="http://www.w3.org/2001/04/xmlenc#">
-	<EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#aes256-cbc"/>
+	<EncryptionMethod Algorithm="%s"/>
 	<KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#">
 		<EncryptedKey xmlns="http://www.w3.org/2001/04/xmlenc#">
-			<EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p">
-				<DigestMethod Algorithm="http://www.w3.org/2000/09/xmldsig#sha1" xmlns="http://www.w3.org/2000/09/xmldsig#"/>
+			<EncryptionMethod Algorithm="%s">%s
 			</EncryptionMethod>
 			<KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#">
 				<X509Data>
@@ -167,8 +605,39 @@ const encTempl = `<EncryptedData Type="http://www.w3.org/2001/04/xmlenc#Element"
 	</CipherData>
 </EncryptedData>`
 
-// Encrypt encrypt an xml plaintext value with a private key
+// Encrypt encrypt an xml plaintext value with a private key, using AES-256
+// in CBC mode.
 func Encrypt(plaintext string, publicKey string) (string, error) {
+	return EncryptWithMethod(plaintext, publicKey, AES256CBC)
+}
+
+// EncryptWithMethod is like Encrypt, but encrypts the data with method,
+// which is one of AES128CBC, AES192CBC, AES256CBC, TripleDESCBC,
+// AES128GCM and AES256GCM.
+func EncryptWithMethod(plaintext string, publicKey string, method string) (string, error) {
+	return EncryptWithKeyTransport(plaintext, publicKey, method, DefaultKeyTransport)
+}
+
+// EncryptWithKeyTransport is like EncryptWithMethod, but encrypts the
+// session key to publicKey with keyTransport rather than
+// DefaultKeyTransport.
+func EncryptWithKeyTransport(plaintext string, publicKey string, method string, keyTransport KeyTransport) (string, error) {
+	sessionKey, ok := sessionKeys[method]
+	if !ok {
+		return "", fmt.Errorf("unsupported encryption method %q", method)
+	}
+	if err := CheckKeyTransport(keyTransport); err != nil {
+		return "", err
+	}
+	keyTransportParams := ""
+	if keyTransport.DigestMethod != "" {
+		keyTransportParams += fmt.Sprintf(`
+				<DigestMethod Algorithm="%s" xmlns="http://www.w3.org/2000/09/xmldsig#"/>`, keyTransport.DigestMethod)
+	}
+	if keyTransport.MGF != "" {
+		keyTransportParams += fmt.Sprintf(`
+				<MGF Algorithm="%s" xmlns="http://www.w3.org/2009/xmlenc11#"/>`, keyTransport.MGF)
+	}
 
 	publicKeyFile, err := writeToTemp(publicKey)
 	if err != nil {
@@ -182,7 +651,7 @@ func Encrypt(plaintext string, publicKey string) (string, error) {
 	}
 	defer deleteTempFile(samlXmlsecInput.Name())
 
-	samlXmlsecTemplate, err := writeToTemp(encTempl)
+	samlXmlsecTemplate, err := writeToTemp(fmt.Sprintf(encTempl, method, keyTransport.Algorithm, keyTransportParams))
 	if err != nil {
 		return "", err
 	}
@@ -195,7 +664,7 @@ func Encrypt(plaintext string, publicKey string) (string, error) {
 	defer deleteTempFile(samlXmlsecOutput.Name())
 	samlXmlsecOutput.Close()
 
-	output, err := exec.Command("xmlsec1", "--encrypt", "--session-key", "aes-256-cbc", "--pubkey-cert-pem", publicKeyFile.Name(),
+	output, err := exec.Command("xmlsec1", "--encrypt", "--session-key", sessionKey, "--pubkey-cert-pem", publicKeyFile.Name(),
 		"--output", samlXmlsecOutput.Name(), "--xml-data", samlXmlsecInput.Name(), samlXmlsecTemplate.Name()).CombinedOutput()
 	if err != nil {
 		return "", errors.New(err.Error() + " : " + string(output))
@@ -209,8 +678,37 @@ func Encrypt(plaintext string, publicKey string) (string, error) {
 	return encryptedXML, nil
 }
 
-// Decrypt decrypt an xml cipher value with a third-party public key
+// Decrypt decrypt an xml cipher value with a third-party public key. The
+// data may be encrypted with any of the methods that EncryptWithMethod
+// supports.
 func Decrypt(cipher string, privateKey *rsa.PrivateKey) (string, error) {
+	return DecryptContext(context.Background(), cipher, privateKey)
+}
+
+// DecryptContext is like Decrypt, but gives up and returns ctx.Err() if ctx
+// is done before cipher is decrypted.
+func DecryptContext(ctx context.Context, cipher string, privateKey *rsa.PrivateKey) (string, error) {
+	return DecryptWithOptions(ctx, cipher, privateKey, DecryptOptions{})
+}
+
+// DecryptOptions relax the checks that DecryptWithOptions makes of the
+// algorithms of an EncryptedData.
+type DecryptOptions struct {
+	// AllowRSA15 accepts session keys encrypted with RSA15, for IDPs that
+	// cannot use OAEP.
+	AllowRSA15 bool
+}
+
+// DecryptWithOptions is like DecryptContext, but checks the algorithms of
+// cipher as opts say.
+func DecryptWithOptions(ctx context.Context, cipher string, privateKey *rsa.PrivateKey, opts DecryptOptions) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if err := checkEncryptionMethod(cipher, opts); err != nil {
+		return "", err
+	}
+
 	privateKeyFile, err := writePrivateKey(privateKey)
 	if err != nil {
 		return "", err
@@ -230,8 +728,12 @@ func Decrypt(cipher string, privateKey *rsa.PrivateKey) (string, error) {
 	defer deleteTempFile(samlXmlsecOutput.Name())
 	samlXmlsecOutput.Close()
 
-	output, err := exec.Command("xmlsec1", "--decrypt", "--privkey-der", privateKeyFile.Name(), "--id-attr:ID", "http://www.w3.org/2001/04/xmlenc#EncryptedData",
+	output, err := exec.CommandContext(ctx, "xmlsec1", "--decrypt", "--privkey-der", privateKeyFile.Name(), "--id-attr:ID", "http://www.w3.org/2001/04/xmlenc#EncryptedData",
 		"--output", samlXmlsecOutput.Name(), samlXmlsecInput.Name()).CombinedOutput()
+	if ctx.Err() != nil {
+		// xmlsec1 was killed
+		return "", ctx.Err()
+	}
 	if err != nil {
 		return "", errors.New(err.Error() + " : " + string(output))
 	}
@@ -244,6 +746,42 @@ func Decrypt(cipher string, privateKey *rsa.PrivateKey) (string, error) {
 	return decryptedXML, nil
 }
 
+// checkEncryptionMethod returns an error unless the EncryptedData in cipher
+// is encrypted with a method in sessionKeys and, if it has an EncryptedKey
+// in its KeyInfo, with a key transport that CheckKeyTransport accepts, or
+// with RSA15 if opts allow it.
+func checkEncryptionMethod(cipher string, opts DecryptOptions) error {
+	// The elements are matched by local name only, as the xenc prefix
+	// may be declared outside of cipher.
+	encryptedData := struct {
+		XMLName          xml.Name `xml:"EncryptedData"`
+		EncryptionMethod Method   `xml:"EncryptionMethod"`
+		KeyTransport     struct {
+			Algorithm    string `xml:",attr"`
+			DigestMethod Method `xml:"DigestMethod"`
+			MGF          Method `xml:"MGF"`
+		} `xml:"KeyInfo>EncryptedKey>EncryptionMethod"`
+	}{}
+	if err := xml.Unmarshal([]byte(cipher), &encryptedData); err != nil {
+		return fmt.Errorf("cannot parse EncryptedData: %s", err)
+	}
+	if _, ok := sessionKeys[encryptedData.EncryptionMethod.Algorithm]; !ok {
+		return fmt.Errorf("unsupported encryption method %q", encryptedData.EncryptionMethod.Algorithm)
+	}
+	if encryptedData.KeyTransport.Algorithm == "" {
+		// e.g. the EncryptedKey is referred to by a RetrievalMethod
+		return nil
+	}
+	if encryptedData.KeyTransport.Algorithm == RSA15 && opts.AllowRSA15 {
+		return nil
+	}
+	return CheckKeyTransport(KeyTransport{
+		Algorithm:    encryptedData.KeyTransport.Algorithm,
+		DigestMethod: encryptedData.KeyTransport.DigestMethod.Algorithm,
+		MGF:          encryptedData.KeyTransport.MGF.Algorithm,
+	})
+}
+
 // writeToTemp write a string to a temporary file and close
 // Caller is responsible for its lifetime
 func writeToTemp(val string) (*os.File, error) {